@@ -0,0 +1,119 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/bowei/lighthouse/pkg/capture"
+	"github.com/bowei/lighthouse/pkg/tcpdump"
+	"github.com/golang/glog"
+)
+
+var (
+	captureFlagSet = flag.NewFlagSet("capture", flag.ExitOnError)
+	captureFlags   = struct {
+		backend       *string
+		count         *int
+		fileSize      *int
+		rotateSeconds *int
+		iface         *string
+		snapLen       *int
+		outputFile    *string
+		fileCount     *int
+		noResolve     *bool
+		noPromiscuous *bool
+		bufferSize    *int
+		immediateMode *bool
+		direction     *string
+		timestampType *string
+		nano          *bool
+		user          *string
+		postRotate    *string
+	}{
+		backend:       captureFlagSet.String("backend", "auto", "capture backend (auto, tcpdump, native); auto uses tcpdump if it is installed"),
+		count:         captureFlagSet.Int("count", 0, "exit after this many packets (-c)"),
+		fileSize:      captureFlagSet.Int("file-size", 0, "start a new file after this many millions of bytes (-C)"),
+		rotateSeconds: captureFlagSet.Int("rotate-seconds", 0, "start a new file every this many seconds (-G); tcpdump only"),
+		iface:         captureFlagSet.String("interface", "", "interface to capture on (-i)"),
+		snapLen:       captureFlagSet.Int("snaplen", 0, "bytes to capture from each packet (-s); 0 for the default"),
+		outputFile:    captureFlagSet.String("w", "", "file to write the capture to (-w)"),
+		fileCount:     captureFlagSet.Int("file-count", 0, "with --file-size, keep at most this many files (-W)"),
+		noResolve:     captureFlagSet.Bool("no-resolve", false, "do not convert addresses to names (-n)"),
+		noPromiscuous: captureFlagSet.Bool("no-promiscuous", false, "do not put the interface in promiscuous mode (-p)"),
+		bufferSize:    captureFlagSet.Int("buffer-size", 0, "capture buffer size in KiB (-B); tcpdump only"),
+		immediateMode: captureFlagSet.Bool("immediate-mode", false, "deliver packets as soon as they arrive (--immediate-mode)"),
+		direction:     captureFlagSet.String("direction", "", "capture only packets in this direction: in, out or inout (-Q); tcpdump only"),
+		timestampType: captureFlagSet.String("time-stamp-type", "", "timestamp type, such as host or adapter (-j); tcpdump only"),
+		nano:          captureFlagSet.Bool("nano", false, "write nanosecond timestamps (--time-stamp-precision=nano); tcpdump only"),
+		user:          captureFlagSet.String("user", "", "drop privileges to this user (-Z); tcpdump only"),
+		postRotate:    captureFlagSet.String("post-rotate-command", "", "run this command on each file after rotation (-z); tcpdump only"),
+	}
+)
+
+func init() {
+	allSubcommands["capture"] = &captureCommand{}
+}
+
+type captureCommand struct{}
+
+func (c *captureCommand) flags() *flag.FlagSet {
+	return captureFlagSet
+}
+
+func (c *captureCommand) run() int {
+	var capturer capture.Capturer
+	switch *captureFlags.backend {
+	case "auto":
+		capturer = capture.New()
+	case "tcpdump":
+		capturer = &tcpdump.Runner{}
+	case "native":
+		capturer = &capture.Native{}
+	default:
+		fmt.Printf("Invalid --backend %q\n", *captureFlags.backend)
+		return 1
+	}
+	opt := &tcpdump.Options{
+		Count:          *captureFlags.count,
+		FileSize:       *captureFlags.fileSize,
+		RotateSeconds:  *captureFlags.rotateSeconds,
+		Interface:      *captureFlags.iface,
+		SnapLen:        *captureFlags.snapLen,
+		OutputFile:     *captureFlags.outputFile,
+		FileCountLimit: *captureFlags.fileCount,
+
+		NoResolve:         *captureFlags.noResolve,
+		NoPromiscuous:     *captureFlags.noPromiscuous,
+		BufferSize:        *captureFlags.bufferSize,
+		ImmediateMode:     *captureFlags.immediateMode,
+		Direction:         *captureFlags.direction,
+		TimestampType:     *captureFlags.timestampType,
+		NanoPrecision:     *captureFlags.nano,
+		User:              *captureFlags.user,
+		PostRotateCommand: *captureFlags.postRotate,
+	}
+	filter := strings.Join(captureFlagSet.Args(), " ")
+	glog.V(2).Infof("capture with %T, options %+v, filter %q", capturer, opt, filter)
+	if err := capturer.Run(opt, filter); err != nil {
+		fmt.Printf("Error capturing: %v\n", err)
+		return 1
+	}
+	return 0
+}
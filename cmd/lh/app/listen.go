@@ -0,0 +1,135 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/probe"
+	"github.com/golang/glog"
+)
+
+var (
+	listenFlagSet = flag.NewFlagSet("listen", flag.ExitOnError)
+	listenFlags   = struct {
+		interfaces *string
+		magic      *string
+		count      *int
+		json       *bool
+	}{
+		interfaces: listenFlagSet.String("interfaces", "", "comma separated interfaces to listen on; all interfaces if empty"),
+		magic:      listenFlagSet.String("magic", "", "only report probes with this magic; all probes if empty"),
+		count:      listenFlagSet.Int("count", 0, "exit after this many probes; 0 to run until interrupted"),
+		json:       listenFlagSet.Bool("json", false, "print each probe as a JSON object"),
+	}
+)
+
+func init() {
+	allSubcommands["listen"] = &listenCommand{}
+}
+
+type listenCommand struct{}
+
+func (c *listenCommand) flags() *flag.FlagSet {
+	return listenFlagSet
+}
+
+// listenEvent is the JSON form of a probe.ProbeEvent.
+type listenEvent struct {
+	ID         string    `json:"id"`
+	Magic      string    `json:"magic"`
+	Sender     string    `json:"sender"`
+	SentAt     time.Time `json:"sent_at"`
+	Protocol   string    `json:"protocol"`
+	Src        string    `json:"src"`
+	SrcPort    int       `json:"src_port,omitempty"`
+	Dest       string    `json:"dest"`
+	DestPort   int       `json:"dest_port,omitempty"`
+	Interface  string    `json:"interface"`
+	Timestamp  time.Time `json:"timestamp"`
+	TTL        int       `json:"ttl"`
+	Fragmented bool      `json:"fragmented,omitempty"`
+}
+
+func (c *listenCommand) run() int {
+	var interfaces []string
+	for _, name := range strings.Split(*listenFlags.interfaces, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			interfaces = append(interfaces, name)
+		}
+	}
+	r, err := probe.NewReceiver(interfaces)
+	if err != nil {
+		fmt.Printf("Error listening: %v\n", err)
+		return 1
+	}
+	r.Magic = *listenFlags.magic
+
+	// Stop on SIGINT or SIGTERM by closing the receiver, which makes
+	// Next return an error.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-signals
+		close(stopped)
+		r.Close()
+	}()
+
+	enc := json.NewEncoder(os.Stdout)
+	for n := 0; *listenFlags.count == 0 || n < *listenFlags.count; n++ {
+		e, err := r.Next()
+		if err != nil {
+			select {
+			case <-stopped:
+				return 0
+			default:
+			}
+			fmt.Printf("Error receiving: %v\n", err)
+			return 1
+		}
+		glog.V(2).Infof("Received %v", e)
+		if !*listenFlags.json {
+			fmt.Println(e)
+			continue
+		}
+		enc.Encode(listenEvent{
+			ID:         fmt.Sprintf("%016x", e.Identity.ID),
+			Magic:      e.Identity.Magic,
+			Sender:     e.Identity.Sender,
+			SentAt:     e.Identity.Timestamp,
+			Protocol:   e.Protocol,
+			Src:        e.Src.String(),
+			SrcPort:    e.SrcPort,
+			Dest:       e.Dest.String(),
+			DestPort:   e.DestPort,
+			Interface:  e.Interface,
+			Timestamp:  e.Timestamp,
+			TTL:        e.TTL,
+			Fragmented: e.Fragmented,
+		})
+	}
+	r.Close()
+	return 0
+}
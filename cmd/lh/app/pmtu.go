@@ -0,0 +1,72 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/probe"
+	"github.com/golang/glog"
+)
+
+var (
+	pmtuFlagSet = flag.NewFlagSet("pmtu", flag.ExitOnError)
+	pmtuFlags   = struct {
+		src      *string
+		srcPort  *int
+		endpoint *string
+		port     *int
+		magic    *string
+		timeout  *time.Duration
+		maxSize  *int
+	}{
+		src:      pmtuFlagSet.String("src", "", "source address; chosen by route lookup if empty"),
+		srcPort:  pmtuFlagSet.Int("src-port", 0, "source port; an unused ephemeral port is chosen if 0"),
+		endpoint: pmtuFlagSet.String("endpoint", "", "endpoint to discover the path MTU to"),
+		port:     pmtuFlagSet.Int("port", 80, "TCP port to send to"),
+		magic:    pmtuFlagSet.String("magic", "magic", "magic packet identity"),
+		timeout:  pmtuFlagSet.Duration("timeout", time.Second, "time to wait for a reply to each probe"),
+		maxSize:  pmtuFlagSet.Int("max-size", 0, "largest packet size to try; 0 for the MTU of the local interface"),
+	}
+)
+
+func init() {
+	allSubcommands["pmtu"] = &pmtuCommand{}
+}
+
+type pmtuCommand struct{}
+
+func (c *pmtuCommand) flags() *flag.FlagSet {
+	return pmtuFlagSet
+}
+
+func (c *pmtuCommand) run() int {
+	opt := &probe.Options{Timeout: *pmtuFlags.timeout}
+	report, err := probe.DiscoverPMTU(*pmtuFlags.src, *pmtuFlags.srcPort, *pmtuFlags.endpoint, *pmtuFlags.port, *pmtuFlags.magic, *pmtuFlags.maxSize, opt)
+	glog.V(2).Infof("DiscoverPMTU = %v, %v", report, err)
+	if err != nil {
+		fmt.Printf("Error discovering path MTU: %v\n", err)
+		return 1
+	}
+	fmt.Println(report)
+	if report.BlackHole() {
+		return 1
+	}
+	return 0
+}
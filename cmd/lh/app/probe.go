@@ -18,21 +18,82 @@ package app
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/bowei/lighthouse/pkg/probe"
+	"github.com/bowei/lighthouse/pkg/target"
 	"github.com/golang/glog"
 )
 
 var (
 	probeFlagSet = flag.NewFlagSet("probe", flag.ExitOnError)
 	probeFlags   = struct {
-		endpoint *string
-		port     *int
-		magic    *string
+		protocol        *string
+		src             *string
+		srcPort         *int
+		endpoint        *string
+		port            *string
+		targets         *string
+		parallel        *int
+		rate            *float64
+		perDestRate     *float64
+		perDestInFlight *int
+		retries         *int
+		backoff         *time.Duration
+		shuffle         *bool
+		magic           *string
+		timeout         *time.Duration
+		tcpOptions      *string
+		ttl             *int
+		dscp            *int
+		df              *bool
+		ipID            *int
+		flowLabel       *int
+		fragSize        *int
+		fragOrder       *string
+		fragDelay       *time.Duration
+		ecn             *string
+		ecnSetup        *bool
+		suite           *string
+		handshake       *bool
+		suppress        *bool
 	}{
-		endpoint: probeFlagSet.String("endpoint", "", "endpoint to send to"),
-		port:     probeFlagSet.Int("port", 80, "port to send to"),
-		magic:    probeFlagSet.String("magic", "magic", "magic packet identity"),
+		protocol:        probeFlagSet.String("protocol", "tcp", "protocol to probe with (tcp, udp, icmp, sctp)"),
+		src:             probeFlagSet.String("src", "", "source address; chosen by route lookup if empty"),
+		srcPort:         probeFlagSet.Int("src-port", 0, "source port; an unused ephemeral port is chosen if 0 (with several targets, requires --parallel=1)"),
+		endpoint:        probeFlagSet.String("endpoint", "", "comma separated addresses, CIDR blocks and hostnames to send to"),
+		port:            probeFlagSet.String("port", "80", "comma separated ports and port ranges to send to"),
+		targets:         probeFlagSet.String("targets-file", "", "file with one \"<endpoints> [ports]\" per line to send to, in addition to --endpoint"),
+		parallel:        probeFlagSet.Int("parallel", 16, "number of targets to probe at once"),
+		rate:            probeFlagSet.Float64("rate", 100, "maximum probes per second across all targets; 0 for no limit"),
+		perDestRate:     probeFlagSet.Float64("per-dest-rate", 10, "maximum probes per second to each address; 0 for no limit"),
+		perDestInFlight: probeFlagSet.Int("per-dest-in-flight", 4, "maximum probes in flight to each address; 0 for no limit"),
+		retries:         probeFlagSet.Int("retries", 0, "number of times to resend a probe that got no reply or could not be sent"),
+		backoff:         probeFlagSet.Duration("backoff", 100*time.Millisecond, "delay before the first retry, doubled for each retry"),
+		shuffle:         probeFlagSet.Bool("shuffle", true, "probe the targets in a random order"),
+		magic:           probeFlagSet.String("magic", "magic", "magic packet identity"),
+		timeout:         probeFlagSet.Duration("timeout", 3*time.Second, "time to wait for a reply"),
+		tcpOptions:      probeFlagSet.String("tcp-options", "", "comma separated TCP options (mss=N, wscale=N, sackok, ts, probeid, probeid254, nop)"),
+		ttl:             probeFlagSet.Int("ttl", 0, "IP TTL (or IPv6 hop limit); 0 for the system default"),
+		dscp:            probeFlagSet.Int("dscp", 0, "IP DSCP (0-63)"),
+		df:              probeFlagSet.Bool("df", false, "set the IPv4 don't fragment bit (for IPv6, disable fragmentation)"),
+		ipID:            probeFlagSet.Int("ip-id", 0, "IPv4 identification; 0 lets the kernel choose"),
+		flowLabel:       probeFlagSet.Int("flow-label", 0, "IPv6 flow label; 0 lets the kernel choose"),
+		fragSize:        probeFlagSet.Int("fragment-size", 0, "split the probe into IP fragments of this many payload bytes; 0 to not fragment"),
+		fragOrder:       probeFlagSet.String("fragment-order", "in-order", "order to send fragments in (in-order, reversed, overlapping)"),
+		fragDelay:       probeFlagSet.Duration("fragment-delay", 0, "delay between fragments (not included in the RTT)"),
+		ecn:             probeFlagSet.String("ecn", "", "test ECN: send with this codepoint (not-ect, ect0, ect1, ce) and report negotiation and the codepoint of the reply; bleaching is detected from ICMP quotes, so it needs a --ttl low enough for the probe to expire on the way"),
+		ecnSetup:        probeFlagSet.Bool("ecn-setup", true, "with --ecn, send TCP probes as ECN-setup SYNs"),
+		handshake:       probeFlagSet.Bool("handshake", false, "complete a TCP handshake from userspace, send the identity as data and close, reporting each step (needs --suppress-rst)"),
+		suppress:        probeFlagSet.Bool("suppress-rst", false, "with --handshake, add an iptables OUTPUT rule dropping the kernel's RSTs for the connection while it runs; without it, the kernel resets the connection as soon as the SYN-ACK arrives"),
+		suite:           probeFlagSet.String("suite", "", fmt.Sprintf("run a named TCP test suite instead of a single probe (%s)", strings.Join(probe.TCPSuites(), ", "))),
 	}
 )
 
@@ -46,10 +107,254 @@ func (c *probeCommand) flags() *flag.FlagSet {
 	return probeFlagSet
 }
 
+var probeSendFuncs = map[string]probe.SendFunc{
+	"tcp":  probe.SendTCP,
+	"udp":  probe.SendUDP,
+	"sctp": probe.SendSCTP,
+	"icmp": func(src string, _ int, dest string, _ int, magic string, opt *probe.Options) (*probe.Result, error) {
+		return probe.SendICMP(src, dest, magic, opt)
+	},
+}
+
 func (c *probeCommand) run() int {
-	glog.Errorf("runProbe endpoint=%s magic=%s", *probeFlags.endpoint, *probeFlags.magic)
-	err := probe.SendTCP("127.0.0.1", 3000, *probeFlags.endpoint, *probeFlags.port, *probeFlags.magic)
-	glog.Errorf("probe.SendTCP = %v", err)
+	glog.Errorf("runProbe protocol=%s endpoint=%s magic=%s", *probeFlags.protocol, *probeFlags.endpoint, *probeFlags.magic)
+	send, ok := probeSendFuncs[*probeFlags.protocol]
+	if !ok {
+		fmt.Printf("Invalid protocol %q\n", *probeFlags.protocol)
+		return 1
+	}
+	tcpOptions, err := probe.ParseTCPOptions(*probeFlags.tcpOptions)
+	if err != nil {
+		fmt.Printf("Invalid --tcp-options: %v\n", err)
+		return 1
+	}
+	fragOrder, err := probe.ParseFragmentOrder(*probeFlags.fragOrder)
+	if err != nil {
+		fmt.Printf("Invalid --fragment-order: %v\n", err)
+		return 1
+	}
+	var (
+		ecn      probe.ECNCodepoint
+		ecnSetup bool
+	)
+	if *probeFlags.ecn != "" {
+		if ecn, err = probe.ParseECNCodepoint(*probeFlags.ecn); err != nil {
+			fmt.Printf("Invalid --ecn: %v\n", err)
+			return 1
+		}
+		ecnSetup = *probeFlags.ecnSetup
+	}
+	opt := &probe.Options{
+		Timeout:       *probeFlags.timeout,
+		TCPOptions:    tcpOptions,
+		TTL:           *probeFlags.ttl,
+		DSCP:          *probeFlags.dscp,
+		ECN:           ecn,
+		DontFragment:  *probeFlags.df,
+		IPID:          *probeFlags.ipID,
+		FlowLabel:     *probeFlags.flowLabel,
+		FragmentSize:  *probeFlags.fragSize,
+		FragmentOrder: fragOrder,
+		FragmentDelay: *probeFlags.fragDelay,
+		ECNSetup:      ecnSetup,
+		SuppressRST:   *probeFlags.suppress,
+	}
+	targets, err := probeTargets()
+	if err != nil {
+		fmt.Printf("Invalid targets: %v\n", err)
+		return 1
+	}
+	if *probeFlags.suite != "" || *probeFlags.handshake {
+		t, err := target.Single(targets)
+		if err != nil {
+			fmt.Printf("--suite and --handshake: %v\n", err)
+			return 1
+		}
+		if *probeFlags.suite != "" {
+			return runSuite(t, opt)
+		}
+		return runHandshake(t, opt)
+	}
+	if len(targets) > 1 {
+		return runTargets(send, targets, opt)
+	}
+	sched := probe.SchedulerOptions{Retries: *probeFlags.retries, Backoff: *probeFlags.backoff}
+	job := probe.Job{Src: *probeFlags.src, SrcPort: *probeFlags.srcPort, Dest: targets[0].IP.String(), Port: targets[0].Port, Magic: *probeFlags.magic}
+	jr := probe.NewScheduler(send, opt, sched).Run([]probe.Job{job})[0]
+	glog.Errorf("send = %v, %v", jr.Result, jr.Err)
+	if jr.Err != nil {
+		return 1
+	}
+	fmt.Println(jr.Result)
 
 	return 0
 }
+
+// probeTargets expands --endpoint, --port and --targets-file.
+func probeTargets() ([]target.Target, error) {
+	var targets []target.Target
+	if *probeFlags.endpoint != "" {
+		expanded, err := target.Expand(*probeFlags.endpoint, *probeFlags.port)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, expanded...)
+	}
+	if *probeFlags.targets != "" {
+		f, err := os.Open(*probeFlags.targets)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fromFile, err := target.ReadFile(f, *probeFlags.port)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", *probeFlags.targets, err)
+		}
+		targets = append(targets, fromFile...)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets; set --endpoint or --targets-file")
+	}
+	// Remove targets given more than once. ICMP has no ports, so each
+	// address is probed once.
+	seen := map[string]bool{}
+	var unique []target.Target
+	for _, t := range targets {
+		if *probeFlags.protocol == "icmp" {
+			t.Port = 0
+		}
+		if !seen[t.String()] {
+			seen[t.String()] = true
+			unique = append(unique, t)
+		}
+	}
+	return unique, nil
+}
+
+// runTargets probes every target with a probe.Scheduler and prints a
+// table of the results. It returns 1 if any probe failed to send.
+func runTargets(send probe.SendFunc, targets []target.Target, opt *probe.Options) int {
+	sched := probe.SchedulerOptions{
+		Workers:         *probeFlags.parallel,
+		Rate:            *probeFlags.rate,
+		PerDestRate:     *probeFlags.perDestRate,
+		PerDestInFlight: *probeFlags.perDestInFlight,
+		Retries:         *probeFlags.retries,
+		Backoff:         *probeFlags.backoff,
+		Shuffle:         *probeFlags.shuffle,
+	}
+	// Probes sent at the same time need distinct source ports, so a fixed
+	// --src-port can only be used when probing one target at a time.
+	if *probeFlags.srcPort != 0 && sched.Workers != 1 {
+		fmt.Printf("--src-port with %d targets requires --parallel=1\n", len(targets))
+		return 1
+	}
+	jobs := make([]probe.Job, len(targets))
+	for i, t := range targets {
+		jobs[i] = probe.Job{Src: *probeFlags.src, SrcPort: *probeFlags.srcPort, Dest: t.IP.String(), Port: t.Port, Magic: *probeFlags.magic}
+	}
+	results := probe.NewScheduler(send, opt, sched).Run(jobs)
+
+	ret := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tNAME\tVERDICT\tREASON\tFROM\tRTT\tATTEMPTS")
+	for i, r := range results {
+		t := targets[i]
+		addr := t.IP.String()
+		if *probeFlags.protocol != "icmp" {
+			addr = t.String()
+		}
+		if r.Err != nil {
+			ret = 1
+			fmt.Fprintf(w, "%s\t%s\terror\t%v\t\t\t%d\n", addr, t.Name, r.Err, r.Attempts)
+			continue
+		}
+		from, rtt := "", ""
+		if r.Result.From != nil {
+			from, rtt = r.Result.From.String(), r.Result.RTT.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\t%d\n", addr, t.Name, r.Result.Verdict, r.Result.Reason, from, rtt, r.Attempts)
+	}
+	w.Flush()
+	fmt.Println(summarizeVerdicts(results))
+	return ret
+}
+
+// summarizeVerdicts counts the results by verdict, e.g. "3 targets: 2
+// open, 1 filtered".
+func summarizeVerdicts(results []probe.JobResult) string {
+	var (
+		order  []string
+		counts = map[string]int{}
+	)
+	for _, r := range results {
+		v := "error"
+		if r.Err == nil {
+			v = fmt.Sprint(r.Result.Verdict)
+		}
+		if counts[v] == 0 {
+			order = append(order, v)
+		}
+		counts[v]++
+	}
+	parts := make([]string, len(order))
+	for i, v := range order {
+		parts[i] = strconv.Itoa(counts[v]) + " " + v
+	}
+	return fmt.Sprintf("%d targets: %s", len(results), strings.Join(parts, ", "))
+}
+
+func runSuite(t target.Target, opt *probe.Options) int {
+	if *probeFlags.protocol != "tcp" {
+		fmt.Printf("--suite requires --protocol=tcp\n")
+		return 1
+	}
+	report, err := probe.RunTCPSuite(*probeFlags.suite, *probeFlags.src, *probeFlags.srcPort, t.IP.String(), t.Port, *probeFlags.magic, opt)
+	if err != nil {
+		fmt.Printf("Error running suite: %v\n", err)
+		return 1
+	}
+	fmt.Println(report)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+func runHandshake(t target.Target, opt *probe.Options) int {
+	if *probeFlags.protocol != "tcp" {
+		fmt.Printf("--handshake requires --protocol=tcp\n")
+		return 1
+	}
+	// Without the rule, the kernel resets the connection when the SYN-ACK
+	// arrives and every step after the SYN fails because of this host,
+	// not the path.
+	if !opt.SuppressRST {
+		fmt.Printf("--handshake requires --suppress-rst, which adds an iptables rule dropping the kernel's RSTs for the connection\n")
+		return 1
+	}
+	// Remove the iptables rule if interrupted.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-signals:
+			probe.RemoveRSTFilters()
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	report, err := probe.Handshake(*probeFlags.src, *probeFlags.srcPort, t.IP.String(), t.Port, *probeFlags.magic, opt)
+	if err != nil {
+		fmt.Printf("Error running handshake: %v\n", err)
+		return 1
+	}
+	fmt.Println(report)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
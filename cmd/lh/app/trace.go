@@ -0,0 +1,115 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/probe"
+	"github.com/golang/glog"
+)
+
+var (
+	traceFlagSet = flag.NewFlagSet("trace", flag.ExitOnError)
+	traceFlags   = struct {
+		src      *string
+		srcPort  *int
+		endpoint *string
+		port     *int
+		magic    *string
+		timeout  *time.Duration
+		maxTTL   *int
+		flows    *int
+		tracebox *bool
+		options  *string
+	}{
+		src:      traceFlagSet.String("src", "", "source address; chosen by route lookup if empty"),
+		srcPort:  traceFlagSet.Int("src-port", 0, "source port; an unused ephemeral port is chosen if 0"),
+		endpoint: traceFlagSet.String("endpoint", "", "endpoint to trace to"),
+		port:     traceFlagSet.Int("port", 80, "TCP port to trace to"),
+		magic:    traceFlagSet.String("magic", "magic", "magic packet identity"),
+		timeout:  traceFlagSet.Duration("timeout", time.Second, "time to wait for a reply at each hop"),
+		maxTTL:   traceFlagSet.Int("max-ttl", 30, "maximum number of hops"),
+		tracebox: traceFlagSet.Bool("tracebox", false, "report the header fields that middleboxes modify, using the quotations in ICMP time exceeded messages"),
+		options:  traceFlagSet.String("tcp-options", "", "comma separated TCP options to send (see lh probe); with --tracebox, defaults to mss, sackok, ts and wscale"),
+		flows:    traceFlagSet.Int("flows", 0, "discover ECMP paths by tracing this many flows (varying the source port and IPv6 flow label); 0 for a single flow; not supported with --tracebox"),
+	}
+)
+
+func init() {
+	allSubcommands["trace"] = &traceCommand{}
+}
+
+type traceCommand struct{}
+
+func (c *traceCommand) flags() *flag.FlagSet {
+	return traceFlagSet
+}
+
+func (c *traceCommand) run() int {
+	tcpOptions, err := probe.ParseTCPOptions(*traceFlags.options)
+	if err != nil {
+		fmt.Printf("Invalid --tcp-options: %v\n", err)
+		return 1
+	}
+	opt := &probe.Options{Timeout: *traceFlags.timeout, TCPOptions: tcpOptions}
+	if *traceFlags.tracebox {
+		if *traceFlags.flows > 0 {
+			fmt.Printf("--tracebox traces a single flow and cannot be used with --flows\n")
+			return 1
+		}
+		return runTracebox(opt)
+	}
+	if *traceFlags.flows > 0 {
+		return runMultipath(opt)
+	}
+	report, err := probe.TraceTCP(*traceFlags.src, *traceFlags.srcPort, *traceFlags.endpoint, *traceFlags.port, *traceFlags.magic, *traceFlags.maxTTL, opt)
+	glog.V(2).Infof("TraceTCP = %v, %v", report, err)
+	if err != nil {
+		fmt.Printf("Error tracing: %v\n", err)
+		return 1
+	}
+	fmt.Println(report)
+	if !report.Reached() {
+		return 1
+	}
+	return 0
+}
+
+func runMultipath(opt *probe.Options) int {
+	graph, err := probe.TraceMultipath(*traceFlags.src, *traceFlags.srcPort, *traceFlags.endpoint, *traceFlags.port, *traceFlags.magic, *traceFlags.maxTTL, *traceFlags.flows, opt)
+	glog.V(2).Infof("TraceMultipath = %v, %v", graph, err)
+	if err != nil {
+		fmt.Printf("Error tracing: %v\n", err)
+		return 1
+	}
+	fmt.Println(graph)
+	return 0
+}
+
+func runTracebox(opt *probe.Options) int {
+	report, err := probe.Tracebox(*traceFlags.src, *traceFlags.srcPort, *traceFlags.endpoint, *traceFlags.port, *traceFlags.magic, *traceFlags.maxTTL, opt)
+	glog.V(2).Infof("Tracebox = %v, %v", report, err)
+	if err != nil {
+		fmt.Printf("Error tracing: %v\n", err)
+		return 1
+	}
+	fmt.Println(report)
+	return 0
+}
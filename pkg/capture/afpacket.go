@@ -0,0 +1,169 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/packetsock"
+	"github.com/bowei/lighthouse/pkg/pcap"
+)
+
+const (
+	// sllHeaderSize is the size of the Linux "cooked" header.
+	sllHeaderSize = 16
+	// sll2HeaderSize is the size of the version 2 Linux "cooked" header.
+	sll2HeaderSize = 20
+)
+
+// sysClassNet is where interface types are read from. It is a variable
+// for testing.
+var sysClassNet = "/sys/class/net"
+
+// afPacketSource reads packets with an AF_PACKET socket. Ethernet and
+// loopback interfaces are read with their link layer header; other
+// interfaces and "any" without, adding a cooked header as libpcap does.
+type afPacketSource struct {
+	sock *packetsock.Socket
+	link pcap.LinkType
+}
+
+// newPacketSource returns a source for the interface, or all interfaces
+// for "any" or "". If promiscuous is set, the interface is put in
+// promiscuous mode; "any" never is.
+func newPacketSource(ifName string, promiscuous bool) (packetSource, error) {
+	s := &afPacketSource{link: pcap.LinkTypeLinuxSLL2}
+	cfg := &packetsock.Config{}
+	if ifName != "" && ifName != "any" {
+		ifi, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Interfaces = []int{ifi.Index}
+		cfg.Promiscuous = promiscuous
+		hwType, err := interfaceType(ifi.Name)
+		if err != nil {
+			return nil, err
+		}
+		switch hwType {
+		case packetsock.ArphrdEther, packetsock.ArphrdLoopback:
+			s.link = pcap.LinkTypeEthernet
+			cfg.LinkLayer = true
+		case packetsock.ArphrdNone:
+			s.link = pcap.LinkTypeRaw
+		default:
+			s.link = pcap.LinkTypeLinuxSLL
+		}
+	}
+
+	sock, err := packetsock.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.sock = sock
+	return s, nil
+}
+
+// interfaceType returns the ARPHRD_* hardware type of the interface.
+func interfaceType(ifName string) (int, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/type", sysClassNet, ifName))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func (s *afPacketSource) linkType() pcap.LinkType {
+	return s.link
+}
+
+func (s *afPacketSource) read(b []byte) (int, int, time.Time, error) {
+	var headerSize int
+	switch s.link {
+	case pcap.LinkTypeLinuxSLL:
+		headerSize = sllHeaderSize
+	case pcap.LinkTypeLinuxSLL2:
+		headerSize = sll2HeaderSize
+	}
+	data := b[headerSize:]
+	for {
+		n, origLen, addr, ts, err := s.sock.Read(data)
+		if err != nil {
+			return 0, 0, time.Time{}, err
+		}
+		// Like libpcap, skip the outgoing copy of packets on loopback,
+		// which are also received.
+		if addr.Pkttype == packetsock.PacketOutgoing && addr.Hatype == packetsock.ArphrdLoopback {
+			continue
+		}
+		switch s.link {
+		case pcap.LinkTypeLinuxSLL:
+			putSLLHeader(b, addr)
+		case pcap.LinkTypeLinuxSLL2:
+			putSLL2Header(b, addr)
+		}
+		return n + headerSize, origLen + headerSize, ts, nil
+	}
+}
+
+// putSLLHeader writes the Linux cooked header for a packet received from
+// addr into b.
+func putSLLHeader(b []byte, addr *packetsock.Addr) {
+	encoder := binary.BigEndian
+	encoder.PutUint16(b[0:], uint16(addr.Pkttype))
+	encoder.PutUint16(b[2:], addr.Hatype)
+	encoder.PutUint16(b[4:], uint16(addr.Halen))
+	for i := range b[6:14] {
+		b[6+i] = 0
+	}
+	halen := int(addr.Halen)
+	if halen > 8 {
+		halen = 8
+	}
+	copy(b[6:], addr.Addr[:halen])
+	encoder.PutUint16(b[14:], addr.Protocol)
+}
+
+// putSLL2Header writes the version 2 Linux cooked header for a packet
+// received from addr into b.
+func putSLL2Header(b []byte, addr *packetsock.Addr) {
+	encoder := binary.BigEndian
+	encoder.PutUint16(b[0:], addr.Protocol)
+	encoder.PutUint16(b[2:], 0)
+	encoder.PutUint32(b[4:], uint32(addr.Ifindex))
+	encoder.PutUint16(b[8:], addr.Hatype)
+	b[10] = addr.Pkttype
+	b[11] = addr.Halen
+	for i := range b[12:20] {
+		b[12+i] = 0
+	}
+	halen := int(addr.Halen)
+	if halen > 8 {
+		halen = 8
+	}
+	copy(b[12:], addr.Addr[:halen])
+}
+
+func (s *afPacketSource) close() error {
+	return s.sock.Close()
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capture
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bowei/lighthouse/pkg/packetsock"
+)
+
+func TestPutSLLHeader(t *testing.T) {
+	t.Parallel()
+
+	addr := &packetsock.Addr{Pkttype: packetsock.PacketOutgoing, Hatype: packetsock.ArphrdEther, Protocol: 0x0800, Halen: 6, Addr: [8]byte{1, 2, 3, 4, 5, 6, 0xff, 0xff}}
+
+	b := make([]byte, sllHeaderSize)
+	for i := range b {
+		b[i] = 0xee
+	}
+	putSLLHeader(b, addr)
+
+	want := "0004" + "0001" + "0006" + "0102030405060000" + "0800"
+	if got := hex.EncodeToString(b); got != want {
+		t.Errorf("putSLLHeader() = %s; want %s", got, want)
+	}
+}
+
+func TestPutSLL2Header(t *testing.T) {
+	t.Parallel()
+
+	addr := &packetsock.Addr{Ifindex: 3, Pkttype: packetsock.PacketHost, Hatype: packetsock.ArphrdEther, Protocol: 0x86dd, Halen: 6, Addr: [8]byte{1, 2, 3, 4, 5, 6, 0xff, 0xff}}
+
+	b := make([]byte, sll2HeaderSize)
+	for i := range b {
+		b[i] = 0xee
+	}
+	putSLL2Header(b, addr)
+
+	want := "86dd" + "0000" + "00000003" + "0001" + "00" + "06" + "0102030405060000"
+	if got := hex.EncodeToString(b); got != want {
+		t.Errorf("putSLL2Header() = %s; want %s", got, want)
+	}
+}
+
+func TestInterfaceType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysclassnet")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "eth0"), 0755); err != nil {
+		t.Fatalf("Mkdir() = %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "eth0", "type"), []byte("1\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+
+	saved := sysClassNet
+	sysClassNet = dir
+	defer func() { sysClassNet = saved }()
+
+	if got, err := interfaceType("eth0"); got != packetsock.ArphrdEther || err != nil {
+		t.Errorf("interfaceType(eth0) = %d, %v; want %d, nil", got, err, packetsock.ArphrdEther)
+	}
+	if _, err := interfaceType("missing0"); err == nil {
+		t.Errorf("interfaceType(missing0) = _, nil; want error")
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package capture captures packets to pcap files, with tcpdump if it is
+// installed and natively otherwise.
+package capture
+
+import (
+	"os/exec"
+
+	"github.com/bowei/lighthouse/pkg/flags"
+	"github.com/bowei/lighthouse/pkg/tcpdump"
+	"github.com/golang/glog"
+)
+
+// Capturer captures packets.
+type Capturer interface {
+	// CheckFilter checks the syntax of a BPF filter.
+	CheckFilter(filter string) error
+	// Run a capture of the packets matching filter. This blocks until
+	// the capture completes.
+	Run(opt *tcpdump.Options, filter string) error
+}
+
+var (
+	_ Capturer = &tcpdump.Runner{}
+	_ Capturer = &Native{}
+)
+
+// TCPDumpAvailable returns true if flags.TCPDumpExecutable is installed.
+func TCPDumpAvailable() bool {
+	_, err := exec.LookPath(flags.TCPDumpExecutable)
+	return err == nil
+}
+
+// New returns a tcpdump Capturer if tcpdump is installed, otherwise a
+// Native one.
+func New() Capturer {
+	if TCPDumpAvailable() {
+		glog.V(2).Infof("Capturing with %s", flags.TCPDumpExecutable)
+		return &tcpdump.Runner{}
+	}
+	glog.V(2).Infof("%s not found, capturing natively", flags.TCPDumpExecutable)
+	return &Native{}
+}
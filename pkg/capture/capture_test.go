@@ -0,0 +1,71 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capture
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bowei/lighthouse/pkg/flags"
+	"github.com/bowei/lighthouse/pkg/tcpdump"
+)
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	executable := filepath.Join(dir, "tcpdump")
+	if err := ioutil.WriteFile(executable, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	notExecutable := filepath.Join(dir, "not-executable")
+	if err := ioutil.WriteFile(notExecutable, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+
+	saved := flags.TCPDumpExecutable
+	defer func() { flags.TCPDumpExecutable = saved }()
+
+	for _, tc := range []struct {
+		path       string
+		wantNative bool
+	}{
+		{path: executable},
+		{path: notExecutable, wantNative: true},
+		{path: filepath.Join(dir, "missing"), wantNative: true},
+	} {
+		flags.TCPDumpExecutable = tc.path
+		c := New()
+		switch c.(type) {
+		case *Native:
+			if !tc.wantNative {
+				t.Errorf("New() with %s = %T; want *tcpdump.Runner", tc.path, c)
+			}
+		case *tcpdump.Runner:
+			if tc.wantNative {
+				t.Errorf("New() with %s = %T; want *Native", tc.path, c)
+			}
+		default:
+			t.Errorf("New() with %s = %T", tc.path, c)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/pcap"
+	"github.com/bowei/lighthouse/pkg/tcpdump"
+	"github.com/golang/glog"
+)
+
+// fileSizeUnit is the unit of tcpdump.Options.FileSize, as for tcpdump -C.
+const fileSizeUnit = 1000000
+
+var (
+	// ErrFilterUnsupported is returned by Native for a non-empty filter,
+	// as compiling filters needs libpcap.
+	ErrFilterUnsupported = errors.New("filters are not supported by the native capturer")
+	// ErrNoOutputFile is returned by Native if there is no output file.
+	ErrNoOutputFile = errors.New("the native capturer needs an output file")
+)
+
+// Native captures packets with an AF_PACKET socket, without tcpdump. The
+// files it writes are in the same format as those of tcpdump -w with a
+// recent libpcap (1.10 or later): the link type is Ethernet for Ethernet
+// and loopback interfaces, Linux "cooked" v2 (LINUX_SLL2) for the "any"
+// interface (the default) and Linux "cooked" (LINUX_SLL) for other
+// interface types. As with tcpdump, interfaces other than "any" are put in
+// promiscuous mode unless NoPromiscuous is set.
+//
+// The output differs from tcpdump's in that older versions of libpcap
+// write LINUX_SLL for "any" and that timestamps always have microsecond
+// precision.
+type Native struct {
+}
+
+// packetSource reads packets, including the link layer header.
+type packetSource interface {
+	linkType() pcap.LinkType
+	// read a packet into b, returning the number of bytes read, the
+	// length of the packet on the wire and the capture time.
+	read(b []byte) (int, int, time.Time, error)
+	close() error
+}
+
+// CheckFilter returns ErrFilterUnsupported unless the filter is empty.
+func (n *Native) CheckFilter(filter string) error {
+	if filter != "" {
+		return ErrFilterUnsupported
+	}
+	return nil
+}
+
+// Run a capture. RotateSeconds, BufferSize, Direction, TimestampType,
+// NanoPrecision, User and PostRotateCommand are not supported. Packets are
+// written as soon as they arrive, so ImmediateMode makes no difference.
+func (n *Native) Run(opt *tcpdump.Options, filter string) error {
+	if err := opt.Validate(); err != nil {
+		return err
+	}
+	if err := n.CheckFilter(filter); err != nil {
+		return err
+	}
+	if opt.OutputFile == "" {
+		return ErrNoOutputFile
+	}
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"RotateSeconds", opt.RotateSeconds != 0},
+		{"BufferSize", opt.BufferSize != 0},
+		{"Direction", opt.Direction != ""},
+		{"TimestampType", opt.TimestampType != ""},
+		{"NanoPrecision", opt.NanoPrecision},
+		{"User", opt.User != ""},
+		{"PostRotateCommand", opt.PostRotateCommand != ""},
+	} {
+		if o.set {
+			return fmt.Errorf("%s is not supported by the native capturer", o.name)
+		}
+	}
+
+	src, err := newPacketSource(opt.Interface, !opt.NoPromiscuous)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	return capture(src, opt)
+}
+
+// capture writes the packets from src to files.
+func capture(src packetSource, opt *tcpdump.Options) error {
+	snapLen := opt.SnapLen
+	if snapLen <= 0 {
+		snapLen = pcap.DefaultSnapLen
+	}
+	out := &rotatingFile{
+		name:     opt.OutputFile,
+		maxSize:  int64(opt.FileSize) * fileSizeUnit,
+		maxFiles: opt.FileCountLimit,
+		snapLen:  snapLen,
+		linkType: src.linkType(),
+	}
+	defer out.close()
+	if err := out.open(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, pcap.DefaultSnapLen)
+	for count := 0; opt.Count == 0 || count < opt.Count; count++ {
+		n, origLen, ts, err := src.read(buf)
+		if err != nil {
+			return err
+		}
+		if err := out.write(ts, buf[:n], origLen); err != nil {
+			return err
+		}
+	}
+	glog.V(2).Infof("Captured %d packets to %s", opt.Count, opt.OutputFile)
+	return out.close()
+}
+
+// rotatingFile writes pcap files, starting a new file when the current one
+// exceeds maxSize. Files are named as by tcpdump -C and -W.
+type rotatingFile struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+	snapLen  int
+	linkType pcap.LinkType
+
+	index int
+	file  io.WriteCloser
+	w     *pcap.Writer
+}
+
+// fileName returns the name of the file with the given index. As with
+// tcpdump, the first file has the plain name unless maxFiles is set, and
+// the index is padded to the number of digits of maxFiles-1.
+func (r *rotatingFile) fileName(index int) string {
+	width := 0
+	for n := r.maxFiles - 1; n > 0; n /= 10 {
+		width++
+	}
+	if index == 0 && width == 0 {
+		return r.name
+	}
+	return fmt.Sprintf("%s%0*d", r.name, width, index)
+}
+
+func (r *rotatingFile) open() error {
+	if r.name == "-" {
+		r.file = nopCloser{os.Stdout}
+	} else {
+		name := r.name
+		if r.maxSize > 0 {
+			name = r.fileName(r.index)
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		r.file = f
+	}
+	w, err := pcap.NewWriter(r.file, r.snapLen, r.linkType)
+	if err != nil {
+		r.close()
+		return err
+	}
+	r.w = w
+	return nil
+}
+
+func (r *rotatingFile) write(ts time.Time, data []byte, origLen int) error {
+	// Like tcpdump, rotate before writing once the file is over the size.
+	if r.maxSize > 0 && r.name != "-" && r.w.Size() > r.maxSize {
+		if err := r.close(); err != nil {
+			return err
+		}
+		r.index++
+		if r.maxFiles > 0 && r.index >= r.maxFiles {
+			r.index = 0
+		}
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	return r.w.WritePacket(ts, data, origLen)
+}
+
+func (r *rotatingFile) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file, r.w = nil, nil
+	return err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,198 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/pcap"
+	"github.com/bowei/lighthouse/pkg/tcpdump"
+)
+
+var errFakeDone = errors.New("no more packets")
+
+// fakeSource returns packets of the given sizes, then errFakeDone.
+type fakeSource struct {
+	sizes []int
+	at    time.Time
+}
+
+func (s *fakeSource) linkType() pcap.LinkType { return pcap.LinkTypeEthernet }
+
+func (s *fakeSource) read(b []byte) (int, int, time.Time, error) {
+	if len(s.sizes) == 0 {
+		return 0, 0, time.Time{}, errFakeDone
+	}
+	n := s.sizes[0]
+	s.sizes = s.sizes[1:]
+	s.at = s.at.Add(time.Second)
+	for i := 0; i < n; i++ {
+		b[i] = byte(n)
+	}
+	return n, n, s.at, nil
+}
+
+func (s *fakeSource) close() error { return nil }
+
+// readPcap returns the link type and the lengths of the packets in a
+// capture file.
+func readPcap(t *testing.T, name string) (pcap.LinkType, []int) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) = _, %v", name, err)
+	}
+	if len(b) < pcap.FileHeaderSize {
+		t.Fatalf("%s is %d bytes; want a pcap file", name, len(b))
+	}
+	decoder := binary.LittleEndian
+	link := pcap.LinkType(decoder.Uint32(b[20:]))
+	var lens []int
+	for b = b[pcap.FileHeaderSize:]; len(b) >= pcap.RecordHeaderSize; {
+		n := int(decoder.Uint32(b[8:]))
+		lens = append(lens, n)
+		b = b[pcap.RecordHeaderSize+n:]
+	}
+	return link, lens
+}
+
+func TestFileName(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		maxFiles int
+		index    int
+		want     string
+	}{
+		{maxFiles: 0, index: 0, want: "out.pcap"},
+		{maxFiles: 0, index: 1, want: "out.pcap1"},
+		{maxFiles: 0, index: 12, want: "out.pcap12"},
+		{maxFiles: 1, index: 0, want: "out.pcap"},
+		{maxFiles: 3, index: 0, want: "out.pcap0"},
+		{maxFiles: 10, index: 9, want: "out.pcap9"},
+		{maxFiles: 11, index: 3, want: "out.pcap03"},
+		{maxFiles: 101, index: 7, want: "out.pcap007"},
+	} {
+		r := &rotatingFile{name: "out.pcap", maxFiles: tc.maxFiles}
+		if got := r.fileName(tc.index); got != tc.want {
+			t.Errorf("fileName(%d) with %d files = %q; want %q", tc.index, tc.maxFiles, got, tc.want)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Four 250k packets fill a file of -C 1 (1,000,000 bytes).
+	const big = 250000
+	for _, tc := range []struct {
+		desc      string
+		opt       tcpdump.Options
+		sizes     []int
+		wantErr   error
+		wantFiles map[string][]int
+	}{
+		{
+			desc:      "count",
+			opt:       tcpdump.Options{OutputFile: "count.pcap", Count: 2},
+			sizes:     []int{60, 70, 80},
+			wantFiles: map[string][]int{"count.pcap": {60, 70}},
+		},
+		{
+			desc:      "snaplen",
+			opt:       tcpdump.Options{OutputFile: "snap.pcap", SnapLen: 64},
+			sizes:     []int{60, 1500},
+			wantErr:   errFakeDone,
+			wantFiles: map[string][]int{"snap.pcap": {60, 64}},
+		},
+		{
+			desc:  "rotate",
+			opt:   tcpdump.Options{OutputFile: "rotate.pcap", FileSize: 1, Count: 9},
+			sizes: []int{big, big, big, big, big, big, big, big, big},
+			wantFiles: map[string][]int{
+				"rotate.pcap":  {big, big, big, big},
+				"rotate.pcap1": {big, big, big, big},
+				"rotate.pcap2": {big},
+			},
+		},
+		{
+			desc:  "ring",
+			opt:   tcpdump.Options{OutputFile: "ring.pcap", FileSize: 1, FileCountLimit: 2, Count: 9},
+			sizes: []int{big, big, big, big, big, big, big, big, big},
+			wantFiles: map[string][]int{
+				"ring.pcap0": {big},
+				"ring.pcap1": {big, big, big, big},
+			},
+		},
+	} {
+		opt := tc.opt
+		opt.OutputFile = filepath.Join(dir, opt.OutputFile)
+		src := &fakeSource{sizes: tc.sizes, at: time.Unix(100, 0)}
+		if err := capture(src, &opt); err != tc.wantErr {
+			t.Errorf("%s: capture() = %v; want %v", tc.desc, err, tc.wantErr)
+			continue
+		}
+		for name, want := range tc.wantFiles {
+			link, got := readPcap(t, filepath.Join(dir, name))
+			if link != pcap.LinkTypeEthernet {
+				t.Errorf("%s: %s has link type %v; want %v", tc.desc, name, link, pcap.LinkTypeEthernet)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s has packets %v; want %v", tc.desc, name, got, want)
+			}
+		}
+	}
+}
+
+func TestNativeErrors(t *testing.T) {
+	t.Parallel()
+
+	n := &Native{}
+	if err := n.CheckFilter(""); err != nil {
+		t.Errorf("CheckFilter(\"\") = %v; want nil", err)
+	}
+	for _, tc := range []struct {
+		desc    string
+		opt     tcpdump.Options
+		filter  string
+		wantErr error
+	}{
+		{desc: "filter", opt: tcpdump.Options{OutputFile: "x"}, filter: "tcp", wantErr: ErrFilterUnsupported},
+		{desc: "no output file", wantErr: ErrNoOutputFile},
+		{desc: "rotate seconds", opt: tcpdump.Options{OutputFile: "x", RotateSeconds: 1}},
+		{desc: "direction", opt: tcpdump.Options{OutputFile: "x", Direction: tcpdump.DirectionIn}},
+		{desc: "user", opt: tcpdump.Options{OutputFile: "x", User: "nobody"}},
+		{desc: "invalid", opt: tcpdump.Options{OutputFile: "x", SnapLen: -1}},
+	} {
+		err := n.Run(&tc.opt, tc.filter)
+		if err == nil || (tc.wantErr != nil && err != tc.wantErr) {
+			t.Errorf("%s: Run() = %v; want %v", tc.desc, err, tc.wantErr)
+		}
+	}
+}
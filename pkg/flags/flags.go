@@ -17,5 +17,7 @@ limitations under the License.
 package flags
 
 var (
-	TCPDumpExecutable = "/usr/sbin/tcpdump"
+	TCPDumpExecutable   = "/usr/sbin/tcpdump"
+	IPTablesExecutable  = "/sbin/iptables"
+	IP6TablesExecutable = "/sbin/ip6tables"
 )
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package packetsock reads packets from network interfaces with Linux
+// AF_PACKET sockets.
+package packetsock
+
+import "errors"
+
+// MaxInterfaces is the number of interfaces a Socket can be restricted to.
+const MaxInterfaces = 255
+
+var (
+	// ErrUnsupported is returned by Open on platforms without AF_PACKET.
+	ErrUnsupported = errors.New("packet sockets are only supported on Linux")
+	// ErrTooManyInterfaces is returned by Open for more than
+	// MaxInterfaces interfaces.
+	ErrTooManyInterfaces = errors.New("too many interfaces for a packet socket")
+)
+
+// Packet types (PACKET_*), the direction of a packet.
+const (
+	PacketHost      = 0
+	PacketBroadcast = 1
+	PacketMulticast = 2
+	PacketOtherHost = 3
+	PacketOutgoing  = 4
+)
+
+// Hardware types (ARPHRD_*) of interfaces.
+const (
+	ArphrdEther    = 1
+	ArphrdLoopback = 772
+	ArphrdNone     = 65534
+)
+
+// Config of a Socket.
+type Config struct {
+	// LinkLayer reads packets with their link layer header (SOCK_RAW).
+	// Otherwise the header is removed (SOCK_DGRAM).
+	LinkLayer bool
+	// Interfaces are the indices of the interfaces to read packets from,
+	// or all interfaces if empty. The socket is bound to a single
+	// interface and filtered to several, so that the kernel drops the
+	// packets of other interfaces.
+	Interfaces []int
+	// Promiscuous puts the Interfaces in promiscuous mode while the
+	// Socket is open.
+	Promiscuous bool
+}
+
+// Addr describes the packet read, as struct sockaddr_ll.
+type Addr struct {
+	// Ifindex is the index of the interface the packet was read on.
+	Ifindex int
+	// Pkttype is one of the Packet* types.
+	Pkttype uint8
+	// Hatype is the Arphrd* hardware type of the interface.
+	Hatype uint16
+	// Protocol is the EtherType of the packet.
+	Protocol uint16
+	// Addr is the link layer source address, of Halen bytes.
+	Halen uint8
+	Addr  [8]byte
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packetsock
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// skfAdIfindex is the offset of the interface index in BPF loads
+	// (SKF_AD_OFF + SKF_AD_IFINDEX).
+	skfAdIfindex = -0x1000 + 8
+	// maxFilterInterfaces is the number of interfaces interfaceFilter can
+	// select, as BPF jump offsets are 8 bits.
+	maxFilterInterfaces = MaxInterfaces
+	// maxSnapLen is the most a filter accepts of a packet.
+	maxSnapLen = 262144
+)
+
+// ethPAll is ETH_P_ALL in network byte order.
+var ethPAll = htons(syscall.ETH_P_ALL)
+
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+// Socket is an AF_PACKET socket.
+type Socket struct {
+	file *os.File
+	rc   syscall.RawConn
+	oob  []byte
+}
+
+// Open a Socket. This needs CAP_NET_RAW.
+func Open(cfg *Config) (*Socket, error) {
+	sockType := syscall.SOCK_DGRAM
+	if cfg.LinkLayer {
+		sockType = syscall.SOCK_RAW
+	}
+	// The socket receives nothing until it is bound with a protocol, after
+	// it is set up, so that it only ever receives the packets of the
+	// interfaces.
+	fd, err := syscall.Socket(syscall.AF_PACKET, sockType, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := setup(fd, cfg); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	s := &Socket{
+		oob:  make([]byte, syscall.CmsgSpace(int(unsafe.Sizeof(syscall.Timespec{})))),
+		file: os.NewFile(uintptr(fd), "packet"),
+	}
+	if s.rc, err = s.file.SyscallConn(); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// setup the socket fd for cfg.
+func setup(fd int, cfg *Config) error {
+	if cfg.Promiscuous {
+		for _, index := range cfg.Interfaces {
+			if err := setPromiscuous(fd, index); err != nil {
+				return err
+			}
+		}
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	// A non-blocking file uses the runtime poller, so that Close
+	// interrupts a blocked Read.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		return err
+	}
+	return bind(fd, cfg.Interfaces)
+}
+
+// bind the socket fd to the given interfaces, binding it to a single
+// interface or filtering it to several.
+func bind(fd int, interfaces []int) error {
+	ifindex := 0
+	switch {
+	case len(interfaces) == 1:
+		ifindex = interfaces[0]
+	case len(interfaces) > maxFilterInterfaces:
+		return ErrTooManyInterfaces
+	case len(interfaces) > 1:
+		if err := syscall.AttachLsf(fd, interfaceFilter(interfaces)); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: ethPAll, Ifindex: ifindex}); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	return nil
+}
+
+// interfaceFilter returns a BPF program accepting the packets of the given
+// interfaces.
+func interfaceFilter(interfaces []int) []syscall.SockFilter {
+	n := len(interfaces)
+	prog := []syscall.SockFilter{*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, skfAdIfindex)}
+	for i, index := range interfaces {
+		// Jump to the accept at the end, past the remaining
+		// comparisons and the reject.
+		prog = append(prog, *syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, index, n-i, 0))
+	}
+	return append(prog,
+		*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 0),
+		*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, maxSnapLen))
+}
+
+// packetMreq is struct packet_mreq.
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]byte
+}
+
+// setPromiscuous puts the interface in promiscuous mode until the socket fd
+// is closed.
+func setPromiscuous(fd, index int) error {
+	mreq := packetMreq{ifindex: int32(index), typ: syscall.PACKET_MR_PROMISC}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP,
+		uintptr(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq), 0)
+	if errno != 0 {
+		return os.NewSyscallError("setsockopt", errno)
+	}
+	return nil
+}
+
+// Read a packet into b. It returns the number of bytes read, the length of
+// the packet, which is more than that if the packet was truncated, where
+// the packet came from and when it arrived.
+func (s *Socket) Read(b []byte) (int, int, *Addr, time.Time, error) {
+	for {
+		var (
+			n, oobn int
+			from    syscall.Sockaddr
+			err     error
+		)
+		readErr := s.rc.Read(func(fd uintptr) bool {
+			// With MSG_TRUNC, n is the length of the packet even if it
+			// is longer than b.
+			n, oobn, _, from, err = syscall.Recvmsg(int(fd), b, s.oob, syscall.MSG_TRUNC)
+			return err != syscall.EAGAIN
+		})
+		if readErr != nil {
+			return 0, 0, nil, time.Time{}, readErr
+		}
+		if err != nil {
+			return 0, 0, nil, time.Time{}, os.NewSyscallError("recvmsg", err)
+		}
+		sa, ok := from.(*syscall.SockaddrLinklayer)
+		if !ok {
+			continue
+		}
+		addr := &Addr{
+			Ifindex:  sa.Ifindex,
+			Pkttype:  sa.Pkttype,
+			Hatype:   sa.Hatype,
+			Protocol: binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Protocol))[:]),
+			Halen:    sa.Halen,
+			Addr:     sa.Addr,
+		}
+		length := n
+		if n > len(b) {
+			n = len(b)
+		}
+		return n, length, addr, timestamp(s.oob[:oobn]), nil
+	}
+}
+
+// timestamp returns the kernel receive timestamp from the control messages,
+// or the current time if there is none.
+func timestamp(oob []byte) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Now()
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SCM_TIMESTAMPNS && len(m.Data) >= int(unsafe.Sizeof(syscall.Timespec{})) {
+			ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+			return time.Unix(ts.Unix())
+		}
+	}
+	return time.Now()
+}
+
+// Close the socket, interrupting a blocked Read.
+func (s *Socket) Close() error {
+	return s.file.Close()
+}
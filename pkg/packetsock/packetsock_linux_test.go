@@ -0,0 +1,61 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packetsock
+
+import (
+	"syscall"
+	"testing"
+)
+
+// runFilter runs the ifindex loads, comparisons and returns of a BPF
+// program for a packet from the interface ifindex.
+func runFilter(t *testing.T, prog []syscall.SockFilter, ifindex int) uint32 {
+	var a uint32
+	for pc := 0; pc < len(prog); pc++ {
+		f := prog[pc]
+		switch f.Code {
+		case syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS:
+			if int32(f.K) != skfAdIfindex {
+				t.Fatalf("load of %#x, want the interface index", f.K)
+			}
+			a = uint32(ifindex)
+		case syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K:
+			if a == f.K {
+				pc += int(f.Jt)
+			} else {
+				pc += int(f.Jf)
+			}
+		case syscall.BPF_RET | syscall.BPF_K:
+			return f.K
+		default:
+			t.Fatalf("unexpected instruction %+v", f)
+		}
+	}
+	t.Fatalf("program did not return")
+	return 0
+}
+
+func TestInterfaceFilter(t *testing.T) {
+	t.Parallel()
+
+	prog := interfaceFilter([]int{2, 5, 9})
+	for ifindex, want := range map[int]bool{1: false, 2: true, 3: false, 5: true, 9: true, 10: false} {
+		if got := runFilter(t, prog, ifindex) != 0; got != want {
+			t.Errorf("filter accepts interface %d = %t; want %t", ifindex, got, want)
+		}
+	}
+}
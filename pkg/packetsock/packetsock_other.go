@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packetsock
+
+import "time"
+
+// Socket is an AF_PACKET socket.
+type Socket struct{}
+
+// Open returns ErrUnsupported.
+func Open(cfg *Config) (*Socket, error) {
+	return nil, ErrUnsupported
+}
+
+// Read is not supported.
+func (s *Socket) Read(b []byte) (int, int, *Addr, time.Time, error) {
+	return 0, 0, nil, time.Time{}, ErrUnsupported
+}
+
+// Close is not supported.
+func (s *Socket) Close() error {
+	return ErrUnsupported
+}
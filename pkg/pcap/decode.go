@@ -0,0 +1,165 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	// LinkTypeLinuxSLL2 is for packets with the version 2 Linux "cooked"
+	// header.
+	LinkTypeLinuxSLL2 LinkType = 276
+
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86dd
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	ethHeaderSize  = 14
+	sllHeaderSize  = 16
+	sll2HeaderSize = 20
+
+	ipv4MinHeaderSize = 20
+	ipv6HeaderSize    = 40
+
+	protoTCP  = 6
+	protoUDP  = 17
+	protoSCTP = 132
+)
+
+var (
+	// ErrNotIP is returned by Decode for packets that are not IPv4 or
+	// IPv6.
+	ErrNotIP = errors.New("not an IP packet")
+	// ErrTruncated is returned by Decode when the headers are truncated.
+	ErrTruncated = errors.New("truncated packet")
+)
+
+// Decoded holds the IP and transport layer fields of a packet.
+type Decoded struct {
+	Src, Dest net.IP
+	// Protocol is the IP protocol number (the IPv6 next header; extension
+	// headers are not interpreted).
+	Protocol int
+	// TTL is the IPv4 TTL or IPv6 hop limit.
+	TTL int
+	// SrcPort and DestPort are set for TCP, UDP and SCTP.
+	SrcPort, DestPort int
+	// IP is the IP packet, without the link layer header.
+	IP []byte
+	// Payload is the IP payload.
+	Payload []byte
+}
+
+// Decode the IP and transport headers of a packet with the given link
+// type. ErrNotIP is returned for other network protocols.
+func Decode(linkType LinkType, data []byte) (*Decoded, error) {
+	ip, err := stripLink(linkType, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(ip) == 0 {
+		return nil, ErrTruncated
+	}
+
+	d := &Decoded{IP: ip}
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < ipv4MinHeaderSize {
+			return nil, ErrTruncated
+		}
+		ihl := int(ip[0]&0xf) * 4
+		if ihl < ipv4MinHeaderSize || len(ip) < ihl {
+			return nil, ErrTruncated
+		}
+		end := int(binary.BigEndian.Uint16(ip[2:]))
+		if end > len(ip) || end < ihl {
+			end = len(ip)
+		}
+		d.TTL, d.Protocol = int(ip[8]), int(ip[9])
+		d.Src, d.Dest = net.IP(ip[12:16]), net.IP(ip[16:20])
+		d.Payload = ip[ihl:end]
+		// Only the first fragment has the transport header.
+		if binary.BigEndian.Uint16(ip[6:])&0x1fff != 0 {
+			return d, nil
+		}
+	case 6:
+		if len(ip) < ipv6HeaderSize {
+			return nil, ErrTruncated
+		}
+		end := ipv6HeaderSize + int(binary.BigEndian.Uint16(ip[4:]))
+		if end > len(ip) {
+			end = len(ip)
+		}
+		d.Protocol, d.TTL = int(ip[6]), int(ip[7])
+		d.Src, d.Dest = net.IP(ip[8:24]), net.IP(ip[24:40])
+		d.Payload = ip[ipv6HeaderSize:end]
+	default:
+		return nil, ErrNotIP
+	}
+
+	switch d.Protocol {
+	case protoTCP, protoUDP, protoSCTP:
+		if len(d.Payload) >= 4 {
+			d.SrcPort = int(binary.BigEndian.Uint16(d.Payload))
+			d.DestPort = int(binary.BigEndian.Uint16(d.Payload[2:]))
+		}
+	}
+	return d, nil
+}
+
+// stripLink returns the network layer packet in data.
+func stripLink(linkType LinkType, data []byte) ([]byte, error) {
+	var (
+		etherType int
+		offset    int
+	)
+	switch linkType {
+	case LinkTypeRaw:
+		return data, nil
+	case LinkTypeEthernet:
+		if len(data) < ethHeaderSize {
+			return nil, ErrTruncated
+		}
+		etherType, offset = int(binary.BigEndian.Uint16(data[12:])), ethHeaderSize
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(data) < offset+4 {
+				return nil, ErrTruncated
+			}
+			etherType = int(binary.BigEndian.Uint16(data[offset+2:]))
+			offset += 4
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < sllHeaderSize {
+			return nil, ErrTruncated
+		}
+		etherType, offset = int(binary.BigEndian.Uint16(data[14:])), sllHeaderSize
+	case LinkTypeLinuxSLL2:
+		if len(data) < sll2HeaderSize {
+			return nil, ErrTruncated
+		}
+		etherType, offset = int(binary.BigEndian.Uint16(data[0:])), sll2HeaderSize
+	default:
+		return nil, ErrNotIP
+	}
+	if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return nil, ErrNotIP
+	}
+	return data[offset:], nil
+}
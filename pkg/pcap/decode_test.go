@@ -0,0 +1,79 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcap
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	// 10.0.0.1:1000 > 10.0.0.2:80 TCP, ttl 61, with 20 bytes of TCP header.
+	ipv4 := "45000028" + "00014000" + "3d06" + "0000" + "0a000001" + "0a000002" +
+		"03e80050" + "00000000" + "00000000" + "50020000" + "00000000"
+	// [2001:db8::1]:53 > [2001:db8::2]:1000 UDP, hop limit 7.
+	ipv6 := "60000000" + "0008" + "11" + "07" + "20010db8000000000000000000000001" + "20010db8000000000000000000000002" +
+		"003503e8" + "00080000"
+	// A non-first IPv4 fragment.
+	fragment := "45000020" + "00010001" + "4006" + "0000" + "0a000001" + "0a000002" + "0102030405060708"
+	eth := "020000000002" + "020000000001"
+
+	for _, tc := range []struct {
+		desc      string
+		linkType  LinkType
+		data      string
+		wantErr   error
+		wantSrc   string
+		wantProto int
+		wantTTL   int
+		wantPorts [2]int
+	}{
+		{desc: "raw ipv4", linkType: LinkTypeRaw, data: ipv4, wantSrc: "10.0.0.1", wantProto: 6, wantTTL: 61, wantPorts: [2]int{1000, 80}},
+		{desc: "ethernet ipv4", linkType: LinkTypeEthernet, data: eth + "0800" + ipv4, wantSrc: "10.0.0.1", wantProto: 6, wantTTL: 61, wantPorts: [2]int{1000, 80}},
+		{desc: "ethernet vlan ipv6", linkType: LinkTypeEthernet, data: eth + "8100" + "0064" + "86dd" + ipv6, wantSrc: "2001:db8::1", wantProto: 17, wantTTL: 7, wantPorts: [2]int{53, 1000}},
+		{desc: "sll ipv6", linkType: LinkTypeLinuxSLL, data: "0000" + "0001" + "0006" + "0200000000010000" + "86dd" + ipv6, wantSrc: "2001:db8::1", wantProto: 17, wantTTL: 7, wantPorts: [2]int{53, 1000}},
+		{desc: "sll2 ipv4", linkType: LinkTypeLinuxSLL2, data: "0800" + "0000" + "00000002" + "0001" + "00" + "06" + "0200000000010000" + ipv4, wantSrc: "10.0.0.1", wantProto: 6, wantTTL: 61, wantPorts: [2]int{1000, 80}},
+		{desc: "fragment", linkType: LinkTypeRaw, data: fragment, wantSrc: "10.0.0.1", wantProto: 6, wantTTL: 64},
+		{desc: "arp", linkType: LinkTypeEthernet, data: eth + "0806" + "0001", wantErr: ErrNotIP},
+		{desc: "unknown link type", linkType: 12345, data: ipv4, wantErr: ErrNotIP},
+		{desc: "not ip", linkType: LinkTypeRaw, data: "00", wantErr: ErrNotIP},
+		{desc: "truncated ethernet", linkType: LinkTypeEthernet, data: eth, wantErr: ErrTruncated},
+		{desc: "truncated vlan", linkType: LinkTypeEthernet, data: eth + "8100" + "00", wantErr: ErrTruncated},
+		{desc: "truncated ipv4", linkType: LinkTypeRaw, data: ipv4[:30], wantErr: ErrTruncated},
+		{desc: "truncated ipv6", linkType: LinkTypeRaw, data: ipv6[:60], wantErr: ErrTruncated},
+		{desc: "empty", linkType: LinkTypeRaw, wantErr: ErrTruncated},
+	} {
+		data, err := hex.DecodeString(tc.data)
+		if err != nil {
+			t.Fatalf("%s: bad test data: %v", tc.desc, err)
+		}
+		d, err := Decode(tc.linkType, data)
+		if err != tc.wantErr {
+			t.Errorf("%s: Decode() = _, %v; want %v", tc.desc, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if d.Src.String() != tc.wantSrc || d.Protocol != tc.wantProto || d.TTL != tc.wantTTL || d.SrcPort != tc.wantPorts[0] || d.DestPort != tc.wantPorts[1] {
+			t.Errorf("%s: Decode() = %s proto %d ttl %d ports %d > %d; want %s proto %d ttl %d ports %v",
+				tc.desc, d.Src, d.Protocol, d.TTL, d.SrcPort, d.DestPort, tc.wantSrc, tc.wantProto, tc.wantTTL, tc.wantPorts)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pcap writes packet captures in the classic libpcap file format,
+// as written by tcpdump -w.
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	magicMicroseconds = 0xa1b2c3d4
+	versionMajor      = 2
+	versionMinor      = 4
+
+	// FileHeaderSize is the size of the file header.
+	FileHeaderSize = 24
+	// RecordHeaderSize is the size of the header of each packet.
+	RecordHeaderSize = 16
+
+	// DefaultSnapLen is the snap length tcpdump uses by default (and for
+	// -s 0).
+	DefaultSnapLen = 262144
+)
+
+// LinkType is the link layer header type of the packets in a capture.
+type LinkType uint32
+
+// Link types. See https://www.tcpdump.org/linktypes.html.
+const (
+	// LinkTypeEthernet is for packets with an Ethernet header.
+	LinkTypeEthernet LinkType = 1
+	// LinkTypeRaw is for packets without a link layer header, starting
+	// with the IPv4 or IPv6 header.
+	LinkTypeRaw LinkType = 101
+	// LinkTypeLinuxSLL is for packets with a Linux "cooked" header, as
+	// captured on the "any" interface.
+	LinkTypeLinuxSLL LinkType = 113
+)
+
+func (t LinkType) String() string {
+	switch t {
+	case LinkTypeEthernet:
+		return "EN10MB"
+	case LinkTypeRaw:
+		return "RAW"
+	case LinkTypeLinuxSLL:
+		return "LINUX_SLL"
+	case LinkTypeLinuxSLL2:
+		return "LINUX_SLL2"
+	}
+	return fmt.Sprintf("linktype(%d)", uint32(t))
+}
+
+// Writer writes a capture file.
+type Writer struct {
+	w       io.Writer
+	snapLen int
+	// n is the number of bytes written, including the file header.
+	n int64
+}
+
+// NewWriter writes the file header to w and returns a Writer for the
+// packets. A snapLen of 0 means DefaultSnapLen.
+func NewWriter(w io.Writer, snapLen int, linkType LinkType) (*Writer, error) {
+	if snapLen <= 0 {
+		snapLen = DefaultSnapLen
+	}
+	var b [FileHeaderSize]byte
+	encoder := binary.LittleEndian
+	encoder.PutUint32(b[0:], magicMicroseconds)
+	encoder.PutUint16(b[4:], versionMajor)
+	encoder.PutUint16(b[6:], versionMinor)
+	// b[8:16] is the time zone offset and timestamp accuracy, both zero.
+	encoder.PutUint32(b[16:], uint32(snapLen))
+	encoder.PutUint32(b[20:], uint32(linkType))
+	if _, err := w.Write(b[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, snapLen: snapLen, n: FileHeaderSize}, nil
+}
+
+// WritePacket writes a packet captured at ts. data is truncated to the
+// snap length; origLen is the length of the packet on the wire, which may
+// be more than len(data).
+func (w *Writer) WritePacket(ts time.Time, data []byte, origLen int) error {
+	if len(data) > w.snapLen {
+		data = data[:w.snapLen]
+	}
+	if origLen < len(data) {
+		origLen = len(data)
+	}
+	var b [RecordHeaderSize]byte
+	encoder := binary.LittleEndian
+	encoder.PutUint32(b[0:], uint32(ts.Unix()))
+	encoder.PutUint32(b[4:], uint32(ts.Nanosecond()/1000))
+	encoder.PutUint32(b[8:], uint32(len(data)))
+	encoder.PutUint32(b[12:], uint32(origLen))
+	if _, err := w.w.Write(b[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.n += int64(RecordHeaderSize + len(data))
+	return nil
+}
+
+// Size returns the number of bytes written, including the file header.
+func (w *Writer) Size() int64 {
+	return w.n
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 0, LinkTypeLinuxSLL)
+	if err != nil {
+		t.Fatalf("NewWriter() = _, %v; want nil", err)
+	}
+	ts := time.Unix(0x5b000000, 123456789)
+	if err := w.WritePacket(ts, []byte{1, 2, 3}, 0); err != nil {
+		t.Fatalf("WritePacket() = %v; want nil", err)
+	}
+
+	want := "d4c3b2a1" + "0200" + "0400" + "00000000" + "00000000" + "00000400" + "71000000" +
+		"0000005b" + "40e20100" + "03000000" + "03000000" + "010203"
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("wrote %s; want %s", got, want)
+	}
+	if w.Size() != int64(buf.Len()) {
+		t.Errorf("Size() = %d; want %d", w.Size(), buf.Len())
+	}
+}
+
+func TestWriterSnapLen(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 4, LinkTypeRaw)
+	if err != nil {
+		t.Fatalf("NewWriter() = _, %v; want nil", err)
+	}
+	if err := w.WritePacket(time.Unix(1, 0), []byte{1, 2, 3, 4, 5, 6}, 60); err != nil {
+		t.Fatalf("WritePacket() = %v; want nil", err)
+	}
+
+	record := buf.Bytes()[FileHeaderSize:]
+	want := "01000000" + "00000000" + "04000000" + "3c000000" + "01020304"
+	if got := hex.EncodeToString(record); got != want {
+		t.Errorf("wrote record %s; want %s", got, want)
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestWriterError(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewWriter(errWriter{}, 0, LinkTypeEthernet); err == nil {
+		t.Errorf("NewWriter(errWriter) = _, nil; want error")
+	}
+}
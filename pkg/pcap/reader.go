@@ -0,0 +1,120 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	magicNanoseconds = 0xa1b23c4d
+	// maxRecordSize bounds the captured length of a record, to detect
+	// corrupt files.
+	maxRecordSize = 1 << 26
+)
+
+// Packet is a packet read from a capture.
+type Packet struct {
+	Timestamp time.Time
+	// Data is the captured bytes, starting with the link layer header.
+	Data []byte
+	// Length of the packet on the wire. This is more than len(Data) if
+	// the packet was truncated to the snap length.
+	Length int
+}
+
+// Reader reads a capture file, in either byte order and with microsecond
+// or nanosecond timestamps.
+type Reader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	snapLen  int
+	linkType LinkType
+}
+
+// NewReader reads the file header from r and returns a Reader for the
+// packets.
+func NewReader(r io.Reader) (*Reader, error) {
+	var b [FileHeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	rd := &Reader{r: r}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(b[0:]) {
+		case magicMicroseconds:
+			rd.order = order
+		case magicNanoseconds:
+			rd.order, rd.nano = order, true
+		}
+		if rd.order != nil {
+			break
+		}
+	}
+	if rd.order == nil {
+		return nil, fmt.Errorf("not a pcap file (magic %x)", b[0:4])
+	}
+	if major := rd.order.Uint16(b[4:]); major != versionMajor {
+		return nil, fmt.Errorf("unsupported pcap version %d", major)
+	}
+	rd.snapLen = int(rd.order.Uint32(b[16:]))
+	rd.linkType = LinkType(rd.order.Uint32(b[20:]))
+	return rd, nil
+}
+
+// LinkType of the packets.
+func (r *Reader) LinkType() LinkType {
+	return r.linkType
+}
+
+// SnapLen of the capture.
+func (r *Reader) SnapLen() int {
+	return r.snapLen
+}
+
+// ReadPacket returns the next packet. It returns io.EOF at the end of the
+// capture and io.ErrUnexpectedEOF if the capture ends in the middle of a
+// packet.
+func (r *Reader) ReadPacket() (*Packet, error) {
+	var b [RecordHeaderSize]byte
+	if _, err := io.ReadFull(r.r, b[:]); err != nil {
+		return nil, err
+	}
+	sec, frac := r.order.Uint32(b[0:]), r.order.Uint32(b[4:])
+	capLen, origLen := r.order.Uint32(b[8:]), r.order.Uint32(b[12:])
+	if capLen > maxRecordSize {
+		return nil, fmt.Errorf("invalid pcap record length %d", capLen)
+	}
+
+	p := &Packet{Data: make([]byte, capLen), Length: int(origLen)}
+	if _, err := io.ReadFull(r.r, p.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if r.nano {
+		p.Timestamp = time.Unix(int64(sec), int64(frac))
+	} else {
+		p.Timestamp = time.Unix(int64(sec), int64(frac)*1000)
+	}
+	return p, nil
+}
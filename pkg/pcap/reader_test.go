@@ -0,0 +1,114 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReaderRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 4, LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("NewWriter() = _, %v", err)
+	}
+	want := []*Packet{
+		{Timestamp: time.Unix(10, 5000), Data: []byte{1, 2, 3}, Length: 3},
+		{Timestamp: time.Unix(11, 0), Data: []byte{4, 5, 6, 7}, Length: 1500},
+	}
+	w.WritePacket(want[0].Timestamp, want[0].Data, 0)
+	w.WritePacket(want[1].Timestamp, []byte{4, 5, 6, 7, 8, 9}, 1500)
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader() = _, %v", err)
+	}
+	if r.LinkType() != LinkTypeEthernet || r.SnapLen() != 4 {
+		t.Errorf("LinkType(), SnapLen() = %v, %d; want %v, 4", r.LinkType(), r.SnapLen(), LinkTypeEthernet)
+	}
+	for i := range want {
+		p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket() = _, %v", err)
+		}
+		if !p.Timestamp.Equal(want[i].Timestamp) || !reflect.DeepEqual(p.Data, want[i].Data) || p.Length != want[i].Length {
+			t.Errorf("ReadPacket() = %+v; want %+v", p, want[i])
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("ReadPacket() = _, %v; want io.EOF", err)
+	}
+}
+
+func TestReaderBigEndianNanoseconds(t *testing.T) {
+	t.Parallel()
+
+	b, _ := hex.DecodeString("a1b23c4d" + "0002" + "0004" + "00000000" + "00000000" + "0000ffff" + "00000065" +
+		"00000001" + "00000007" + "00000002" + "00000002" + "4500")
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("NewReader() = _, %v", err)
+	}
+	if r.LinkType() != LinkTypeRaw || r.SnapLen() != 0xffff {
+		t.Errorf("LinkType(), SnapLen() = %v, %d; want %v, 65535", r.LinkType(), r.SnapLen(), LinkTypeRaw)
+	}
+	p, err := r.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket() = _, %v", err)
+	}
+	if !p.Timestamp.Equal(time.Unix(1, 7)) || !reflect.DeepEqual(p.Data, []byte{0x45, 0}) {
+		t.Errorf("ReadPacket() = %+v; want 2 bytes at 1.000000007", p)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	t.Parallel()
+
+	header := "d4c3b2a1" + "0200" + "0400" + "00000000" + "00000000" + "00000400" + "01000000"
+	for _, tc := range []struct {
+		desc          string
+		in            string
+		wantHeaderErr bool
+		wantErr       error
+	}{
+		{desc: "empty", in: "", wantHeaderErr: true},
+		{desc: "bad magic", in: "00000000" + header[8:], wantHeaderErr: true},
+		{desc: "bad version", in: header[:8] + "0100" + header[12:], wantHeaderErr: true},
+		{desc: "truncated record header", in: header + "01000000", wantErr: io.ErrUnexpectedEOF},
+		{desc: "truncated data", in: header + "01000000" + "00000000" + "04000000" + "04000000" + "0102", wantErr: io.ErrUnexpectedEOF},
+	} {
+		b, _ := hex.DecodeString(tc.in)
+		r, err := NewReader(bytes.NewReader(b))
+		if gotErr := err != nil; gotErr != tc.wantHeaderErr {
+			t.Errorf("%s: NewReader() = _, %v; want error %t", tc.desc, err, tc.wantHeaderErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := r.ReadPacket(); err != tc.wantErr {
+			t.Errorf("%s: ReadPacket() = _, %v; want %v", tc.desc, err, tc.wantErr)
+		}
+	}
+}
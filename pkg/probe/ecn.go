@@ -0,0 +1,213 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ECNCodepoint is the value of the ECN field, the low two bits of the IPv4
+// TOS (IPv6 traffic class) byte (RFC 3168).
+type ECNCodepoint uint8
+
+const (
+	// ECNNotECT means the sender is not ECN capable.
+	ECNNotECT ECNCodepoint = 0
+	// ECNECT1 is ECN capable transport (1).
+	ECNECT1 ECNCodepoint = 1
+	// ECNECT0 is ECN capable transport (0).
+	ECNECT0 ECNCodepoint = 2
+	// ECNCE means congestion experienced.
+	ECNCE ECNCodepoint = 3
+)
+
+const ecnMask = 0x3
+
+var ecnCodepointNames = map[ECNCodepoint]string{
+	ECNNotECT: "not-ect",
+	ECNECT1:   "ect1",
+	ECNECT0:   "ect0",
+	ECNCE:     "ce",
+}
+
+func (c ECNCodepoint) String() string {
+	if name, ok := ecnCodepointNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("ecn(%d)", uint8(c))
+}
+
+// ParseECNCodepoint parses the name of a codepoint: not-ect, ect0, ect1 or
+// ce.
+func ParseECNCodepoint(s string) (ECNCodepoint, error) {
+	for c, name := range ecnCodepointNames {
+		if s == name {
+			return c, nil
+		}
+	}
+	return ECNNotECT, fmt.Errorf("invalid ECN codepoint %q", s)
+}
+
+// ECNReport describes what happened to the ECN signals of a TCP probe.
+//
+// Bleaching is detected from the probe as quoted in an ICMP error, so it is
+// only reported for probes that expire on the way (with a TTL lower than
+// the number of hops to the destination), or that are otherwise rejected
+// by a router. The codepoint of the SYN-ACK shows what arrived on the
+// return path instead.
+type ECNReport struct {
+	// Codepoint is the ECN codepoint the probe was sent with.
+	Codepoint ECNCodepoint
+	// Setup is true if the probe was an ECN-setup SYN (ECE and CWR set).
+	Setup bool
+
+	// SynAck is true if the destination replied with a SYN-ACK.
+	SynAck bool
+	// Negotiated is true if the SYN-ACK was an ECN-setup SYN-ACK (ECE
+	// set, CWR clear).
+	Negotiated bool
+	// SynAckTOS is true if the IP TOS (IPv6 traffic class) of the SYN-ACK
+	// was received, in which case SynAckCodepoint is its codepoint. RFC
+	// 3168 hosts send SYN-ACKs as not-ect; anything else was set by the
+	// destination or remarked on the way back.
+	SynAckTOS       bool
+	SynAckCodepoint ECNCodepoint
+
+	// QuotedBy is the address that quoted the probe in an ICMP error, or
+	// nil if the probe was not quoted. The quote shows the probe as it
+	// arrived at QuotedBy.
+	QuotedBy net.IP
+	// QuotedCodepoint is the codepoint in the quoted IP header.
+	QuotedCodepoint ECNCodepoint
+	// QuotedFlags is true if the quote was long enough to include the TCP
+	// flags.
+	QuotedFlags bool
+	// QuotedECE and QuotedCWR are the flags in the quoted TCP header.
+	QuotedECE, QuotedCWR bool
+}
+
+// CodepointBleached returns true if the probe was sent ECN capable but was
+// quoted with the codepoint cleared.
+func (r *ECNReport) CodepointBleached() bool {
+	return r.QuotedBy != nil && r.Codepoint != ECNNotECT && r.QuotedCodepoint == ECNNotECT
+}
+
+// FlagsBleached returns true if the probe was an ECN-setup SYN but was
+// quoted without ECE or CWR.
+func (r *ECNReport) FlagsBleached() bool {
+	return r.QuotedFlags && r.Setup && !(r.QuotedECE && r.QuotedCWR)
+}
+
+func (r *ECNReport) String() string {
+	sent := r.Codepoint.String()
+	if r.Setup {
+		sent += " ecn-setup syn"
+	}
+	parts := []string{"sent " + sent}
+	switch {
+	case r.Negotiated:
+		parts = append(parts, "negotiated")
+	case r.SynAck:
+		parts = append(parts, "not negotiated")
+	}
+	if r.SynAckTOS {
+		parts = append(parts, "syn-ack "+r.SynAckCodepoint.String())
+	}
+	if r.QuotedBy != nil {
+		quote := fmt.Sprintf("quoted by %v with %v", r.QuotedBy, r.QuotedCodepoint)
+		switch {
+		case r.CodepointBleached():
+			quote += " (codepoint bleached)"
+		case r.QuotedCodepoint != r.Codepoint:
+			quote += " (codepoint remarked)"
+		}
+		if r.FlagsBleached() {
+			quote += " (flags bleached)"
+		}
+		parts = append(parts, quote)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ecnObserver fills in an ECNReport from the replies to a TCP probe.
+type ecnObserver struct {
+	tcp    *tcpPacket
+	src    net.IP
+	dest   net.IP
+	report *ECNReport
+}
+
+func newECNObserver(tcp *tcpPacket, src, dest net.IP, codepoint ECNCodepoint) *ecnObserver {
+	return &ecnObserver{
+		tcp:  tcp,
+		src:  src,
+		dest: dest,
+		report: &ECNReport{
+			Codepoint: codepoint,
+			Setup:     tcp.flags.ece && tcp.flags.cwr,
+		},
+	}
+}
+
+// wrap classify so that every reply is observed.
+func (o *ecnObserver) wrap(classify classifier) classifier {
+	return func(r *reply) (Verdict, string, bool) {
+		verdict, reason, ok := classify(r)
+		if ok && verdict == VerdictOpen && r.proto == tcpProtoNum {
+			o.observeSynAck(r)
+		} else if r.proto == icmpProtoNum || r.proto == icmpv6ProtoNum {
+			o.observeQuote(r)
+		}
+		return verdict, reason, ok
+	}
+}
+
+func (o *ecnObserver) observeSynAck(r *reply) {
+	var resp tcpPacket
+	if _, err := resp.decode(r.data, o.dest, o.src); err != nil && err != ErrBadChecksum {
+		return
+	}
+	o.report.SynAck = true
+	o.report.Negotiated = resp.flags.ece && !resp.flags.cwr
+	if o.report.SynAckTOS = r.hasTOS; r.hasTOS {
+		o.report.SynAckCodepoint = ECNCodepoint(r.tos & ecnMask)
+	}
+}
+
+func (o *ecnObserver) observeQuote(r *reply) {
+	q, ok := decodeICMPQuote(r)
+	if !ok {
+		return
+	}
+	if !q.matches(tcpProtoNum, o.dest, func(quoted []byte) bool {
+		decoder := binary.BigEndian
+		return decoder.Uint16(quoted) == o.tcp.srcPort &&
+			decoder.Uint16(quoted[2:]) == o.tcp.destPort &&
+			decoder.Uint32(quoted[4:]) == o.tcp.seq
+	}) {
+		return
+	}
+	o.report.QuotedBy = r.from
+	o.report.QuotedCodepoint = ECNCodepoint(q.tos & ecnMask)
+	if o.report.QuotedFlags = len(q.data) >= 14; o.report.QuotedFlags {
+		o.report.QuotedCWR = q.data[13]&(1<<7) != 0
+		o.report.QuotedECE = q.data[13]&(1<<6) != 0
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseECNCodepoint(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []ECNCodepoint{ECNNotECT, ECNECT0, ECNECT1, ECNCE} {
+		got, err := ParseECNCodepoint(c.String())
+		if err != nil || got != c {
+			t.Errorf("ParseECNCodepoint(%q) = %v, %v; want %v, nil", c.String(), got, err, c)
+		}
+	}
+	if _, err := ParseECNCodepoint("ect2"); err == nil {
+		t.Errorf("ParseECNCodepoint(%q) = _, nil, want error", "ect2")
+	}
+}
+
+func TestOptionsTOS(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		opt  *Options
+		want uint8
+	}{
+		{opt: nil, want: 0},
+		{opt: &Options{DSCP: 46}, want: 0xb8},
+		{opt: &Options{ECN: ECNECT0}, want: 0x02},
+		{opt: &Options{DSCP: 46, ECN: ECNCE}, want: 0xbb},
+	} {
+		if got := tc.opt.tos(); got != tc.want {
+			t.Errorf("%+v.tos() = %#x, want %#x", tc.opt, got, tc.want)
+		}
+	}
+}
+
+func TestECNObserver(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.0.2")
+	router := net.ParseIP("10.0.0.254")
+	probe := &tcpPacket{srcPort: 3000, destPort: 80, seq: 100, flags: tcpFlags{syn: true, ece: true, cwr: true}}
+
+	synAck := func(flags tcpFlags) *reply {
+		pkt := make([]byte, tcpHeaderSize)
+		(&tcpPacket{srcPort: 80, destPort: 3000, ack: 101, flags: flags}).encode(pkt, dest, src, nil)
+		return &reply{proto: tcpProtoNum, from: dest, data: pkt}
+	}
+	synAckTOS := func(flags tcpFlags, tos uint8) *reply {
+		r := synAck(flags)
+		r.tos, r.hasTOS = tos, true
+		return r
+	}
+	// quote returns an ICMP time exceeded message quoting the probe with
+	// the given TOS, flags and quote length.
+	quote := func(tos uint8, flags tcpFlags, quoteLen int) *reply {
+		tcp := *probe
+		tcp.flags = flags
+		seg := make([]byte, tcpHeaderSize)
+		tcp.encode(seg, src, dest, nil)
+		ip := &ipv4Header{tos: tos, ttl: 1, protocol: tcpProtoNum, src: src, dest: dest}
+		pkt := make([]byte, ip.headerLen()+len(seg))
+		ip.encode(pkt, seg)
+		b := []byte{icmpTypeTimeExceeded, 0, 0, 0, 0, 0, 0, 0}
+		return &reply{proto: icmpProtoNum, from: router, data: append(b, pkt[:ip.headerLen()+quoteLen]...)}
+	}
+	setup := tcpFlags{syn: true, ece: true, cwr: true}
+
+	for _, tc := range []struct {
+		desc    string
+		r       *reply
+		want    ECNReport
+		bleachC bool
+		bleachF bool
+	}{
+		{
+			desc: "negotiated",
+			r:    synAck(tcpFlags{syn: true, ack: true, ece: true}),
+			want: ECNReport{Codepoint: ECNECT0, Setup: true, SynAck: true, Negotiated: true},
+		},
+		{
+			desc: "not negotiated",
+			r:    synAck(tcpFlags{syn: true, ack: true}),
+			want: ECNReport{Codepoint: ECNECT0, Setup: true, SynAck: true},
+		},
+		{
+			desc: "syn-ack codepoint",
+			r:    synAckTOS(tcpFlags{syn: true, ack: true, ece: true}, 0xb9),
+			want: ECNReport{Codepoint: ECNECT0, Setup: true, SynAck: true, Negotiated: true, SynAckTOS: true, SynAckCodepoint: ECNECT1},
+		},
+		{
+			desc: "ece and cwr reflected",
+			r:    synAck(tcpFlags{syn: true, ack: true, ece: true, cwr: true}),
+			want: ECNReport{Codepoint: ECNECT0, Setup: true, SynAck: true},
+		},
+		{
+			desc: "quote unchanged",
+			r:    quote(0x02, setup, tcpHeaderSize),
+			want: ECNReport{Codepoint: ECNECT0, Setup: true, QuotedBy: router, QuotedCodepoint: ECNECT0, QuotedFlags: true, QuotedECE: true, QuotedCWR: true},
+		},
+		{
+			desc:    "quote bleached",
+			r:       quote(0x00, tcpFlags{syn: true}, tcpHeaderSize),
+			want:    ECNReport{Codepoint: ECNECT0, Setup: true, QuotedBy: router, QuotedCodepoint: ECNNotECT, QuotedFlags: true},
+			bleachC: true,
+			bleachF: true,
+		},
+		{
+			desc: "short quote",
+			r:    quote(0x03, tcpFlags{syn: true}, 8),
+			want: ECNReport{Codepoint: ECNECT0, Setup: true, QuotedBy: router, QuotedCodepoint: ECNCE},
+		},
+	} {
+		o := newECNObserver(probe, src, dest, ECNECT0)
+		classify := o.wrap(classifyTCP(probe, src, dest, 0))
+		classify(tc.r)
+		if !reflect.DeepEqual(*o.report, tc.want) {
+			t.Errorf("%s: report = %+v, want %+v", tc.desc, *o.report, tc.want)
+		}
+		if got := o.report.CodepointBleached(); got != tc.bleachC {
+			t.Errorf("%s: CodepointBleached() = %t, want %t", tc.desc, got, tc.bleachC)
+		}
+		if got := o.report.FlagsBleached(); got != tc.bleachF {
+			t.Errorf("%s: FlagsBleached() = %t, want %t", tc.desc, got, tc.bleachF)
+		}
+	}
+}
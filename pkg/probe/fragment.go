@@ -0,0 +1,421 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	ipv6FragmentProtoNum  = 44
+	ipv6FragmentHeaderLen = 8
+
+	defaultReassemblyTimeout = 30 * time.Second
+	// defaultMaxReassemblyEntries is the default number of incomplete
+	// datagrams kept.
+	defaultMaxReassemblyEntries = 1024
+	// defaultMaxFragments is the default number of fragments kept for a
+	// datagram.
+	defaultMaxFragments = 64
+	// defaultMaxDatagramSize is the default limit on the reassembled
+	// payload, the largest an IP datagram can carry.
+	defaultMaxDatagramSize = 65535
+)
+
+// ErrReassemblyLimit is returned by Reassembler.Add when a datagram goes
+// over the fragment or size limit. The datagram is dropped.
+var ErrReassemblyLimit = errors.New("datagram exceeds the reassembly limits")
+
+// FragmentOrder is the order in which fragments are sent.
+type FragmentOrder int
+
+const (
+	// FragmentInOrder sends the fragments in order.
+	FragmentInOrder FragmentOrder = iota
+	// FragmentReversed sends the last fragment first.
+	FragmentReversed
+	// FragmentOverlapping sends the fragments in order, but each fragment
+	// after the first also repeats the last 8 bytes of the previous one.
+	// Many receivers (e.g. Linux and anything following RFC 5722 for
+	// IPv6) drop the datagram when this happens.
+	FragmentOverlapping
+)
+
+var fragmentOrderNames = map[FragmentOrder]string{
+	FragmentInOrder:     "in-order",
+	FragmentReversed:    "reversed",
+	FragmentOverlapping: "overlapping",
+}
+
+func (o FragmentOrder) String() string {
+	if s, ok := fragmentOrderNames[o]; ok {
+		return s
+	}
+	return fmt.Sprintf("FragmentOrder(%d)", int(o))
+}
+
+// ParseFragmentOrder parses "in-order", "reversed" or "overlapping".
+func ParseFragmentOrder(s string) (FragmentOrder, error) {
+	for o, name := range fragmentOrderNames {
+		if s == name {
+			return o, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid fragment order %q", s)
+}
+
+// fragment is a piece of the payload starting at offset.
+type fragment struct {
+	offset int
+	data   []byte
+	last   bool
+}
+
+// splitFragments splits payload into fragments of at most size bytes
+// (rounded down to a multiple of 8) in the given order.
+func splitFragments(payload []byte, size int, order FragmentOrder) ([]fragment, error) {
+	size &^= 7
+	if size <= 0 {
+		return nil, fmt.Errorf("fragment size must be at least 8")
+	}
+
+	var frags []fragment
+	for offset := 0; offset < len(payload); offset += size {
+		start := offset
+		if order == FragmentOverlapping && offset > 0 {
+			start -= 8
+		}
+		end := offset + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		frags = append(frags, fragment{offset: start, data: payload[start:end], last: end == len(payload)})
+	}
+	if order == FragmentReversed {
+		for i, j := 0, len(frags)-1; i < j; i, j = i+1, j-1 {
+			frags[i], frags[j] = frags[j], frags[i]
+		}
+	}
+	return frags, nil
+}
+
+// fragmentIPv4 splits payload into IPv4 packets with the header h. h.id
+// should be set as it identifies the fragments of a datagram.
+func fragmentIPv4(h *ipv4Header, payload []byte, size int, order FragmentOrder) ([][]byte, error) {
+	frags, err := splitFragments(payload, size, order)
+	if err != nil {
+		return nil, err
+	}
+	var pkts [][]byte
+	for _, f := range frags {
+		fh := *h
+		fh.totalLen = 0
+		fh.dontFragment = false
+		fh.moreFragments = !f.last
+		fh.fragOffset = uint16(f.offset / 8)
+		pkt := make([]byte, fh.headerLen()+len(f.data))
+		fh.encode(pkt, f.data)
+		pkts = append(pkts, pkt)
+	}
+	return pkts, nil
+}
+
+// fragmentIPv6 splits payload into IPv6 packets with the header h and a
+// fragment extension header with the given identification. h.nextHeader is
+// the protocol of the payload.
+func fragmentIPv6(h *ipv6Header, id uint32, payload []byte, size int, order FragmentOrder) ([][]byte, error) {
+	frags, err := splitFragments(payload, size, order)
+	if err != nil {
+		return nil, err
+	}
+	var pkts [][]byte
+	for _, f := range frags {
+		ext := make([]byte, ipv6FragmentHeaderLen+len(f.data))
+		fh := ipv6FragmentHeader{nextHeader: h.nextHeader, offset: uint16(f.offset / 8), more: !f.last, id: id}
+		fh.encode(ext)
+		copy(ext[ipv6FragmentHeaderLen:], f.data)
+
+		ip := *h
+		ip.nextHeader = ipv6FragmentProtoNum
+		ip.payloadLen = 0
+		pkt := make([]byte, ipv6HeaderSize+len(ext))
+		ip.encode(pkt, ext)
+		pkts = append(pkts, pkt)
+	}
+	return pkts, nil
+}
+
+// ipv6FragmentHeader is the IPv6 fragment extension header (RFC 8200
+// section 4.5).
+type ipv6FragmentHeader struct {
+	nextHeader uint8  // 0
+	offset     uint16 // 2 (in units of 8 bytes)
+	more       bool   // 3
+	id         uint32 // 4
+}
+
+func (f *ipv6FragmentHeader) encode(pkt []byte) int {
+	pkt[0] = f.nextHeader
+	pkt[1] = 0
+	v := f.offset << 3
+	if f.more {
+		v |= 1
+	}
+	binary.BigEndian.PutUint16(pkt[2:], v)
+	binary.BigEndian.PutUint32(pkt[4:], f.id)
+	return ipv6FragmentHeaderLen
+}
+
+func (f *ipv6FragmentHeader) decode(pkt []byte) ([]byte, error) {
+	if len(pkt) < ipv6FragmentHeaderLen {
+		return nil, ErrTruncated
+	}
+	f.nextHeader = pkt[0]
+	v := binary.BigEndian.Uint16(pkt[2:])
+	f.offset = v >> 3
+	f.more = v&1 != 0
+	f.id = binary.BigEndian.Uint32(pkt[4:])
+	return pkt[ipv6FragmentHeaderLen:], nil
+}
+
+type reassemblyKey struct {
+	src, dest string
+	proto     uint8
+	id        uint32
+}
+
+type reassemblyEntry struct {
+	key reassemblyKey
+	// header is the IP header of the first fragment (offset 0).
+	header []byte
+	frags  []fragment
+	first  time.Time
+	// size is the number of payload bytes received, counting overlaps
+	// twice, and end the end of the last fragment if it has arrived.
+	size int
+	end  int
+}
+
+// Reassembler reassembles IPv4 and IPv6 fragments, for example from a
+// packet capture, so that the probe identity can be found in fragmented
+// probes.
+type Reassembler struct {
+	// Timeout after which incomplete datagrams are dropped. Defaults to
+	// 30 seconds.
+	Timeout time.Duration
+	// MaxEntries is the number of incomplete datagrams kept. When it is
+	// reached, the oldest is dropped. Defaults to 1024.
+	MaxEntries int
+	// MaxFragments is the number of fragments kept for a datagram.
+	// Defaults to 64.
+	MaxFragments int
+	// MaxDatagramSize limits the payload of a datagram. Defaults to 65535.
+	MaxDatagramSize int
+
+	entries map[reassemblyKey]*list.Element
+	// order has the entries, oldest first.
+	order *list.List
+	now   func() time.Time
+}
+
+// NewReassembler returns a new Reassembler.
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		Timeout:         defaultReassemblyTimeout,
+		MaxEntries:      defaultMaxReassemblyEntries,
+		MaxFragments:    defaultMaxFragments,
+		MaxDatagramSize: defaultMaxDatagramSize,
+		entries:         map[reassemblyKey]*list.Element{},
+		order:           list.New(),
+		now:             time.Now,
+	}
+}
+
+// Add an IP packet. If the packet is not a fragment, it is returned as is.
+// If it completes a datagram, the reassembled packet is returned with
+// fragmented set to true. Otherwise nil is returned, with
+// ErrReassemblyLimit if the datagram was dropped for going over a limit.
+func (r *Reassembler) Add(pkt []byte) (datagram []byte, fragmented bool, err error) {
+	r.expire()
+	if len(pkt) == 0 {
+		return nil, false, ErrTruncated
+	}
+
+	var (
+		key    reassemblyKey
+		frag   fragment
+		header []byte
+	)
+	switch pkt[0] >> 4 {
+	case 4:
+		var ip ipv4Header
+		payload, err := ip.decode(pkt)
+		if err != nil && err != ErrBadChecksum {
+			return nil, false, err
+		}
+		if !ip.moreFragments && ip.fragOffset == 0 {
+			return pkt, false, nil
+		}
+		key = reassemblyKey{src: ip.src.String(), dest: ip.dest.String(), proto: ip.protocol, id: uint32(ip.id)}
+		frag = fragment{offset: int(ip.fragOffset) * 8, data: payload, last: !ip.moreFragments}
+		header = pkt[:ip.headerLen()]
+	case 6:
+		var ip ipv6Header
+		payload, err := ip.decode(pkt)
+		if err != nil {
+			return nil, false, err
+		}
+		if ip.nextHeader != ipv6FragmentProtoNum {
+			return pkt, false, nil
+		}
+		var fh ipv6FragmentHeader
+		data, err := fh.decode(payload)
+		if err != nil {
+			return nil, false, err
+		}
+		key = reassemblyKey{src: ip.src.String(), dest: ip.dest.String(), proto: fh.nextHeader, id: fh.id}
+		frag = fragment{offset: int(fh.offset) * 8, data: data, last: !fh.more}
+		// The reassembled packet has the header without the fragment
+		// extension header.
+		ip.nextHeader = fh.nextHeader
+		header = make([]byte, ipv6HeaderSize)
+		ip.payloadLen = 0
+		ip.encode(header, nil)
+	default:
+		return nil, false, fmt.Errorf("invalid IP version %d", pkt[0]>>4)
+	}
+
+	fragEnd := frag.offset + len(frag.data)
+	if fragEnd > r.MaxDatagramSize {
+		r.remove(key)
+		return nil, false, ErrReassemblyLimit
+	}
+	var e *reassemblyEntry
+	if elem, ok := r.entries[key]; ok {
+		e = elem.Value.(*reassemblyEntry)
+	} else {
+		if r.order.Len() >= r.MaxEntries {
+			r.remove(r.order.Front().Value.(*reassemblyEntry).key)
+		}
+		e = &reassemblyEntry{key: key, first: r.now()}
+		r.entries[key] = r.order.PushBack(e)
+	}
+	if len(e.frags) >= r.MaxFragments || e.size+len(frag.data) > r.MaxDatagramSize {
+		r.remove(key)
+		return nil, false, ErrReassemblyLimit
+	}
+	frag.data = append([]byte{}, frag.data...)
+	e.frags = append(e.frags, frag)
+	e.size += len(frag.data)
+	if frag.last {
+		e.end = fragEnd
+	}
+	if frag.offset == 0 {
+		e.header = append([]byte{}, header...)
+	}
+
+	payload, ok := e.reassemble()
+	if !ok {
+		return nil, false, nil
+	}
+	r.remove(key)
+	return buildReassembled(e.header, payload), true, nil
+}
+
+// remove the entry for key, if any.
+func (r *Reassembler) remove(key reassemblyKey) {
+	if elem, ok := r.entries[key]; ok {
+		r.order.Remove(elem)
+		delete(r.entries, key)
+	}
+}
+
+// reassemble returns the payload if all of the fragments are present.
+func (e *reassemblyEntry) reassemble() ([]byte, bool) {
+	// Without the first and last fragments, or with fewer bytes than the
+	// datagram, there must be a hole.
+	if e.header == nil || e.end == 0 || e.size < e.end {
+		return nil, false
+	}
+	frags := append([]fragment{}, e.frags...)
+	sort.Slice(frags, func(i, j int) bool { return frags[i].offset < frags[j].offset })
+
+	var (
+		end      int
+		haveLast bool
+	)
+	for _, f := range frags {
+		if f.offset > end {
+			// Hole.
+			return nil, false
+		}
+		if fEnd := f.offset + len(f.data); fEnd > end {
+			end = fEnd
+		}
+		if f.last {
+			haveLast = true
+		}
+	}
+	if !haveLast {
+		return nil, false
+	}
+	payload := make([]byte, end)
+	for _, f := range frags {
+		copy(payload[f.offset:], f.data)
+	}
+	return payload, true
+}
+
+// buildReassembled returns a packet with the header of the first fragment,
+// updated to describe the reassembled payload. The header was already
+// decoded when the fragment was added, so errors are not checked again.
+func buildReassembled(header, payload []byte) []byte {
+	if header[0]>>4 == 4 {
+		var ip ipv4Header
+		ip.decode(header)
+		ip.totalLen = 0
+		ip.moreFragments = false
+		ip.fragOffset = 0
+		pkt := make([]byte, ip.headerLen()+len(payload))
+		ip.encode(pkt, payload)
+		return pkt
+	}
+	var ip ipv6Header
+	ip.decode(header)
+	ip.payloadLen = 0
+	pkt := make([]byte, ipv6HeaderSize+len(payload))
+	ip.encode(pkt, payload)
+	return pkt
+}
+
+// expire drops the datagrams older than the timeout. The entries are in
+// order of arrival, so only the expired ones are looked at.
+func (r *Reassembler) expire() {
+	now := r.now()
+	for elem := r.order.Front(); elem != nil; elem = r.order.Front() {
+		e := elem.Value.(*reassemblyEntry)
+		if now.Sub(e.first) <= r.Timeout {
+			return
+		}
+		r.remove(e.key)
+	}
+}
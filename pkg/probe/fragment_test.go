@@ -0,0 +1,257 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitFragments(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 20)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	type frag struct {
+		offset, len int
+		last        bool
+	}
+	for _, tc := range []struct {
+		order FragmentOrder
+		size  int
+		want  []frag
+	}{
+		{order: FragmentInOrder, size: 8, want: []frag{{0, 8, false}, {8, 8, false}, {16, 4, true}}},
+		{order: FragmentInOrder, size: 13, want: []frag{{0, 8, false}, {8, 8, false}, {16, 4, true}}},
+		{order: FragmentInOrder, size: 32, want: []frag{{0, 20, true}}},
+		{order: FragmentReversed, size: 8, want: []frag{{16, 4, true}, {8, 8, false}, {0, 8, false}}},
+		{order: FragmentOverlapping, size: 16, want: []frag{{0, 16, false}, {8, 12, true}}},
+	} {
+		frags, err := splitFragments(payload, tc.size, tc.order)
+		if err != nil {
+			t.Errorf("splitFragments(_, %d, %v) = _, %v, want nil", tc.size, tc.order, err)
+			continue
+		}
+		var got []frag
+		for _, f := range frags {
+			if !reflect.DeepEqual(f.data, payload[f.offset:f.offset+len(f.data)]) {
+				t.Errorf("splitFragments(_, %d, %v): fragment at %d has data %v", tc.size, tc.order, f.offset, f.data)
+			}
+			got = append(got, frag{f.offset, len(f.data), f.last})
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitFragments(_, %d, %v) = %v, want %v", tc.size, tc.order, got, tc.want)
+		}
+	}
+
+	if _, err := splitFragments(payload, 7, FragmentInOrder); err == nil {
+		t.Errorf("splitFragments(_, 7, _) = _, nil, want error")
+	}
+}
+
+func TestFragmentReassemble(t *testing.T) {
+	t.Parallel()
+
+	tcp := &tcpPacket{srcPort: 3000, destPort: 80, seq: 1, flags: tcpFlags{syn: true}}
+	id, err := (&Identity{Magic: "magic", ID: 42, Timestamp: time.Unix(1, 0), Sender: "host"}).Encode()
+	if err != nil {
+		t.Fatalf("Encode() = _, %v, want nil", err)
+	}
+
+	for _, tc := range []struct {
+		desc  string
+		v6    bool
+		order FragmentOrder
+	}{
+		{desc: "ipv4 in order", order: FragmentInOrder},
+		{desc: "ipv4 reversed", order: FragmentReversed},
+		{desc: "ipv4 overlapping", order: FragmentOverlapping},
+		{desc: "ipv6 in order", v6: true, order: FragmentInOrder},
+		{desc: "ipv6 reversed", v6: true, order: FragmentReversed},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			src, dest := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+			if tc.v6 {
+				src, dest = net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+			}
+			seg := make([]byte, tcp.headerLen()+len(id))
+			tcp.encode(seg, src, dest, id)
+
+			var (
+				pkts [][]byte
+				want []byte
+				err  error
+			)
+			if tc.v6 {
+				ip := &ipv6Header{nextHeader: tcpProtoNum, hopLimit: 64, src: src, dest: dest}
+				pkts, err = fragmentIPv6(ip, 1234, seg, 24, tc.order)
+				want = make([]byte, ipv6HeaderSize+len(seg))
+				ip.encode(want, seg)
+			} else {
+				ip := &ipv4Header{id: 1234, ttl: 64, protocol: tcpProtoNum, src: src, dest: dest}
+				pkts, err = fragmentIPv4(ip, seg, 24, tc.order)
+				want = make([]byte, ip.headerLen()+len(seg))
+				ip.encode(want, seg)
+			}
+			if err != nil {
+				t.Fatalf("fragment() = _, %v, want nil", err)
+			}
+			if len(pkts) < 2 {
+				t.Fatalf("fragment() = %d packets, want at least 2", len(pkts))
+			}
+
+			r := NewReassembler()
+			for i, pkt := range pkts {
+				got, fragmented, err := r.Add(pkt)
+				if err != nil {
+					t.Fatalf("Add(pkt %d) = _, _, %v, want nil", i, err)
+				}
+				if i < len(pkts)-1 {
+					if got != nil {
+						t.Errorf("Add(pkt %d) = %v, want nil (incomplete)", i, got)
+					}
+					continue
+				}
+				if !fragmented || !reflect.DeepEqual(got, want) {
+					t.Errorf("Add(pkt %d) = %v, %t; want %v, true", i, got, fragmented, want)
+				}
+				if _, err := FindIdentity(got); err != nil {
+					t.Errorf("FindIdentity(%v) = _, %v, want nil", got, err)
+				}
+			}
+			if len(r.entries) != 0 {
+				t.Errorf("r.entries = %v, want empty", r.entries)
+			}
+		})
+	}
+}
+
+func TestReassemblerPassthroughAndExpiry(t *testing.T) {
+	t.Parallel()
+
+	ip := &ipv4Header{id: 1, ttl: 64, protocol: udpProtoNum, src: net.ParseIP("10.0.0.1"), dest: net.ParseIP("10.0.0.2")}
+	payload := make([]byte, 32)
+	pkt := make([]byte, ip.headerLen()+len(payload))
+	ip.encode(pkt, payload)
+
+	now := time.Unix(100, 0)
+	r := NewReassembler()
+	r.now = func() time.Time { return now }
+
+	got, fragmented, err := r.Add(pkt)
+	if err != nil || fragmented || !reflect.DeepEqual(got, pkt) {
+		t.Errorf("Add(unfragmented) = %v, %t, %v; want packet, false, nil", got, fragmented, err)
+	}
+
+	pkts, err := fragmentIPv4(ip, payload, 16, FragmentInOrder)
+	if err != nil {
+		t.Fatalf("fragmentIPv4() = _, %v, want nil", err)
+	}
+	if got, _, _ := r.Add(pkts[0]); got != nil {
+		t.Errorf("Add(first) = %v, want nil", got)
+	}
+	now = now.Add(time.Minute)
+	if got, _, _ := r.Add(pkts[1]); got != nil {
+		t.Errorf("Add(last after timeout) = %v, want nil", got)
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	t.Parallel()
+
+	src, dest := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	// fragments returns the fragments of a 64 byte datagram with the
+	// given ID, 8 bytes each.
+	fragments := func(id uint16) [][]byte {
+		ip := &ipv4Header{id: id, ttl: 64, protocol: udpProtoNum, src: src, dest: dest}
+		pkts, err := fragmentIPv4(ip, make([]byte, 64), 8, FragmentInOrder)
+		if err != nil {
+			t.Fatalf("fragmentIPv4() = _, %v, want nil", err)
+		}
+		return pkts
+	}
+
+	t.Run("entries", func(t *testing.T) {
+		r := NewReassembler()
+		r.MaxEntries = 2
+		for id := uint16(1); id <= 3; id++ {
+			r.Add(fragments(id)[0])
+		}
+		if len(r.entries) != 2 || r.order.Len() != 2 {
+			t.Fatalf("%d entries, %d in order; want 2", len(r.entries), r.order.Len())
+		}
+		// The oldest datagram was dropped, so it can't be completed.
+		for _, pkt := range fragments(1)[1:] {
+			if got, _, _ := r.Add(pkt); got != nil {
+				t.Errorf("Add(evicted datagram) = %v, want nil", got)
+			}
+		}
+	})
+
+	t.Run("fragments", func(t *testing.T) {
+		r := NewReassembler()
+		r.MaxFragments = 4
+		var err error
+		for _, pkt := range fragments(1) {
+			if _, _, err = r.Add(pkt); err != nil {
+				break
+			}
+		}
+		if err != ErrReassemblyLimit || len(r.entries) != 0 {
+			t.Errorf("Add() = %v with %d entries; want %v with none", err, len(r.entries), ErrReassemblyLimit)
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		r := NewReassembler()
+		r.MaxDatagramSize = 32
+		pkts := fragments(1)
+		if _, _, err := r.Add(pkts[0]); err != nil {
+			t.Fatalf("Add(first) = %v, want nil", err)
+		}
+		// Past the end of the limit.
+		if _, _, err := r.Add(pkts[len(pkts)-1]); err != ErrReassemblyLimit || len(r.entries) != 0 {
+			t.Errorf("Add(last) = %v with %d entries; want %v with none", err, len(r.entries), ErrReassemblyLimit)
+		}
+		// Repeated fragments within the limit.
+		for i := 0; i < 4; i++ {
+			r.Add(pkts[1])
+		}
+		if _, _, err := r.Add(pkts[1]); err != ErrReassemblyLimit {
+			t.Errorf("Add(repeated) = %v; want %v", err, ErrReassemblyLimit)
+		}
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		now := time.Unix(100, 0)
+		r := NewReassembler()
+		r.now = func() time.Time { return now }
+		r.Add(fragments(1)[0])
+		now = now.Add(20 * time.Second)
+		r.Add(fragments(2)[0])
+		now = now.Add(20 * time.Second)
+		r.Add(fragments(3)[0])
+		if _, ok := r.entries[reassemblyKey{src: "10.0.0.1", dest: "10.0.0.2", proto: udpProtoNum, id: 1}]; ok || len(r.entries) != 2 {
+			t.Errorf("entries = %v; want datagrams 2 and 3", r.entries)
+		}
+	})
+}
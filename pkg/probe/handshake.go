@@ -0,0 +1,369 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	handshakeWindowSize = 65535
+	// handshakeAckGrace is how long to wait for a reset after the final
+	// ACK of the handshake.
+	handshakeAckGrace = 500 * time.Millisecond
+)
+
+// HandshakeStep is the outcome of one step of a userspace TCP exchange.
+type HandshakeStep struct {
+	// Name of the step: "syn", "ack", "data", "fin" or "close".
+	Name string
+	// OK is true if the peer responded as expected.
+	OK bool
+	// Detail describes the response, e.g. "syn-ack" or "timeout".
+	Detail string
+	// RTT is the time between sending the segment and the response, zero
+	// if there was no response.
+	RTT time.Duration
+}
+
+// HandshakeReport is the outcome of Handshake.
+type HandshakeReport struct {
+	Identity *Identity
+	Dest     string
+	Port     int
+	Steps    []*HandshakeStep
+}
+
+// OK returns true if all the steps succeeded.
+func (r *HandshakeReport) OK() bool {
+	for _, s := range r.Steps {
+		if !s.OK {
+			return false
+		}
+	}
+	return len(r.Steps) > 0
+}
+
+func (r *HandshakeReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "handshake %v with %s:%d\n", r.Identity, r.Dest, r.Port)
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, s := range r.Steps {
+		status := "FAIL"
+		if s.OK {
+			status = "ok"
+		}
+		detail := s.Detail
+		if s.RTT > 0 {
+			detail = fmt.Sprintf("%s in %v", detail, s.RTT)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, status, detail)
+	}
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// Handshake opens a TCP connection from userspace over raw sockets: it
+// completes the SYN/SYN-ACK/ACK handshake, sends the probe identity as data,
+// checks that the data is acknowledged and closes with a FIN (or a RST if
+// the peer does not close its side). Each step is reported separately.
+// opt.TCPOptions are not used. opt may be nil.
+func Handshake(src string, srcPort int, dest string, destPort int, magic string, opt *Options) (*HandshakeReport, error) {
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
+	if err != nil {
+		return nil, err
+	}
+	if srcPort, err = sourcePort(srcPort, tcpProtoNum); err != nil {
+		return nil, err
+	}
+	id, payload, err := newPayload(magic)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter *rstFilter
+	if opt != nil && opt.SuppressRST {
+		if filter, err = newRSTFilter(srcAddr.IP, destAddr.IP, srcPort, destPort); err != nil {
+			return nil, err
+		}
+		defer filter.remove()
+	}
+
+	s, err := newSession(srcAddr, destAddr, tcpProtoNum, opt)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	h := &handshake{
+		write:    s.write,
+		listener: s.listener,
+		src:      srcAddr.IP,
+		dest:     destAddr.IP,
+		srcPort:  uint16(srcPort),
+		destPort: uint16(destPort),
+		seq:      uint32(id.ID),
+		timeout:  opt.timeout(),
+		filter:   filter,
+	}
+	report := &HandshakeReport{Identity: id, Dest: destAddr.IP.String(), Port: destPort}
+	report.Steps = h.run(payload)
+	return report, nil
+}
+
+// handshake is the state of a userspace TCP connection.
+type handshake struct {
+	// write sends a segment and returns the time it was sent.
+	write             func(pkt []byte) (time.Time, error)
+	listener          *replyListener
+	src, dest         net.IP
+	srcPort, destPort uint16
+	// seq is the next sequence number to send.
+	seq uint32
+	// ack is the next sequence number expected from the peer.
+	ack     uint32
+	timeout time.Duration
+	filter  *rstFilter
+	// reset is set once the peer has reset the connection.
+	reset bool
+	// peerFin is set once the peer has closed its side.
+	peerFin bool
+}
+
+// run the exchange and return the steps that were attempted.
+func (h *handshake) run(payload []byte) []*HandshakeStep {
+	var steps []*HandshakeStep
+	for _, step := range []func() *HandshakeStep{
+		h.syn,
+		h.thirdAck,
+		func() *HandshakeStep { return h.data(payload) },
+		h.fin,
+	} {
+		st := step()
+		glog.V(2).Infof("Handshake step %s: ok=%t %s", st.Name, st.OK, st.Detail)
+		steps = append(steps, st)
+		if !st.OK {
+			break
+		}
+	}
+	// The SYN has no connection to clean up if it failed.
+	if len(steps) > 1 || steps[0].OK {
+		steps = append(steps, h.close())
+	}
+	return steps
+}
+
+func (h *handshake) syn() *HandshakeStep {
+	st := &HandshakeStep{Name: "syn"}
+	sent, err := h.send(tcpFlags{syn: true}, nil)
+	if err != nil {
+		st.Detail = err.Error()
+		return st
+	}
+	isn := h.seq
+	h.seq++
+	resp, result := h.await(sent, h.timeout, func(resp *tcpPacket, _ int) bool {
+		return resp.flags.syn && resp.flags.ack && resp.ack == isn+1
+	})
+	st.Detail, st.RTT = result.Reason, result.RTT
+	if resp == nil || resp.flags.rst {
+		return st
+	}
+	h.ack = resp.seq + 1
+	st.OK, st.Detail = true, "syn-ack"
+	return st
+}
+
+// thirdAck completes the handshake. The peer does not acknowledge the ACK
+// itself, so the step succeeds unless the peer resets the connection.
+func (h *handshake) thirdAck() *HandshakeStep {
+	st := &HandshakeStep{Name: "ack"}
+	sent, err := h.send(tcpFlags{ack: true}, nil)
+	if err != nil {
+		st.Detail = err.Error()
+		return st
+	}
+	timeout := handshakeAckGrace
+	if h.timeout < timeout {
+		timeout = h.timeout
+	}
+	// Data from the peer (e.g. a banner) shows that it accepted the ACK.
+	resp, result := h.await(sent, timeout, func(_ *tcpPacket, dataLen int) bool {
+		return dataLen > 0
+	})
+	switch {
+	case resp == nil && result.From != nil:
+		// ICMP unreachable.
+		st.Detail, st.RTT = result.Reason, result.RTT
+	case resp == nil:
+		st.OK, st.Detail = true, "no reset"
+	case resp.flags.rst:
+		st.Detail, st.RTT = "rst", result.RTT
+	default:
+		st.OK, st.Detail, st.RTT = true, "peer sent data", result.RTT
+	}
+	return st
+}
+
+func (h *handshake) data(payload []byte) *HandshakeStep {
+	st := &HandshakeStep{Name: "data"}
+	sent, err := h.send(tcpFlags{psh: true, ack: true}, payload)
+	if err != nil {
+		st.Detail = err.Error()
+		return st
+	}
+	h.seq += uint32(len(payload))
+	resp, result := h.await(sent, h.timeout, func(resp *tcpPacket, _ int) bool {
+		return resp.flags.ack && seqAtLeast(resp.ack, h.seq)
+	})
+	st.Detail, st.RTT = result.Reason, result.RTT
+	if resp == nil || resp.flags.rst {
+		return st
+	}
+	st.OK, st.Detail = true, fmt.Sprintf("%d bytes acked", len(payload))
+	return st
+}
+
+func (h *handshake) fin() *HandshakeStep {
+	st := &HandshakeStep{Name: "fin"}
+	sent, err := h.send(tcpFlags{fin: true, ack: true}, nil)
+	if err != nil {
+		st.Detail = err.Error()
+		return st
+	}
+	h.seq++
+	resp, result := h.await(sent, h.timeout, func(resp *tcpPacket, _ int) bool {
+		return resp.flags.ack && seqAtLeast(resp.ack, h.seq)
+	})
+	st.Detail, st.RTT = result.Reason, result.RTT
+	if resp == nil || resp.flags.rst {
+		return st
+	}
+	st.OK, st.Detail = true, "fin acked"
+	if resp.flags.fin {
+		st.Detail = "fin acked, peer sent fin"
+		h.ack = resp.seq + 1
+		h.peerFin = true
+	}
+	return st
+}
+
+// close the connection after the last step. If the peer has closed its
+// side, its FIN is acknowledged; otherwise the connection is aborted with a
+// RST so that the peer does not keep state for it.
+func (h *handshake) close() *HandshakeStep {
+	st := &HandshakeStep{Name: "close", OK: true}
+	if h.reset {
+		st.Detail = "connection was reset"
+		return st
+	}
+	if h.peerFin {
+		if _, err := h.send(tcpFlags{ack: true}, nil); err != nil {
+			st.OK, st.Detail = false, err.Error()
+			return st
+		}
+		st.Detail = "acked peer fin"
+		return st
+	}
+	// Our RST would be dropped by the filter as well.
+	if h.filter != nil {
+		h.filter.remove()
+	}
+	if _, err := h.send(tcpFlags{rst: true, ack: true}, nil); err != nil {
+		st.OK, st.Detail = false, err.Error()
+		return st
+	}
+	st.Detail = "aborted with rst"
+	return st
+}
+
+// send a segment with the current sequence numbers.
+func (h *handshake) send(flags tcpFlags, data []byte) (time.Time, error) {
+	tcp := &tcpPacket{
+		srcPort:    h.srcPort,
+		destPort:   h.destPort,
+		seq:        h.seq,
+		ack:        h.ack,
+		flags:      flags,
+		windowSize: handshakeWindowSize,
+	}
+	pkt := make([]byte, tcp.headerLen()+len(data))
+	n, err := tcp.encode(pkt, h.src, h.dest, data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	glog.V(2).Infof("Handshake sending seq=%d ack=%d flags=%v (%d bytes of data)", tcp.seq, tcp.ack, flags, len(data))
+	return h.write(pkt[:n])
+}
+
+// await a segment from the peer for which match returns true, or a RST.
+// The returned segment is nil if there was none (the result has the
+// details).
+func (h *handshake) await(sent time.Time, timeout time.Duration, match func(resp *tcpPacket, dataLen int) bool) (*tcpPacket, *Result) {
+	var got *tcpPacket
+	classify := func(r *reply) (Verdict, string, bool) {
+		switch r.proto {
+		case tcpProtoNum:
+			if !r.from.Equal(h.dest) {
+				return VerdictUnknown, "", false
+			}
+			resp := &tcpPacket{}
+			data, err := resp.decode(r.data, h.dest, h.src)
+			if err != nil && err != ErrBadChecksum {
+				return VerdictUnknown, "", false
+			}
+			if resp.srcPort != h.destPort || resp.destPort != h.srcPort {
+				return VerdictUnknown, "", false
+			}
+			if resp.flags.rst {
+				got = resp
+				h.reset = true
+				return VerdictClosed, "rst", true
+			}
+			if !match(resp, len(data)) {
+				return VerdictUnknown, "", false
+			}
+			got = resp
+			return VerdictOpen, resp.flags.String(), true
+		case icmpProtoNum, icmpv6ProtoNum:
+			code, ok := matchICMPUnreachable(r, tcpProtoNum, h.dest, func(quoted []byte) bool {
+				decoder := binary.BigEndian
+				return decoder.Uint16(quoted) == h.srcPort && decoder.Uint16(quoted[2:]) == h.destPort
+			})
+			if ok {
+				return VerdictFiltered, unreachableReason(r.proto, code), true
+			}
+		}
+		return VerdictUnknown, "", false
+	}
+	result := h.listener.await(sent, timeout, classify, VerdictFiltered)
+	return got, result
+}
+
+// seqAtLeast returns true if sequence number a is at or after b, allowing
+// for wraparound.
+func seqAtLeast(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
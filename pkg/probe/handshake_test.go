@@ -0,0 +1,159 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakePeer answers the segments of a userspace handshake.
+type fakePeer struct {
+	t         *testing.T
+	src, dest net.IP
+	listener  *replyListener
+	// respond returns the reply to a segment, or nil.
+	respond func(seg *tcpPacket, dataLen int) *tcpPacket
+	// got are the flags of the segments received.
+	got []string
+}
+
+func (p *fakePeer) write(pkt []byte) (time.Time, error) {
+	sent := time.Now()
+	var seg tcpPacket
+	data, err := seg.decode(pkt, p.src, p.dest)
+	if err != nil {
+		p.t.Fatalf("decode(%v) = _, %v, want nil", pkt, err)
+	}
+	p.got = append(p.got, seg.flags.String())
+	resp := p.respond(&seg, len(data))
+	if resp == nil {
+		return sent, nil
+	}
+	resp.srcPort, resp.destPort = seg.destPort, seg.srcPort
+	b := make([]byte, tcpHeaderSize)
+	resp.encode(b, p.dest, p.src, nil)
+	p.listener.replies <- &reply{proto: tcpProtoNum, from: p.dest, data: b, at: time.Now()}
+	return sent, nil
+}
+
+func TestHandshake(t *testing.T) {
+	t.Parallel()
+
+	const peerISN = 5000
+	established := func(seg *tcpPacket, dataLen int) *tcpPacket {
+		switch {
+		case seg.flags.syn:
+			return &tcpPacket{seq: peerISN, ack: seg.seq + 1, flags: tcpFlags{syn: true, ack: true}}
+		case seg.flags.fin:
+			return &tcpPacket{seq: peerISN + 1, ack: seg.seq + 1, flags: tcpFlags{fin: true, ack: true}}
+		case dataLen > 0:
+			return &tcpPacket{seq: peerISN + 1, ack: seg.seq + uint32(dataLen), flags: tcpFlags{ack: true}}
+		}
+		return nil
+	}
+
+	type step struct {
+		name string
+		ok   bool
+	}
+	for _, tc := range []struct {
+		desc      string
+		respond   func(seg *tcpPacket, dataLen int) *tcpPacket
+		wantSteps []step
+		wantSent  []string
+	}{
+		{
+			desc:      "complete",
+			respond:   established,
+			wantSteps: []step{{"syn", true}, {"ack", true}, {"data", true}, {"fin", true}, {"close", true}},
+			wantSent:  []string{"S", "A", "AP", "AF", "A"},
+		},
+		{
+			desc: "peer does not close",
+			respond: func(seg *tcpPacket, dataLen int) *tcpPacket {
+				if seg.flags.fin {
+					return &tcpPacket{seq: peerISN + 1, ack: seg.seq + 1, flags: tcpFlags{ack: true}}
+				}
+				return established(seg, dataLen)
+			},
+			wantSteps: []step{{"syn", true}, {"ack", true}, {"data", true}, {"fin", true}, {"close", true}},
+			wantSent:  []string{"S", "A", "AP", "AF", "AR"},
+		},
+		{
+			desc: "closed port",
+			respond: func(seg *tcpPacket, _ int) *tcpPacket {
+				return &tcpPacket{ack: seg.seq + 1, flags: tcpFlags{rst: true, ack: true}}
+			},
+			wantSteps: []step{{"syn", false}},
+			wantSent:  []string{"S"},
+		},
+		{
+			desc: "third ack reset",
+			respond: func(seg *tcpPacket, dataLen int) *tcpPacket {
+				if !seg.flags.syn && dataLen == 0 {
+					return &tcpPacket{seq: seg.ack, flags: tcpFlags{rst: true}}
+				}
+				return established(seg, dataLen)
+			},
+			wantSteps: []step{{"syn", true}, {"ack", false}, {"close", true}},
+			wantSent:  []string{"S", "A"},
+		},
+		{
+			desc: "data dropped",
+			respond: func(seg *tcpPacket, dataLen int) *tcpPacket {
+				if dataLen > 0 {
+					return nil
+				}
+				return established(seg, dataLen)
+			},
+			wantSteps: []step{{"syn", true}, {"ack", true}, {"data", false}, {"close", true}},
+			wantSent:  []string{"S", "A", "AP", "AR"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+
+			src, dest := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+			peer := &fakePeer{t: t, src: src, dest: dest, listener: newReplyListener(), respond: tc.respond}
+			defer peer.listener.close()
+			h := &handshake{
+				write:    peer.write,
+				listener: peer.listener,
+				src:      src,
+				dest:     dest,
+				srcPort:  3000,
+				destPort: 80,
+				seq:      100,
+				timeout:  50 * time.Millisecond,
+			}
+
+			var got []step
+			for _, st := range h.run([]byte("payload")) {
+				got = append(got, step{st.Name, st.OK})
+			}
+			if !reflect.DeepEqual(got, tc.wantSteps) {
+				t.Errorf("run() steps = %v, want %v", got, tc.wantSteps)
+			}
+			if !reflect.DeepEqual(peer.got, tc.wantSent) {
+				t.Errorf("peer got %v, want %v", peer.got, tc.wantSent)
+			}
+		})
+	}
+}
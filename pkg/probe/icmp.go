@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	icmpTypeEchoReply     = 0
+	icmpTypeEchoRequest   = 8
+	icmpv6TypeEchoRequest = 128
+	icmpv6TypeEchoReply   = 129
+)
+
+// icmpEcho is an ICMP or ICMPv6 echo message. The family is determined by
+// the addresses given to encode and decode.
+type icmpEcho struct {
+	typ      uint8  // 0
+	code     uint8  // 1
+	checksum uint16 // 2 (only set by decode)
+	id       uint16 // 4
+	seq      uint16 // 6
+}
+
+// newICMPEcho returns an echo request for the family of dest.
+func newICMPEcho(dest net.IP, id, seq uint16) *icmpEcho {
+	typ := uint8(icmpTypeEchoRequest)
+	if dest.To4() == nil {
+		typ = icmpv6TypeEchoRequest
+	}
+	return &icmpEcho{typ: typ, id: id, seq: seq}
+}
+
+func (e *icmpEcho) encode(pkt []byte, src, dest net.IP, data []byte) int {
+	encoder := binary.BigEndian
+	pkt[0] = e.typ
+	pkt[1] = e.code
+	pkt[2] = 0
+	pkt[3] = 0
+	encoder.PutUint16(pkt[4:], e.id)
+	encoder.PutUint16(pkt[6:], e.seq)
+
+	checksum := checksumICMP(src, dest, pkt[:icmpHeaderSize], data)
+	pkt[2] = uint8(checksum & 0xff)
+	pkt[3] = uint8(checksum >> 8)
+
+	copy(pkt[icmpHeaderSize:], data)
+
+	return icmpHeaderSize + len(data)
+}
+
+// decode the message from pkt and return the data. The checksum is
+// validated if src and dest are given; ErrBadChecksum is returned if it is
+// invalid but the message is still decoded.
+func (e *icmpEcho) decode(pkt []byte, src, dest net.IP) ([]byte, error) {
+	if len(pkt) < icmpHeaderSize {
+		return nil, ErrTruncated
+	}
+
+	decoder := binary.BigEndian
+	e.typ = pkt[0]
+	e.code = pkt[1]
+	e.checksum = decoder.Uint16(pkt[2:])
+	e.id = decoder.Uint16(pkt[4:])
+	e.seq = decoder.Uint16(pkt[6:])
+	data := pkt[icmpHeaderSize:]
+
+	if src != nil && dest != nil && checksumICMP(src, dest, pkt[:icmpHeaderSize], data) != 0 {
+		return data, ErrBadChecksum
+	}
+	return data, nil
+}
+
+// isReply returns true if the message is an echo reply for the family of
+// the message.
+func (e *icmpEcho) isReply(v6 bool) bool {
+	if v6 {
+		return e.typ == icmpv6TypeEchoReply
+	}
+	return e.typ == icmpTypeEchoReply
+}
+
+// checksumICMP computes the checksum of an ICMP message. ICMPv6 (RFC 4443)
+// includes the pseudo-header, ICMP for IPv4 does not.
+func checksumICMP(src, dest net.IP, header, data []byte) uint16 {
+	if dest.To4() == nil {
+		return checksumPseudo(src, dest, icmpv6ProtoNum, header, data)
+	}
+	chk := &tcpChecksumer{}
+	chk.add(header)
+	chk.add(data)
+	return chk.finalize()
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestICMPEchoEncode(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.0.2")
+	echo := newICMPEcho(dest, 1, 2)
+	data := []byte("hi")
+	want := []byte{0x08, 0x00, 0x8f, 0x93, 0x00, 0x01, 0x00, 0x02, 'h', 'i'}
+
+	pkt := make([]byte, icmpHeaderSize+len(data))
+	n := echo.encode(pkt, src, dest, data)
+	if !reflect.DeepEqual(pkt[:n], want) {
+		t.Errorf("echo.encode() = %v, want %v", pkt[:n], want)
+	}
+}
+
+func TestICMPEchoDecode(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc      string
+		src, dest net.IP
+	}{
+		{desc: "ipv4", src: net.ParseIP("10.0.0.1"), dest: net.ParseIP("10.0.0.2")},
+		{desc: "ipv6", src: net.ParseIP("2001:db8::1"), dest: net.ParseIP("2001:db8::2")},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			echo := newICMPEcho(tc.dest, 0x1234, 0x5678)
+			data := []byte("payload")
+			pkt := make([]byte, icmpHeaderSize+len(data))
+			n := echo.encode(pkt, tc.src, tc.dest, data)
+
+			var got icmpEcho
+			gotData, err := got.decode(pkt[:n], tc.src, tc.dest)
+			if err != nil {
+				t.Fatalf("decode(%v) = _, %v, want nil", pkt[:n], err)
+			}
+			got.checksum = 0
+			if got != *echo || string(gotData) != string(data) {
+				t.Errorf("decode(%v) = %+v, %q; want %+v, %q", pkt[:n], got, gotData, *echo, data)
+			}
+
+			// The ICMPv6 checksum covers the addresses.
+			pkt[icmpHeaderSize]++
+			if _, err := got.decode(pkt[:n], tc.src, tc.dest); err != ErrBadChecksum {
+				t.Errorf("decode(%v) = _, %v, want %v", pkt[:n], err, ErrBadChecksum)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The probe identity is carried in the payload of every probe packet so
+// that a receiver can tell our probes apart from unrelated traffic. The
+// wire format (version 1) is:
+//
+//	offset  size  field
+//	0       2     preamble "LH"
+//	2       1     version
+//	3       1     length of magic
+//	4       1     length of sender
+//	5       3     reserved (zero)
+//	8       8     probe ID
+//	16      8     timestamp (ns since the Unix epoch)
+//	24      -     magic, followed by sender
+//
+// All integers are big endian.
+const (
+	identityVersion    = 1
+	identityHeaderSize = 24
+)
+
+var identityPreamble = []byte{'L', 'H'}
+
+var (
+	// ErrNoIdentity is returned when the payload does not contain a probe
+	// identity.
+	ErrNoIdentity = errors.New("no probe identity in payload")
+	// ErrIdentityVersion is returned when the probe identity has an
+	// unsupported version.
+	ErrIdentityVersion = errors.New("unsupported probe identity version")
+)
+
+// Identity identifies a single probe packet.
+type Identity struct {
+	// Magic is the tag shared by a set of related probes.
+	Magic string
+	// ID is unique to each probe.
+	ID uint64
+	// Timestamp is the time the probe was sent.
+	Timestamp time.Time
+	// Sender identifies the host that sent the probe.
+	Sender string
+}
+
+// NewIdentity returns an Identity with a random ID and the current time.
+func NewIdentity(magic string) (*Identity, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	sender, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Magic:     magic,
+		ID:        binary.BigEndian.Uint64(id[:]),
+		Timestamp: time.Now(),
+		Sender:    sender,
+	}, nil
+}
+
+func (id *Identity) String() string {
+	return fmt.Sprintf("%s/%016x", id.Magic, id.ID)
+}
+
+// Encode the identity into its wire format.
+func (id *Identity) Encode() ([]byte, error) {
+	if len(id.Magic) > 0xff {
+		return nil, fmt.Errorf("magic is too long (%d bytes, max 255)", len(id.Magic))
+	}
+	if len(id.Sender) > 0xff {
+		return nil, fmt.Errorf("sender is too long (%d bytes, max 255)", len(id.Sender))
+	}
+
+	encoder := binary.BigEndian
+	b := make([]byte, identityHeaderSize+len(id.Magic)+len(id.Sender))
+	copy(b, identityPreamble)
+	b[2] = identityVersion
+	b[3] = uint8(len(id.Magic))
+	b[4] = uint8(len(id.Sender))
+	encoder.PutUint64(b[8:], id.ID)
+	encoder.PutUint64(b[16:], uint64(id.Timestamp.UnixNano()))
+	copy(b[identityHeaderSize:], id.Magic)
+	copy(b[identityHeaderSize+len(id.Magic):], id.Sender)
+
+	return b, nil
+}
+
+// DecodeIdentity decodes an identity from the start of the payload.
+func DecodeIdentity(b []byte) (*Identity, error) {
+	if len(b) < identityHeaderSize || !bytes.Equal(b[:2], identityPreamble) {
+		return nil, ErrNoIdentity
+	}
+	if b[2] != identityVersion {
+		return nil, ErrIdentityVersion
+	}
+	magicLen, senderLen := int(b[3]), int(b[4])
+	if len(b) < identityHeaderSize+magicLen+senderLen {
+		return nil, fmt.Errorf("truncated probe identity (%d bytes, want %d)", len(b), identityHeaderSize+magicLen+senderLen)
+	}
+
+	decoder := binary.BigEndian
+	rest := b[identityHeaderSize:]
+	return &Identity{
+		Magic:     string(rest[:magicLen]),
+		ID:        decoder.Uint64(b[8:]),
+		Timestamp: time.Unix(0, int64(decoder.Uint64(b[16:]))),
+		Sender:    string(rest[magicLen : magicLen+senderLen]),
+	}, nil
+}
+
+// FindIdentity searches the payload for an identity. This is used when
+// the identity is not at the start of the payload (e.g. if the payload was
+// padded or the data is a raw capture).
+func FindIdentity(b []byte) (*Identity, error) {
+	for i := 0; i+identityHeaderSize <= len(b); i++ {
+		j := bytes.Index(b[i:], identityPreamble)
+		if j < 0 {
+			break
+		}
+		i += j
+		if id, err := DecodeIdentity(b[i:]); err == nil {
+			return id, nil
+		}
+	}
+	return nil, ErrNoIdentity
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIdentityEncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc string
+		id   Identity
+		want []byte
+	}{
+		{
+			desc: "empty",
+			id:   Identity{Timestamp: time.Unix(0, 0)},
+			want: []byte{
+				'L', 'H', 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+		},
+		{
+			desc: "magic and sender",
+			id: Identity{
+				Magic:     "m",
+				ID:        0x0102030405060708,
+				Timestamp: time.Unix(0, 0x1112131415161718),
+				Sender:    "host",
+			},
+			want: []byte{
+				'L', 'H', 0x01, 0x01, 0x04, 0x00, 0x00, 0x00,
+				0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+				0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+				'm', 'h', 'o', 's', 't',
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			b, err := tc.id.Encode()
+			if err != nil {
+				t.Fatalf("id.Encode() = _, %v, want nil", err)
+			}
+			if !reflect.DeepEqual(b, tc.want) {
+				t.Errorf("id.Encode() = %v, want %v", b, tc.want)
+			}
+			got, err := DecodeIdentity(b)
+			if err != nil {
+				t.Fatalf("DecodeIdentity(%v) = _, %v, want nil", b, err)
+			}
+			if !got.Timestamp.Equal(tc.id.Timestamp) {
+				t.Errorf("DecodeIdentity(%v).Timestamp = %v, want %v", b, got.Timestamp, tc.id.Timestamp)
+			}
+			got.Timestamp = tc.id.Timestamp
+			if *got != tc.id {
+				t.Errorf("DecodeIdentity(%v) = %+v, want %+v", b, *got, tc.id)
+			}
+		})
+	}
+}
+
+func TestDecodeIdentityErrors(t *testing.T) {
+	t.Parallel()
+
+	valid, err := (&Identity{Magic: "magic", Sender: "host"}).Encode()
+	if err != nil {
+		t.Fatalf("Encode() = _, %v, want nil", err)
+	}
+	badVersion := append([]byte{}, valid...)
+	badVersion[2] = 99
+
+	for _, tc := range []struct {
+		desc    string
+		b       []byte
+		wantErr error
+	}{
+		{desc: "empty", b: nil, wantErr: ErrNoIdentity},
+		{desc: "bad preamble", b: append([]byte{'X'}, valid[1:]...), wantErr: ErrNoIdentity},
+		{desc: "bad version", b: badVersion, wantErr: ErrIdentityVersion},
+		{desc: "truncated", b: valid[:len(valid)-1]},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := DecodeIdentity(tc.b)
+			if err == nil {
+				t.Fatalf("DecodeIdentity(%v) = _, nil, want error", tc.b)
+			}
+			if tc.wantErr != nil && err != tc.wantErr {
+				t.Errorf("DecodeIdentity(%v) = _, %v, want %v", tc.b, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestFindIdentity(t *testing.T) {
+	t.Parallel()
+
+	id := Identity{Magic: "magic", ID: 42, Timestamp: time.Unix(1, 0), Sender: "host"}
+	b, err := id.Encode()
+	if err != nil {
+		t.Fatalf("Encode() = _, %v, want nil", err)
+	}
+	data := append([]byte("xxLHyy"), b...)
+	got, err := FindIdentity(data)
+	if err != nil {
+		t.Fatalf("FindIdentity(%v) = _, %v, want nil", data, err)
+	}
+	if got.ID != id.ID || got.Magic != id.Magic {
+		t.Errorf("FindIdentity(%v) = %+v, want %+v", data, *got, id)
+	}
+	if _, err := FindIdentity(data[:len(data)-1]); err != ErrNoIdentity {
+		t.Errorf("FindIdentity(truncated) = _, %v, want %v", err, ErrNoIdentity)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/golang/glog"
+)
+
+const (
+	ipv6HeaderSize = 40
+	icmpv6ProtoNum = 58
+)
+
+var (
+	// ErrTruncated is returned when a packet is too short to decode.
+	ErrTruncated = errors.New("truncated packet")
+	// ErrBadChecksum is returned when a packet fails checksum validation.
+	// The packet is still decoded.
+	ErrBadChecksum = errors.New("bad checksum")
+)
+
+type ipv4Header struct {
+	tos           uint8  // 1
+	totalLen      uint16 // 2
+	id            uint16 // 4
+	dontFragment  bool   // 6
+	moreFragments bool   // 6
+	fragOffset    uint16 // 6 (in units of 8 bytes)
+	ttl           uint8  // 8
+	protocol      uint8  // 9
+	checksum      uint16 // 10 (only set by decode)
+	src, dest     net.IP // 12, 16
+	options       []byte // 20
+}
+
+// headerLen is the length of the encoded header, including options.
+func (h *ipv4Header) headerLen() int {
+	return ipv4MinHeaderSize + (len(h.options)+3)/4*4
+}
+
+// encode the header followed by the payload into pkt. If totalLen is zero,
+// it is computed from the payload.
+func (h *ipv4Header) encode(pkt []byte, payload []byte) int {
+	encoder := binary.BigEndian
+	headerLen := h.headerLen()
+	totalLen := h.totalLen
+	if totalLen == 0 {
+		totalLen = uint16(headerLen + len(payload))
+	}
+
+	pkt[0] = 4<<4 | uint8(headerLen/4)
+	pkt[1] = h.tos
+	encoder.PutUint16(pkt[2:], totalLen)
+	encoder.PutUint16(pkt[4:], h.id)
+	frag := h.fragOffset & 0x1fff
+	if h.dontFragment {
+		frag |= 1 << 14
+	}
+	if h.moreFragments {
+		frag |= 1 << 13
+	}
+	encoder.PutUint16(pkt[6:], frag)
+	pkt[8] = h.ttl
+	pkt[9] = h.protocol
+	pkt[10] = 0
+	pkt[11] = 0
+	copy(pkt[12:16], h.src.To4())
+	copy(pkt[16:20], h.dest.To4())
+
+	// Options are padded with zeros (end of option list).
+	n := copy(pkt[ipv4MinHeaderSize:headerLen], h.options)
+	for i := ipv4MinHeaderSize + n; i < headerLen; i++ {
+		pkt[i] = 0
+	}
+
+	chk := &tcpChecksumer{}
+	chk.add(pkt[:headerLen])
+	checksum := chk.finalize()
+	pkt[10] = uint8(checksum & 0xff)
+	pkt[11] = uint8(checksum >> 8)
+
+	copy(pkt[headerLen:], payload)
+
+	return headerLen + len(payload)
+}
+
+// decode the header from pkt and return the payload. The payload is
+// truncated if pkt is shorter than the total length in the header (e.g. in
+// an ICMP quotation or a capture with a small snap length). ErrBadChecksum
+// is returned if the header checksum is invalid; the header is still
+// decoded.
+func (h *ipv4Header) decode(pkt []byte) ([]byte, error) {
+	if len(pkt) < ipv4MinHeaderSize {
+		return nil, ErrTruncated
+	}
+	if version := pkt[0] >> 4; version != 4 {
+		return nil, fmt.Errorf("invalid IPv4 version %d", version)
+	}
+	ihl := int(pkt[0]&0xf) * 4
+	if ihl < ipv4MinHeaderSize {
+		return nil, fmt.Errorf("invalid IPv4 header length %d", ihl)
+	}
+	if len(pkt) < ihl {
+		return nil, ErrTruncated
+	}
+
+	decoder := binary.BigEndian
+	h.tos = pkt[1]
+	h.totalLen = decoder.Uint16(pkt[2:])
+	h.id = decoder.Uint16(pkt[4:])
+	frag := decoder.Uint16(pkt[6:])
+	h.dontFragment = frag&(1<<14) != 0
+	h.moreFragments = frag&(1<<13) != 0
+	h.fragOffset = frag & 0x1fff
+	h.ttl = pkt[8]
+	h.protocol = pkt[9]
+	h.checksum = decoder.Uint16(pkt[10:])
+	h.src = net.IP(append([]byte{}, pkt[12:16]...))
+	h.dest = net.IP(append([]byte{}, pkt[16:20]...))
+	h.options = nil
+	if ihl > ipv4MinHeaderSize {
+		h.options = append([]byte{}, pkt[ipv4MinHeaderSize:ihl]...)
+	}
+
+	if int(h.totalLen) < ihl {
+		return nil, fmt.Errorf("invalid IPv4 total length %d", h.totalLen)
+	}
+	end := int(h.totalLen)
+	if end > len(pkt) {
+		end = len(pkt)
+	}
+	payload := pkt[ihl:end]
+
+	chk := &tcpChecksumer{}
+	chk.add(pkt[:ihl])
+	if chk.finalize() != 0 {
+		return payload, ErrBadChecksum
+	}
+	return payload, nil
+}
+
+func (h *ipv4Header) String() string {
+	return fmt.Sprintf("%v > %v proto %d ttl %d tos %#x id %d len %d", h.src, h.dest, h.protocol, h.ttl, h.tos, h.id, h.totalLen)
+}
+
+type ipv6Header struct {
+	trafficClass uint8  // 0
+	flowLabel    uint32 // 1 (20 bits)
+	payloadLen   uint16 // 4
+	nextHeader   uint8  // 6
+	hopLimit     uint8  // 7
+	src, dest    net.IP // 8, 24
+}
+
+// encode the header followed by the payload into pkt. If payloadLen is
+// zero, it is computed from the payload.
+func (h *ipv6Header) encode(pkt []byte, payload []byte) int {
+	encoder := binary.BigEndian
+	payloadLen := h.payloadLen
+	if payloadLen == 0 {
+		payloadLen = uint16(len(payload))
+	}
+	encoder.PutUint32(pkt, 6<<28|uint32(h.trafficClass)<<20|h.flowLabel&0xfffff)
+	encoder.PutUint16(pkt[4:], payloadLen)
+	pkt[6] = h.nextHeader
+	pkt[7] = h.hopLimit
+	copy(pkt[8:24], h.src.To16())
+	copy(pkt[24:40], h.dest.To16())
+	copy(pkt[ipv6HeaderSize:], payload)
+
+	return ipv6HeaderSize + len(payload)
+}
+
+// decode the header from pkt and return the payload. As with IPv4, the
+// payload is truncated if pkt is shorter than the payload length. Extension
+// headers are not interpreted.
+func (h *ipv6Header) decode(pkt []byte) ([]byte, error) {
+	if len(pkt) < ipv6HeaderSize {
+		return nil, ErrTruncated
+	}
+	if version := pkt[0] >> 4; version != 6 {
+		return nil, fmt.Errorf("invalid IPv6 version %d", version)
+	}
+
+	decoder := binary.BigEndian
+	first := decoder.Uint32(pkt)
+	h.trafficClass = uint8(first >> 20)
+	h.flowLabel = first & 0xfffff
+	h.payloadLen = decoder.Uint16(pkt[4:])
+	h.nextHeader = pkt[6]
+	h.hopLimit = pkt[7]
+	h.src = net.IP(append([]byte{}, pkt[8:24]...))
+	h.dest = net.IP(append([]byte{}, pkt[24:40]...))
+
+	end := ipv6HeaderSize + int(h.payloadLen)
+	if end > len(pkt) {
+		end = len(pkt)
+	}
+	return pkt[ipv6HeaderSize:end], nil
+}
+
+func (h *ipv6Header) String() string {
+	return fmt.Sprintf("%v > %v next %d hlim %d tc %#x flow %#x len %d", h.src, h.dest, h.nextHeader, h.hopLimit, h.trafficClass, h.flowLabel, h.payloadLen)
+}
+
+// ipNetwork returns "ip4" or "ip6" for the family of ip.
+func ipNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+// icmpProto returns the ICMP protocol number and name for the family of
+// ip.
+func icmpProto(ip net.IP) (int, string) {
+	if ip.To4() != nil {
+		return icmpProtoNum, "icmp"
+	}
+	return icmpv6ProtoNum, "ipv6-icmp"
+}
+
+// resolveAddrs resolves dest, then resolves src in the same address family
+// as dest. If src is empty, the source is chosen by a route lookup.
+func resolveAddrs(src, dest string) (*net.IPAddr, *net.IPAddr, error) {
+	destAddr, err := net.ResolveIPAddr("ip", dest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if src == "" {
+		ip, err := SourceFor(destAddr.IP)
+		if err != nil {
+			return nil, nil, fmt.Errorf("no source address for %v: %v", destAddr, err)
+		}
+		glog.V(2).Infof("SourceFor(%v) = %v", destAddr, ip)
+		return &net.IPAddr{IP: ip}, destAddr, nil
+	}
+	network := ipNetwork(destAddr.IP)
+	srcAddr, err := net.ResolveIPAddr(network, src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("source %q is not a valid %s address for destination %v: %v", src, network, destAddr, err)
+	}
+	return srcAddr, destAddr, nil
+}
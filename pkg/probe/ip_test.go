@@ -0,0 +1,164 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestIPv4Decode(t *testing.T) {
+	t.Parallel()
+
+	pkt := []byte{
+		0x45, 0x00, 0x00, 0x1c, 0x1c, 0x46, 0x40, 0x00,
+		0x40, 0x11, 0x9c, 0x72, 0xc0, 0xa8, 0x00, 0x01,
+		0xc0, 0xa8, 0x00, 0xc7,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0xff, 0xff, // Trailing link layer padding.
+	}
+	want := ipv4Header{
+		totalLen:     0x1c,
+		id:           0x1c46,
+		dontFragment: true,
+		ttl:          64,
+		protocol:     17,
+		checksum:     0x9c72,
+		src:          net.ParseIP("192.168.0.1").To4(),
+		dest:         net.ParseIP("192.168.0.199").To4(),
+	}
+
+	var got ipv4Header
+	payload, err := got.decode(pkt)
+	if err != nil {
+		t.Fatalf("decode(%v) = _, %v, want nil", pkt, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decode(%v) = %+v, want %+v", pkt, got, want)
+	}
+	if wantPayload := pkt[20:28]; !reflect.DeepEqual(payload, wantPayload) {
+		t.Errorf("decode(%v) = %v, want %v", pkt, payload, wantPayload)
+	}
+
+	// Truncated payloads are allowed.
+	if payload, err := got.decode(pkt[:24]); err != nil || len(payload) != 4 {
+		t.Errorf("decode(%v) = %v, %v; want 4 bytes, nil", pkt[:24], payload, err)
+	}
+
+	bad := append([]byte{}, pkt...)
+	bad[8]--
+	if _, err := got.decode(bad); err != ErrBadChecksum {
+		t.Errorf("decode(%v) = _, %v, want %v", bad, err, ErrBadChecksum)
+	}
+	for _, b := range [][]byte{pkt[:19], {0x65, 0x00}, append([]byte{0x44}, pkt[1:]...)} {
+		if _, err := got.decode(b); err == nil {
+			t.Errorf("decode(%v) = _, nil, want error", b)
+		}
+	}
+}
+
+func TestIPv6Decode(t *testing.T) {
+	t.Parallel()
+
+	pkt := []byte{
+		0x60, 0x12, 0x34, 0x56, 0x00, 0x04, 0x06, 0x40,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		0x01, 0x02, 0x03, 0x04,
+	}
+	want := ipv6Header{
+		trafficClass: 0x01,
+		flowLabel:    0x23456,
+		payloadLen:   4,
+		nextHeader:   tcpProtoNum,
+		hopLimit:     64,
+		src:          net.ParseIP("2001:db8::1"),
+		dest:         net.ParseIP("2001:db8::2"),
+	}
+
+	var got ipv6Header
+	payload, err := got.decode(pkt)
+	if err != nil {
+		t.Fatalf("decode(%v) = _, %v, want nil", pkt, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decode(%v) = %+v, want %+v", pkt, got, want)
+	}
+	if wantPayload := pkt[40:]; !reflect.DeepEqual(payload, wantPayload) {
+		t.Errorf("decode(%v) = %v, want %v", pkt, payload, wantPayload)
+	}
+	for _, b := range [][]byte{pkt[:39], append([]byte{0x40}, pkt[1:]...)} {
+		if _, err := got.decode(b); err == nil {
+			t.Errorf("decode(%v) = _, nil, want error", b)
+		}
+	}
+}
+
+func TestIPv4Encode(t *testing.T) {
+	t.Parallel()
+
+	h := ipv4Header{
+		tos:          0xb8,
+		id:           0x1c46,
+		dontFragment: true,
+		ttl:          64,
+		protocol:     tcpProtoNum,
+		src:          net.ParseIP("192.168.0.1"),
+		dest:         net.ParseIP("192.168.0.199"),
+		options:      []byte{0x01},
+	}
+	payload := []byte{0x01, 0x02, 0x03, 0x04}
+
+	pkt := make([]byte, h.headerLen()+len(payload))
+	n := h.encode(pkt, payload)
+	if n != 28 {
+		t.Fatalf("encode() = %d, want 28", n)
+	}
+
+	var got ipv4Header
+	gotPayload, err := got.decode(pkt[:n])
+	if err != nil {
+		t.Fatalf("decode(%v) = _, %v, want nil", pkt[:n], err)
+	}
+	want := h
+	want.totalLen = 28
+	want.checksum = got.checksum
+	want.src = want.src.To4()
+	want.dest = want.dest.To4()
+	want.options = []byte{0x01, 0x00, 0x00, 0x00}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decode(encode(%+v)) = %+v, want %+v", h, got, want)
+	}
+	if !reflect.DeepEqual(gotPayload, payload) {
+		t.Errorf("decode(encode(%+v)) = %v, want %v", h, gotPayload, payload)
+	}
+
+	// Matches the header from TestIPv4Decode.
+	h = ipv4Header{id: 0x1c46, dontFragment: true, ttl: 64, protocol: 17, src: net.ParseIP("192.168.0.1"), dest: net.ParseIP("192.168.0.199")}
+	wantHeader := []byte{
+		0x45, 0x00, 0x00, 0x1c, 0x1c, 0x46, 0x40, 0x00,
+		0x40, 0x11, 0x9c, 0x72, 0xc0, 0xa8, 0x00, 0x01,
+		0xc0, 0xa8, 0x00, 0xc7,
+	}
+	h.encode(pkt, make([]byte, 8))
+	if !reflect.DeepEqual(pkt[:ipv4MinHeaderSize], wantHeader) {
+		t.Errorf("encode() = %v, want %v", pkt[:ipv4MinHeaderSize], wantHeader)
+	}
+}
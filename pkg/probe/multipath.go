@@ -0,0 +1,293 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const defaultFlows = 8
+
+// Flow is one flow of a multipath trace. The flow identifiers are constant
+// for every TTL so that each flow follows a single path through ECMP
+// routers.
+type Flow struct {
+	SrcPort int
+	// FlowLabel is the IPv6 flow label, zero for IPv4.
+	FlowLabel int
+	// Hops of the flow, starting at TTL 1.
+	Hops []*Hop
+}
+
+func (f *Flow) String() string {
+	if f.FlowLabel != 0 {
+		return fmt.Sprintf("src port %d flow label %#x", f.SrcPort, f.FlowLabel)
+	}
+	return fmt.Sprintf("src port %d", f.SrcPort)
+}
+
+// addr returns the key of the address that replied at hop i.
+func (f *Flow) addr(i int) string {
+	if i >= len(f.Hops) || f.Hops[i].Result.From == nil {
+		return "*"
+	}
+	return f.Hops[i].Result.From.String()
+}
+
+// PathNode is an address seen at a given TTL.
+type PathNode struct {
+	TTL int
+	// Addr is the address that replied, "*" if there was no reply. Hops
+	// without a reply are only merged into one node if they follow the
+	// same node at the previous TTL, so that flows that have diverged do
+	// not appear to converge.
+	Addr string
+	// Flows are the indices (in PathGraph.Flows) of the flows that saw
+	// this node.
+	Flows []int
+}
+
+// PathEdge links nodes at consecutive TTLs that were seen by the same
+// flows.
+type PathEdge struct {
+	From, To *PathNode
+	Flows    []int
+}
+
+// Path is a distinct sequence of hops and the flows that took it.
+type Path struct {
+	Addrs []string
+	Flows []int
+}
+
+// PathGraph is the union of the paths taken by the flows of a multipath
+// trace.
+type PathGraph struct {
+	Dest  string
+	Port  int
+	Flows []*Flow
+	// Nodes[i] are the nodes at TTL i+1.
+	Nodes [][]*PathNode
+	Edges []*PathEdge
+}
+
+// newPathGraph merges the hops of the flows into a graph.
+func newPathGraph(dest string, port int, flows []*Flow) *PathGraph {
+	g := &PathGraph{Dest: dest, Port: port, Flows: flows}
+
+	var maxHops int
+	for _, f := range flows {
+		if len(f.Hops) > maxHops {
+			maxHops = len(f.Hops)
+		}
+	}
+	g.Nodes = make([][]*PathNode, maxHops)
+	// nodes[fi][i] is the node of flow fi at TTL i+1.
+	nodes := make([][]*PathNode, len(flows))
+	// A node is keyed by its address or, if there was no reply, by the
+	// node before it.
+	type nodeKey struct {
+		addr string
+		prev *PathNode
+	}
+	for i := 0; i < maxHops; i++ {
+		byKey := map[nodeKey]*PathNode{}
+		for fi, f := range flows {
+			if i >= len(f.Hops) {
+				continue
+			}
+			key := nodeKey{addr: f.addr(i)}
+			if key.addr == "*" && i > 0 {
+				key.prev = nodes[fi][i-1]
+			}
+			n, ok := byKey[key]
+			if !ok {
+				n = &PathNode{TTL: i + 1, Addr: key.addr}
+				byKey[key] = n
+				g.Nodes[i] = append(g.Nodes[i], n)
+			}
+			n.Flows = append(n.Flows, fi)
+			nodes[fi] = append(nodes[fi], n)
+		}
+		sort.SliceStable(g.Nodes[i], func(a, b int) bool { return g.Nodes[i][a].Addr < g.Nodes[i][b].Addr })
+	}
+
+	edges := map[[2]*PathNode]*PathEdge{}
+	for i := 0; i+1 < maxHops; i++ {
+		for fi, f := range flows {
+			if i+1 >= len(f.Hops) {
+				continue
+			}
+			key := [2]*PathNode{nodes[fi][i], nodes[fi][i+1]}
+			e, ok := edges[key]
+			if !ok {
+				e = &PathEdge{From: key[0], To: key[1]}
+				edges[key] = e
+				g.Edges = append(g.Edges, e)
+			}
+			e.Flows = append(e.Flows, fi)
+		}
+	}
+	return g
+}
+
+// Paths returns the distinct paths in the graph, ordered by the first flow
+// that took each of them.
+func (g *PathGraph) Paths() []*Path {
+	var paths []*Path
+	byKey := map[string]*Path{}
+	for fi, f := range g.Flows {
+		var addrs []string
+		for i := range f.Hops {
+			addrs = append(addrs, f.addr(i))
+		}
+		key := strings.Join(addrs, " ")
+		p, ok := byKey[key]
+		if !ok {
+			p = &Path{Addrs: addrs}
+			byKey[key] = p
+			paths = append(paths, p)
+		}
+		p.Flows = append(p.Flows, fi)
+	}
+	return paths
+}
+
+func (g *PathGraph) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "multipath trace to %s:%d, %d flows\n", g.Dest, g.Port, len(g.Flows))
+	for i, f := range g.Flows {
+		fmt.Fprintf(&buf, "flow %d: %v\n", i, f)
+	}
+	for i, nodes := range g.Nodes {
+		var parts []string
+		for _, n := range nodes {
+			parts = append(parts, fmt.Sprintf("%s %s", n.Addr, flowList(n.Flows)))
+		}
+		fmt.Fprintf(&buf, "hop %d: %s\n", i+1, strings.Join(parts, ", "))
+	}
+	paths := g.Paths()
+	fmt.Fprintf(&buf, "%d distinct paths:", len(paths))
+	for _, p := range paths {
+		fmt.Fprintf(&buf, "\n  %s: flows %s", strings.Join(p.Addrs, " -> "), flowList(p.Flows))
+	}
+	return buf.String()
+}
+
+func flowList(flows []int) string {
+	var s []string
+	for _, f := range flows {
+		s = append(s, fmt.Sprintf("%d", f))
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
+
+// TraceMultipath traces the paths to dest:destPort taken by a number of
+// flows (8 if zero), in the style of Paris and Dublin traceroute. Each
+// flow has its own source port and, for IPv6, flow label that are kept
+// constant for every TTL; the hops of all the flows are merged into a
+// graph. If srcPort is non-zero, the flows use consecutive source ports
+// starting at srcPort, all of which must be valid ports. opt.TTL and
+// opt.FlowLabel are ignored; opt may be nil.
+func TraceMultipath(src string, srcPort int, dest string, destPort int, magic string, maxTTL, flows int, opt *Options) (*PathGraph, error) {
+	if maxTTL == 0 {
+		maxTTL = defaultMaxTTL
+	}
+	if maxTTL < 0 || maxTTL > 255 {
+		return nil, fmt.Errorf("invalid max TTL %d", maxTTL)
+	}
+	if flows == 0 {
+		flows = defaultFlows
+	}
+	if flows < 0 {
+		return nil, fmt.Errorf("invalid number of flows %d", flows)
+	}
+	if srcPort < 0 || srcPort+flows-1 > 0xffff {
+		return nil, fmt.Errorf("source ports %d-%d are out of range", srcPort, srcPort+flows-1)
+	}
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	v6 := destAddr.IP.To4() == nil
+	var (
+		all   []*Flow
+		ports = map[int]bool{}
+	)
+	for i := 0; i < flows; i++ {
+		f := &Flow{}
+		if srcPort != 0 {
+			f.SrcPort = srcPort + i
+		} else {
+			// Pick distinct ephemeral ports.
+			for f.SrcPort == 0 || ports[f.SrcPort] {
+				if f.SrcPort, err = EphemeralPort(tcpProtoNum); err != nil {
+					return nil, err
+				}
+			}
+		}
+		ports[f.SrcPort] = true
+		if v6 {
+			f.FlowLabel = i + 1
+		}
+		all = append(all, f)
+	}
+
+	active := all
+	for ttl := 1; ttl <= maxTTL && len(active) > 0; ttl++ {
+		var (
+			wg   sync.WaitGroup
+			errs = make([]error, len(active))
+		)
+		for i, f := range active {
+			wg.Add(1)
+			go func(i int, f *Flow) {
+				defer wg.Done()
+				flowOpt := opt.withTTL(ttl)
+				flowOpt.FlowLabel = f.FlowLabel
+				hop, err := traceHop(srcAddr, destAddr, f.SrcPort, destPort, ttl, magic, flowOpt)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				glog.V(2).Infof("Multipath hop %d (flow %v): %v", ttl, f, hop.Result)
+				f.Hops = append(f.Hops, hop)
+			}(i, f)
+		}
+		wg.Wait()
+
+		var next []*Flow
+		for i, f := range active {
+			if errs[i] != nil {
+				return nil, errs[i]
+			}
+			if !f.Hops[len(f.Hops)-1].final() {
+				next = append(next, f)
+			}
+		}
+		active = next
+	}
+
+	return newPathGraph(destAddr.IP.String(), destPort, all), nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testHops returns the hops of a flow that got replies from addrs ("*" for
+// none) and reached the destination at the last one.
+func testHops(addrs ...string) []*Hop {
+	var ret []*Hop
+	for i, a := range addrs {
+		r := &Result{Verdict: VerdictUnknown, Reason: "time exceeded"}
+		if a == "*" {
+			r.Reason = "timeout"
+		} else {
+			r.From = net.ParseIP(a)
+		}
+		ret = append(ret, &Hop{TTL: i + 1, Result: r})
+	}
+	ret[len(ret)-1].Result.Verdict = VerdictOpen
+	return ret
+}
+
+func TestPathGraph(t *testing.T) {
+	t.Parallel()
+
+	hops := testHops
+	// A diamond: the flows split after the first hop and merge at the
+	// destination. Flow 3 gets no reply from the second hop.
+	flows := []*Flow{
+		{SrcPort: 1000, Hops: hops("10.0.0.1", "10.1.0.1", "10.2.0.1")},
+		{SrcPort: 1001, Hops: hops("10.0.0.1", "10.1.0.2", "10.2.0.1")},
+		{SrcPort: 1002, Hops: hops("10.0.0.1", "10.1.0.1", "10.2.0.1")},
+		{SrcPort: 1003, Hops: hops("10.0.0.1", "*", "10.2.0.1")},
+	}
+	g := newPathGraph("10.2.0.1", 80, flows)
+
+	type node struct {
+		addr  string
+		flows []int
+	}
+	var gotNodes [][]node
+	for _, level := range g.Nodes {
+		var l []node
+		for _, n := range level {
+			l = append(l, node{n.Addr, n.Flows})
+		}
+		gotNodes = append(gotNodes, l)
+	}
+	wantNodes := [][]node{
+		{{"10.0.0.1", []int{0, 1, 2, 3}}},
+		{{"*", []int{3}}, {"10.1.0.1", []int{0, 2}}, {"10.1.0.2", []int{1}}},
+		{{"10.2.0.1", []int{0, 1, 2, 3}}},
+	}
+	if !reflect.DeepEqual(gotNodes, wantNodes) {
+		t.Errorf("Nodes = %v, want %v", gotNodes, wantNodes)
+	}
+
+	type edge struct {
+		from, to string
+		flows    []int
+	}
+	var gotEdges []edge
+	for _, e := range g.Edges {
+		gotEdges = append(gotEdges, edge{e.From.Addr, e.To.Addr, e.Flows})
+	}
+	wantEdges := []edge{
+		{"10.0.0.1", "10.1.0.1", []int{0, 2}},
+		{"10.0.0.1", "10.1.0.2", []int{1}},
+		{"10.0.0.1", "*", []int{3}},
+		{"10.1.0.1", "10.2.0.1", []int{0, 2}},
+		{"10.1.0.2", "10.2.0.1", []int{1}},
+		{"*", "10.2.0.1", []int{3}},
+	}
+	if !reflect.DeepEqual(gotEdges, wantEdges) {
+		t.Errorf("Edges = %v, want %v", gotEdges, wantEdges)
+	}
+
+	var gotPaths []Path
+	for _, p := range g.Paths() {
+		gotPaths = append(gotPaths, *p)
+	}
+	wantPaths := []Path{
+		{Addrs: []string{"10.0.0.1", "10.1.0.1", "10.2.0.1"}, Flows: []int{0, 2}},
+		{Addrs: []string{"10.0.0.1", "10.1.0.2", "10.2.0.1"}, Flows: []int{1}},
+		{Addrs: []string{"10.0.0.1", "*", "10.2.0.1"}, Flows: []int{3}},
+	}
+	if !reflect.DeepEqual(gotPaths, wantPaths) {
+		t.Errorf("Paths() = %v, want %v", gotPaths, wantPaths)
+	}
+
+	s := g.String()
+	for _, want := range []string{"4 flows", "flow 3: src port 1003", "hop 2: * [3], 10.1.0.1 [0 2], 10.1.0.2 [1]", "3 distinct paths"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String() = %q, want it to contain %q", s, want)
+		}
+	}
+}
+
+func TestPathGraphNoReply(t *testing.T) {
+	t.Parallel()
+
+	// The flows split after the first hop and get no replies after that,
+	// except for flow 2 at the last hop.
+	flows := []*Flow{
+		{SrcPort: 1000, Hops: testHops("10.0.0.1", "10.1.0.1", "*", "*")},
+		{SrcPort: 1001, Hops: testHops("10.0.0.1", "10.1.0.2", "*", "*")},
+		{SrcPort: 1002, Hops: testHops("10.0.0.1", "10.1.0.1", "*", "10.2.0.1")},
+	}
+	g := newPathGraph("10.2.0.1", 80, flows)
+
+	var gotNodes [][][]int
+	for _, level := range g.Nodes {
+		var l [][]int
+		for _, n := range level {
+			l = append(l, n.Flows)
+		}
+		gotNodes = append(gotNodes, l)
+	}
+	wantNodes := [][][]int{
+		{{0, 1, 2}},
+		{{0, 2}, {1}},
+		{{0, 2}, {1}},
+		{{0}, {1}, {2}},
+	}
+	if !reflect.DeepEqual(gotNodes, wantNodes) {
+		t.Errorf("Nodes flows = %v, want %v", gotNodes, wantNodes)
+	}
+
+	var gotEdges []string
+	for _, e := range g.Edges {
+		gotEdges = append(gotEdges, fmt.Sprintf("%s %v -> %s %v", e.From.Addr, e.From.Flows, e.To.Addr, e.To.Flows))
+	}
+	wantEdges := []string{
+		"10.0.0.1 [0 1 2] -> 10.1.0.1 [0 2]",
+		"10.0.0.1 [0 1 2] -> 10.1.0.2 [1]",
+		"10.1.0.1 [0 2] -> * [0 2]",
+		"10.1.0.2 [1] -> * [1]",
+		"* [0 2] -> * [0]",
+		"* [1] -> * [1]",
+		"* [0 2] -> 10.2.0.1 [2]",
+	}
+	if !reflect.DeepEqual(gotEdges, wantEdges) {
+		t.Errorf("Edges = %q, want %q", gotEdges, wantEdges)
+	}
+}
+
+func TestTraceMultipathInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		srcPort, flows int
+	}{
+		{srcPort: 65530, flows: 8},
+		{srcPort: 65535, flows: 2},
+		{srcPort: -1, flows: 1},
+		{srcPort: 3000, flows: -1},
+	} {
+		if _, err := TraceMultipath("127.0.0.1", tc.srcPort, "127.0.0.1", 80, "magic", 1, tc.flows, nil); err == nil {
+			t.Errorf("TraceMultipath(srcPort=%d, flows=%d) = _, nil; want error", tc.srcPort, tc.flows)
+		}
+	}
+}
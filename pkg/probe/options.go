@@ -0,0 +1,167 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultProbeTimeout = 3 * time.Second
+	defaultTTL          = 64
+)
+
+// Options for sending a probe.
+type Options struct {
+	// Timeout is how long to wait for a reply. Defaults to 3 seconds.
+	Timeout time.Duration
+	// TCPOptions are added to TCP probes. See ParseTCPOptions.
+	TCPOptions []TCPOption
+
+	// The following fields control the IP header. Setting any of them
+	// causes the IPv4 header to be crafted by us (IP_HDRINCL) instead of
+	// the kernel. For IPv6, IPID is not supported.
+
+	// TTL (or IPv6 hop limit). Zero uses the default.
+	TTL int
+	// DSCP is the differentiated services code point (0-63).
+	DSCP int
+	// ECN is the ECN codepoint.
+	ECN ECNCodepoint
+	// DontFragment sets the IPv4 DF bit. For IPv6, it stops the kernel
+	// from fragmenting packets larger than the path MTU.
+	DontFragment bool
+	// IPID is the IPv4 identification. Zero lets the kernel choose.
+	IPID int
+	// FlowLabel is the IPv6 flow label. Zero lets the kernel choose.
+	FlowLabel int
+
+	// FragmentSize, if non-zero, splits the probe into IP fragments that
+	// carry at most this many bytes of the IP payload (rounded down to a
+	// multiple of 8). IPv6 probes use the fragment extension header;
+	// receivers drop IPv6 fragments if the first one does not hold the
+	// whole transport header (RFC 7112).
+	FragmentSize int
+	// FragmentOrder is the order the fragments are sent in.
+	FragmentOrder FragmentOrder
+	// FragmentDelay is the time to wait between fragments. It is not
+	// included in the RTT.
+	FragmentDelay time.Duration
+
+	// ECNSetup sends TCP probes as ECN-setup SYNs (ECE and CWR set).
+	// Setting this or ECN adds an ECNReport to the result of TCP probes;
+	// see ECNReport for what it can detect.
+	// Note that hosts following RFC 3168 do not negotiate ECN if the SYN
+	// itself has an ECN capable codepoint.
+	ECNSetup bool
+
+	// SuppressRST makes Handshake install an iptables rule that drops the
+	// RSTs the kernel sends for the userspace connection. Without it (or
+	// an equivalent firewall rule), the kernel resets the connection when
+	// the SYN-ACK arrives, so the steps after the SYN fail.
+	SuppressRST bool
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil || o.Timeout == 0 {
+		return defaultProbeTimeout
+	}
+	return o.Timeout
+}
+
+// ttl returns the TTL to use in a crafted header.
+func (o *Options) ttl() uint8 {
+	if o == nil || o.TTL == 0 {
+		return defaultTTL
+	}
+	return uint8(o.TTL)
+}
+
+// withTTL returns a copy of the options with the TTL set.
+func (o *Options) withTTL(ttl int) *Options {
+	var ret Options
+	if o != nil {
+		ret = *o
+	}
+	ret.TTL = ttl
+	return &ret
+}
+
+// tos returns the IPv4 TOS (IPv6 traffic class) byte.
+func (o *Options) tos() uint8 {
+	if o == nil {
+		return 0
+	}
+	return uint8(o.DSCP<<2) | uint8(o.ECN&ecnMask)
+}
+
+// ipHeaderSet returns true if any of the IP header fields are set.
+func (o *Options) ipHeaderSet() bool {
+	return o != nil && (o.TTL != 0 || o.DSCP != 0 || o.ECN != ECNNotECT || o.DontFragment || o.IPID != 0 || o.FlowLabel != 0)
+}
+
+// ecn returns true if the ECN signals of the probe should be reported.
+func (o *Options) ecn() bool {
+	return o != nil && (o.ECN != ECNNotECT || o.ECNSetup)
+}
+
+// craftIPv6 returns true if the IPv6 header must be crafted by us instead
+// of the kernel.
+func (o *Options) craftIPv6() bool {
+	return o != nil && (o.FlowLabel != 0 || o.fragmented())
+}
+
+// fragmented returns true if the probe should be fragmented.
+func (o *Options) fragmented() bool {
+	return o != nil && o.FragmentSize != 0
+}
+
+// validate the options for a probe to dest.
+func (o *Options) validate(v6 bool) error {
+	if o == nil {
+		return nil
+	}
+	if o.TTL < 0 || o.TTL > 255 {
+		return fmt.Errorf("invalid TTL %d", o.TTL)
+	}
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return fmt.Errorf("invalid DSCP %d", o.DSCP)
+	}
+	if o.ECN > ECNCE {
+		return fmt.Errorf("invalid ECN codepoint %d", o.ECN)
+	}
+	if o.IPID < 0 || o.IPID > 0xffff {
+		return fmt.Errorf("invalid IP ID %d", o.IPID)
+	}
+	if v6 && o.IPID != 0 {
+		return fmt.Errorf("IP ID is not supported for IPv6")
+	}
+	if o.FlowLabel < 0 || o.FlowLabel > 0xfffff {
+		return fmt.Errorf("invalid flow label %d", o.FlowLabel)
+	}
+	if !v6 && o.FlowLabel != 0 {
+		return fmt.Errorf("flow label is only supported for IPv6")
+	}
+	if o.FragmentSize < 0 || (o.FragmentSize > 0 && o.FragmentSize < 8) {
+		return fmt.Errorf("invalid fragment size %d (must be at least 8)", o.FragmentSize)
+	}
+	if o.FragmentSize > 0 && o.DontFragment {
+		return fmt.Errorf("cannot fragment a probe with DF set")
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// pmtuMinIPv4 and pmtuMinIPv6 are the sizes that every path must
+	// carry (RFC 791 and RFC 8200).
+	pmtuMinIPv4 = 576
+	pmtuMinIPv6 = 1280
+	// pmtuMaxSize is the largest IP packet.
+	pmtuMaxSize = 65535
+	// pmtuAttempts is the number of times a size is tried before the
+	// probe is considered dropped.
+	pmtuAttempts = 2
+	defaultMTU   = 1500
+)
+
+// PMTUOutcome is the outcome of a single path MTU probe.
+type PMTUOutcome int
+
+const (
+	// PMTUFits means the destination replied to the probe.
+	PMTUFits PMTUOutcome = iota
+	// PMTUTooBig means a router replied with ICMP fragmentation needed
+	// (IPv6 packet too big).
+	PMTUTooBig
+	// PMTUDropped means there was no reply.
+	PMTUDropped
+	// PMTULocalTooBig means the probe is larger than the MTU of the local
+	// route and could not be sent.
+	PMTULocalTooBig
+)
+
+func (o PMTUOutcome) String() string {
+	switch o {
+	case PMTUFits:
+		return "fits"
+	case PMTUTooBig:
+		return "too big"
+	case PMTUDropped:
+		return "dropped"
+	case PMTULocalTooBig:
+		return "too big for local route"
+	}
+	return "unknown"
+}
+
+// PMTUProbe is a probe of a given size.
+type PMTUProbe struct {
+	// Size of the IP packet, including the IP header.
+	Size    int
+	Outcome PMTUOutcome
+	// Result of the probe; nil if it could not be sent.
+	Result *Result
+	// MTU is the next-hop MTU reported by a PMTUTooBig reply.
+	MTU int
+}
+
+// PMTUReport is the outcome of path MTU discovery.
+type PMTUReport struct {
+	Dest string
+	Port int
+	// MTU is the effective path MTU: the largest packet that reached the
+	// destination.
+	MTU    int
+	Probes []*PMTUProbe
+}
+
+// PTBFrom returns the addresses that sent ICMP fragmentation needed
+// (packet too big) messages.
+func (r *PMTUReport) PTBFrom() []net.IP {
+	var ret []net.IP
+	seen := map[string]bool{}
+	for _, p := range r.Probes {
+		if p.Outcome == PMTUTooBig && !seen[p.Result.From.String()] {
+			seen[p.Result.From.String()] = true
+			ret = append(ret, p.Result.From)
+		}
+	}
+	return ret
+}
+
+// BlackHole returns true if packets larger than the path MTU were dropped
+// without an ICMP fragmentation needed (packet too big) message, i.e. the
+// message was filtered or never sent.
+func (r *PMTUReport) BlackHole() bool {
+	for _, p := range r.Probes {
+		if p.Outcome == PMTUDropped {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PMTUReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "path mtu to %s:%d: %d\n", r.Dest, r.Port, r.MTU)
+	for _, p := range r.Probes {
+		fmt.Fprintf(&buf, "  %5d %v", p.Size, p.Outcome)
+		switch {
+		case p.Outcome == PMTUTooBig:
+			fmt.Fprintf(&buf, " (mtu %d from %v)", p.MTU, p.Result.From)
+		case p.Result != nil && p.Result.From != nil:
+			fmt.Fprintf(&buf, " (%s from %v in %v)", p.Result.Reason, p.Result.From, p.Result.RTT)
+		}
+		buf.WriteString("\n")
+	}
+	if from := r.PTBFrom(); len(from) > 0 {
+		fmt.Fprintf(&buf, "icmp packet too big received from %v\n", from)
+	} else {
+		buf.WriteString("no icmp packet too big received\n")
+	}
+	if r.BlackHole() {
+		fmt.Fprintf(&buf, "black hole: packets larger than %d are dropped without icmp packet too big (filtered?)", r.MTU)
+	} else {
+		buf.WriteString("no black hole detected")
+	}
+	return buf.String()
+}
+
+// DiscoverPMTU finds the path MTU to dest:destPort by binary searching the
+// size of DF-marked TCP SYNs that carry a probe identity padded to the
+// size. A probe fits if the destination replies with a SYN-ACK or RST. The
+// search is between the minimum MTU of the IP version and maxSize (the
+// MTU of the local interface if zero). ICMP fragmentation needed (packet
+// too big) messages narrow the search to the reported MTU. opt.DontFragment
+// is always set; opt may be nil.
+func DiscoverPMTU(src string, srcPort int, dest string, destPort int, magic string, maxSize int, opt *Options) (*PMTUReport, error) {
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
+	if err != nil {
+		return nil, err
+	}
+	if srcPort, err = sourcePort(srcPort, tcpProtoNum); err != nil {
+		return nil, err
+	}
+	var dfOpt Options
+	if opt != nil {
+		dfOpt = *opt
+	}
+	dfOpt.DontFragment = true
+
+	s, err := newSession(srcAddr, destAddr, tcpProtoNum, &dfOpt)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	p := &pmtuProber{
+		s:        s,
+		src:      srcAddr.IP,
+		dest:     destAddr.IP,
+		srcPort:  uint16(srcPort),
+		destPort: uint16(destPort),
+		magic:    magic,
+		timeout:  dfOpt.timeout(),
+	}
+	if maxSize == 0 {
+		maxSize = interfaceMTU(srcAddr.IP)
+	}
+	report := &PMTUReport{Dest: destAddr.IP.String(), Port: destPort}
+	if err := p.search(report, maxSize); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// pmtuProber sends probes of a given size.
+type pmtuProber struct {
+	s                 *session
+	src, dest         net.IP
+	srcPort, destPort uint16
+	magic             string
+	timeout           time.Duration
+}
+
+// headerLen is the size of the IP and TCP headers of a probe.
+func (p *pmtuProber) headerLen() int {
+	if p.dest.To4() == nil {
+		return ipv6HeaderSize + tcpHeaderSize
+	}
+	return ipv4MinHeaderSize + tcpHeaderSize
+}
+
+// search for the path MTU between the minimum MTU and maxSize and fill in
+// the report.
+func (p *pmtuProber) search(report *PMTUReport, maxSize int) error {
+	minSize := pmtuMinIPv4
+	if p.dest.To4() == nil {
+		minSize = pmtuMinIPv6
+	}
+	mtu, err := searchPMTU(minSize, maxSize, func(size int) (*PMTUProbe, error) {
+		pr, err := p.probe(size)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(2).Infof("PMTU probe size %d: %v (mtu %d)", size, pr.Outcome, pr.MTU)
+		report.Probes = append(report.Probes, pr)
+		return pr, nil
+	})
+	report.MTU = mtu
+	return err
+}
+
+// searchPMTU returns the largest size between minSize and maxSize for which
+// probe fits. minSize must fit.
+func searchPMTU(minSize, maxSize int, probe func(size int) (*PMTUProbe, error)) (int, error) {
+	if maxSize > pmtuMaxSize {
+		maxSize = pmtuMaxSize
+	}
+	if maxSize < minSize {
+		return 0, fmt.Errorf("invalid max size %d (must be at least %d)", maxSize, minSize)
+	}
+
+	pr, err := probe(minSize)
+	if err != nil {
+		return 0, err
+	}
+	if pr.Outcome != PMTUFits {
+		reason := pr.Outcome.String()
+		if pr.Result != nil {
+			reason = pr.Result.Reason
+		}
+		return 0, fmt.Errorf("no reply to a %d byte probe (%s)", minSize, reason)
+	}
+
+	// Invariant: lo fits and nothing larger than hi does.
+	lo, hi := minSize, maxSize
+	size := hi
+	for lo < hi {
+		pr, err := probe(size)
+		if err != nil {
+			return 0, err
+		}
+		if pr.Outcome == PMTUFits {
+			lo = size
+		} else {
+			hi = size - 1
+		}
+		size = (lo + hi + 1) / 2
+		// Try the reported MTU next; it is usually correct.
+		if pr.Outcome == PMTUTooBig && pr.MTU > lo && pr.MTU <= hi {
+			hi = pr.MTU
+			size = pr.MTU
+		}
+	}
+	return lo, nil
+}
+
+// probe sends a probe of the given size, retrying if it is dropped.
+func (p *pmtuProber) probe(size int) (*PMTUProbe, error) {
+	var pr *PMTUProbe
+	for i := 0; i < pmtuAttempts; i++ {
+		var err error
+		if pr, err = p.probeOnce(size); err != nil {
+			return nil, err
+		}
+		if pr.Outcome != PMTUDropped {
+			break
+		}
+	}
+	return pr, nil
+}
+
+func (p *pmtuProber) probeOnce(size int) (*PMTUProbe, error) {
+	id, payload, err := newPayload(p.magic)
+	if err != nil {
+		return nil, err
+	}
+	dataLen := size - p.headerLen()
+	if dataLen < len(payload) {
+		return nil, fmt.Errorf("probe size %d is too small for the identity", size)
+	}
+	data := make([]byte, dataLen)
+	copy(data, payload)
+
+	tcp := &tcpPacket{
+		srcPort:  p.srcPort,
+		destPort: p.destPort,
+		flags:    tcpFlags{syn: true},
+		seq:      uint32(id.ID),
+	}
+	pkt := make([]byte, tcp.headerLen()+len(data))
+	n, err := tcp.encode(pkt, p.src, p.dest, data)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &PMTUProbe{Size: size}
+	sent, err := p.s.write(pkt[:n])
+	if err != nil {
+		if isMessageTooLong(err) {
+			pr.Outcome = PMTULocalTooBig
+			return pr, nil
+		}
+		return nil, err
+	}
+
+	var ptb *icmpQuote
+	classify := classifyPMTU(tcp, p.src, p.dest, dataLen, &ptb)
+	pr.Result = p.s.listener.await(sent, p.timeout, classify, VerdictUnknown)
+	pr.Result.Identity = id
+	switch {
+	case ptb != nil:
+		pr.Outcome, pr.MTU = PMTUTooBig, ptb.mtu
+	case pr.Result.Verdict == VerdictOpen || pr.Result.Verdict == VerdictClosed:
+		pr.Outcome = PMTUFits
+	default:
+		pr.Outcome = PMTUDropped
+	}
+	return pr, nil
+}
+
+// classifyPMTU matches ICMP fragmentation needed (packet too big) messages
+// quoting the TCP probe and stores them in ptb, as well as the replies
+// matched by classifyTCP.
+func classifyPMTU(tcp *tcpPacket, src, dest net.IP, dataLen int, ptb **icmpQuote) classifier {
+	classify := classifyTCP(tcp, src, dest, dataLen)
+	return func(r *reply) (Verdict, string, bool) {
+		if q, ok := decodeICMPQuote(r); ok && q.isPacketTooBig(r.proto) {
+			if q.matches(tcpProtoNum, dest, func(quoted []byte) bool {
+				decoder := binary.BigEndian
+				return decoder.Uint16(quoted) == tcp.srcPort &&
+					decoder.Uint16(quoted[2:]) == tcp.destPort &&
+					decoder.Uint32(quoted[4:]) == tcp.seq
+			}) {
+				*ptb = q
+				return VerdictFiltered, fmt.Sprintf("packet too big (mtu %d)", q.mtu), true
+			}
+		}
+		return classify(r)
+	}
+}
+
+// interfaceMTU returns the MTU of the interface with the address ip, or
+// 1500 if there is none.
+func interfaceMTU(ip net.IP) int {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return defaultMTU
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return iface.MTU
+			}
+		}
+	}
+	return defaultMTU
+}
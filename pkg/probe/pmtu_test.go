@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakePath simulates the outcome of PMTU probes over a path.
+type fakePath struct {
+	// mtu is the path MTU.
+	mtu int
+	// ptbMTU is reported in packet too big messages; if ptb is false,
+	// larger packets are dropped silently.
+	ptb    bool
+	ptbMTU int
+	sizes  []int
+}
+
+func (f *fakePath) probe(size int) (*PMTUProbe, error) {
+	f.sizes = append(f.sizes, size)
+	pr := &PMTUProbe{Size: size, Result: &Result{}}
+	switch {
+	case size <= f.mtu:
+		pr.Outcome = PMTUFits
+	case f.ptb:
+		pr.Outcome, pr.MTU = PMTUTooBig, f.ptbMTU
+	default:
+		pr.Outcome = PMTUDropped
+	}
+	return pr, nil
+}
+
+func TestSearchPMTU(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc      string
+		path      *fakePath
+		maxSize   int
+		want      int
+		wantSizes []int
+	}{
+		{desc: "fits", path: &fakePath{mtu: 1500}, maxSize: 1500, want: 1500, wantSizes: []int{576, 1500}},
+		{desc: "packet too big", path: &fakePath{mtu: 1400, ptb: true, ptbMTU: 1400}, maxSize: 1500, want: 1400, wantSizes: []int{576, 1500, 1400}},
+		{desc: "packet too big without mtu", path: &fakePath{mtu: 1400, ptb: true}, maxSize: 1500, want: 1400},
+		{desc: "wrong mtu in packet too big", path: &fakePath{mtu: 1300, ptb: true, ptbMTU: 1400}, maxSize: 1500, want: 1300},
+		{desc: "black hole", path: &fakePath{mtu: 1450}, maxSize: 9000, want: 1450},
+		{desc: "max size is minimum", path: &fakePath{mtu: 1500}, maxSize: 576, want: 576, wantSizes: []int{576}},
+	} {
+		got, err := searchPMTU(576, tc.maxSize, tc.path.probe)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: searchPMTU() = %d, %v; want %d, nil", tc.desc, got, err, tc.want)
+		}
+		if tc.wantSizes != nil && !reflect.DeepEqual(tc.path.sizes, tc.wantSizes) {
+			t.Errorf("%s: probed sizes %v, want %v", tc.desc, tc.path.sizes, tc.wantSizes)
+		}
+	}
+
+	if _, err := searchPMTU(576, 1500, (&fakePath{mtu: 500}).probe); err == nil {
+		t.Errorf("searchPMTU() with the minimum size dropped = _, nil, want error")
+	}
+	if _, err := searchPMTU(1280, 1000, (&fakePath{mtu: 1500}).probe); err == nil {
+		t.Errorf("searchPMTU() with max size below the minimum = _, nil, want error")
+	}
+}
+
+func TestClassifyPMTU(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc              string
+		src, dest, router net.IP
+	}{
+		{desc: "ipv4", src: net.ParseIP("10.0.0.1"), dest: net.ParseIP("10.0.1.2"), router: net.ParseIP("10.0.0.254")},
+		{desc: "ipv6", src: net.ParseIP("2001:db8::1"), dest: net.ParseIP("2001:db8:1::2"), router: net.ParseIP("2001:db8::fe")},
+	} {
+		probe := &tcpPacket{srcPort: 3000, destPort: 80, seq: 0x1234, flags: tcpFlags{syn: true}}
+		// Reuse the time exceeded message, changing the type and MTU.
+		msg := timeExceeded(probe, tc.src, tc.dest)
+		proto := icmpProtoNum
+		if tc.dest.To4() == nil {
+			proto = icmpv6ProtoNum
+			msg[0] = icmpv6TypePacketTooBig
+			binary.BigEndian.PutUint32(msg[4:], 1400)
+		} else {
+			msg[0], msg[1] = icmpTypeDestUnreach, icmpCodeFragNeeded
+			binary.BigEndian.PutUint16(msg[6:], 1400)
+		}
+
+		var ptb *icmpQuote
+		classify := classifyPMTU(probe, tc.src, tc.dest, 0, &ptb)
+		if _, _, ok := classify(&reply{proto: proto, from: tc.router, data: msg}); !ok || ptb == nil || ptb.mtu != 1400 {
+			t.Errorf("%s: classify(packet too big) = _, _, %t, ptb %+v; want true with mtu 1400", tc.desc, ok, ptb)
+		}
+	}
+}
+
+func TestPMTUReport(t *testing.T) {
+	t.Parallel()
+
+	router := net.ParseIP("10.0.0.254")
+	report := &PMTUReport{
+		Dest: "10.0.1.2",
+		Port: 80,
+		MTU:  1400,
+		Probes: []*PMTUProbe{
+			{Size: 576, Outcome: PMTUFits, Result: &Result{Reason: "syn-ack", From: net.ParseIP("10.0.1.2")}},
+			{Size: 1500, Outcome: PMTUTooBig, MTU: 1450, Result: &Result{From: router}},
+			{Size: 1450, Outcome: PMTUDropped, Result: &Result{Reason: "timeout"}},
+			{Size: 1400, Outcome: PMTUFits, Result: &Result{Reason: "syn-ack", From: net.ParseIP("10.0.1.2")}},
+		},
+	}
+	if !report.BlackHole() {
+		t.Errorf("BlackHole() = false, want true")
+	}
+	if got := report.PTBFrom(); len(got) != 1 || !got[0].Equal(router) {
+		t.Errorf("PTBFrom() = %v, want [%v]", got, router)
+	}
+	s := report.String()
+	for _, want := range []string{"path mtu to 10.0.1.2:80: 1400", "mtu 1450 from 10.0.0.254", "black hole"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String() = %q, want it to contain %q", s, want)
+		}
+	}
+}
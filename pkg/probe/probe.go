@@ -17,38 +17,357 @@ limitations under the License.
 package probe
 
 import (
+	"encoding/binary"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/golang/glog"
 )
 
-// SendTCP TODO
-func SendTCP(src string, srcPort int, dest string, destPort int, magic string) error {
-	srcAddr, err := net.ResolveIPAddr("ip4", src)
+// SendTCP sends a TCP SYN carrying a probe identity tagged with magic and
+// waits for the reply. If src is empty, the source address is chosen by a
+// route lookup; if srcPort is zero, an unused ephemeral port is chosen. The
+// same applies to the other Send functions. opt may be nil.
+func SendTCP(src string, srcPort int, dest string, destPort int, magic string, opt *Options) (*Result, error) {
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	destAddr, err := net.ResolveIPAddr("ip4", dest)
-	if err != nil {
-		return err
+	if srcPort, err = sourcePort(srcPort, tcpProtoNum); err != nil {
+		return nil, err
 	}
-	conn, err := net.DialIP("ip4:tcp", srcAddr, destAddr)
+	id, payload, err := newPayload(magic)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	tcp := &tcpPacket{
 		srcPort:  uint16(srcPort),
 		destPort: uint16(destPort),
 		flags:    tcpFlags{syn: true},
-		seq:      1,
+		seq:      uint32(id.ID),
+	}
+	if opt != nil {
+		tcp.options = probeTCPOptions(opt.TCPOptions, id)
+		if opt.ECNSetup {
+			tcp.flags.ece, tcp.flags.cwr = true, true
+		}
+	}
+
+	pkt := make([]byte, tcp.headerLen()+len(payload))
+	n, err := tcp.encode(pkt, srcAddr.IP, destAddr.IP, payload)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("Encoded TCP (%d bytes, identity %v): %v", n, id, pkt[:n])
+
+	classify := classifyTCP(tcp, srcAddr.IP, destAddr.IP, len(payload))
+	if !opt.ecn() {
+		return send(srcAddr, destAddr, tcpProtoNum, id, pkt[:n], classify, VerdictFiltered, opt)
+	}
+
+	ecn := newECNObserver(tcp, srcAddr.IP, destAddr.IP, opt.ECN)
+	result, err := send(srcAddr, destAddr, tcpProtoNum, id, pkt[:n], ecn.wrap(classify), VerdictFiltered, opt)
+	if err != nil {
+		return nil, err
+	}
+	result.ECN = ecn.report
+	return result, nil
+}
+
+// SendUDP sends a UDP datagram carrying a probe identity tagged with magic
+// and waits for the reply. opt may be nil.
+func SendUDP(src string, srcPort int, dest string, destPort int, magic string, opt *Options) (*Result, error) {
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
+	if err != nil {
+		return nil, err
+	}
+	if srcPort, err = sourcePort(srcPort, udpProtoNum); err != nil {
+		return nil, err
+	}
+	id, payload, err := newPayload(magic)
+	if err != nil {
+		return nil, err
+	}
+
+	udp := &udpPacket{
+		srcPort:  uint16(srcPort),
+		destPort: uint16(destPort),
+	}
+
+	pkt := make([]byte, udpHeaderSize+len(payload))
+	n := udp.encode(pkt, srcAddr.IP, destAddr.IP, payload)
+	glog.V(2).Infof("Encoded UDP (%d bytes, identity %v): %v", n, id, pkt[:n])
+
+	classify := classifyUDP(udp, srcAddr.IP, destAddr.IP)
+	return send(srcAddr, destAddr, udpProtoNum, id, pkt[:n], classify, VerdictOpenFiltered, opt)
+}
+
+// SendSCTP sends an SCTP INIT carrying a probe identity tagged with magic
+// and waits for the reply. opt may be nil.
+func SendSCTP(src string, srcPort int, dest string, destPort int, magic string, opt *Options) (*Result, error) {
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
+	if err != nil {
+		return nil, err
+	}
+	if srcPort, err = sourcePort(srcPort, sctpProtoNum); err != nil {
+		return nil, err
+	}
+	id, payload, err := newPayload(magic)
+	if err != nil {
+		return nil, err
+	}
+
+	// The initiate tag must not be zero.
+	initiateTag := uint32(id.ID>>32) | 1
+	sctp := &sctpPacket{
+		srcPort:  uint16(srcPort),
+		destPort: uint16(destPort),
+		chunks:   []sctpChunk{newSCTPInit(initiateTag, uint32(id.ID), payload)},
+	}
+
+	pkt := make([]byte, sctp.len())
+	n := sctp.encode(pkt)
+	glog.V(2).Infof("Encoded SCTP (%d bytes, identity %v): %v", n, id, pkt[:n])
+
+	classify := classifySCTP(sctp, destAddr.IP, initiateTag)
+	return send(srcAddr, destAddr, sctpProtoNum, id, pkt[:n], classify, VerdictFiltered, opt)
+}
+
+// SendICMP sends an ICMP (or ICMPv6) echo request carrying a probe identity
+// tagged with magic and waits for the reply. opt may be nil.
+func SendICMP(src string, dest string, magic string, opt *Options) (*Result, error) {
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
+	if err != nil {
+		return nil, err
+	}
+	id, payload, err := newPayload(magic)
+	if err != nil {
+		return nil, err
 	}
 
-	pkt := make([]byte, 1024)
-	len := tcp.encode(pkt, net.ParseIP(src), net.ParseIP(dest), []byte{})
-	glog.V(2).Infof("Encoded TCP (%d bytes): %v", len, pkt[:len])
-	len, err = conn.Write(pkt[:len])
-	glog.V(2).Infof("conn.Write(pkt) = %d, %v", len, err)
+	echo := newICMPEcho(destAddr.IP, uint16(id.ID>>16), uint16(id.ID))
+
+	pkt := make([]byte, icmpHeaderSize+len(payload))
+	n := echo.encode(pkt, srcAddr.IP, destAddr.IP, payload)
+	glog.V(2).Infof("Encoded ICMP echo (%d bytes, identity %v): %v", n, id, pkt[:n])
+
+	icmpNum, _ := icmpProto(destAddr.IP)
+	classify := classifyICMPEcho(echo, srcAddr.IP, destAddr.IP, id)
+	return send(srcAddr, destAddr, icmpNum, id, pkt[:n], classify, VerdictFiltered, opt)
+}
+
+// probeTCPOptions returns a copy of opts with the probe magic, ID and
+// timestamp filled in.
+func probeTCPOptions(opts []TCPOption, id *Identity) []TCPOption {
+	var ret []TCPOption
+	for _, o := range opts {
+		switch {
+		case o.isProbeID():
+			o = TCPOptionProbeID(o.Kind, id.Magic, id.ID)
+		case o.Kind == tcpOptionKindTimestamps && len(o.Data) == 8 && binary.BigEndian.Uint32(o.Data) == 0:
+			o = TCPOptionTimestamps(uint32(id.Timestamp.UnixNano()/int64(time.Millisecond)), 0)
+		}
+		ret = append(ret, o)
+	}
+	return ret
+}
 
-	return err
+// newPayload returns a new identity and its encoding.
+func newPayload(magic string) (*Identity, []byte, error) {
+	id, err := NewIdentity(magic)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := id.Encode()
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, payload, nil
+}
+
+// send the IP payload pkt of the given protocol and wait for a reply.
+func send(srcAddr, destAddr *net.IPAddr, proto int, id *Identity, pkt []byte, classify classifier, timeoutVerdict Verdict, opt *Options) (*Result, error) {
+	s, err := newSession(srcAddr, destAddr, proto, opt)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	sent, err := s.write(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	result := s.listener.await(sent, opt.timeout(), classify, timeoutVerdict)
+	result.Identity = id
+	return result, nil
+}
+
+// session sends packets of one protocol between a pair of addresses and
+// receives the replies.
+type session struct {
+	srcAddr, destAddr *net.IPAddr
+	proto             int
+	opt               *Options
+
+	conn     *net.IPConn
+	icmpConn *net.IPConn
+	// sender is set if we craft the IP header.
+	sender   *rawIPSender
+	listener *replyListener
+}
+
+func newSession(srcAddr, destAddr *net.IPAddr, proto int, opt *Options) (*session, error) {
+	v6 := destAddr.IP.To4() == nil
+	if err := opt.validate(v6); err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		srcAddr:  srcAddr,
+		destAddr: destAddr,
+		proto:    proto,
+		opt:      opt,
+		listener: newReplyListener(),
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			s.close()
+		}
+	}()
+
+	network := ipNetwork(destAddr.IP)
+	var err error
+	if s.conn, err = net.DialIP(fmt.Sprintf("%s:%d", network, proto), srcAddr, destAddr); err != nil {
+		return nil, err
+	}
+	if v6 {
+		// The traffic class of replies is only needed for ECN
+		// reports, so failing to get it is not fatal.
+		if err := setReceiveTrafficClass(s.conn); err != nil {
+			glog.V(2).Infof("Not receiving the traffic class of replies: %v", err)
+		}
+	}
+	s.listener.listen(proto, s.conn)
+
+	if icmpNum, icmpName := icmpProto(destAddr.IP); proto != icmpNum {
+		if s.icmpConn, err = net.ListenIP(network+":"+icmpName, srcAddr); err != nil {
+			return nil, err
+		}
+		s.listener.listen(icmpNum, s.icmpConn)
+	}
+
+	if v6 && opt.ipHeaderSet() && !opt.craftIPv6() {
+		// The kernel builds the header; we only need to set the fields.
+		if err := setIPv6SendOptions(s.conn, opt.TTL, int(opt.tos()), opt.DontFragment); err != nil {
+			return nil, err
+		}
+	} else if opt.ipHeaderSet() || opt.fragmented() {
+		if s.sender, err = newRawIPSender(destAddr.IP); err != nil {
+			return nil, err
+		}
+	}
+
+	ok = true
+	return s, nil
+}
+
+// write the IP payload pkt and return the time it was sent. For fragmented
+// packets, this is when the last fragment was sent, so that the RTT does
+// not include FragmentDelay.
+func (s *session) write(pkt []byte) (time.Time, error) {
+	if s.sender == nil {
+		sent := time.Now()
+		n, err := s.conn.Write(pkt)
+		glog.V(2).Infof("conn.Write(pkt) = %d, %v", n, err)
+		return sent, err
+	}
+
+	pkts, err := craftIP(s.srcAddr.IP, s.destAddr.IP, s.proto, pkt, s.opt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var sent time.Time
+	for i, p := range pkts {
+		if i > 0 && s.opt.FragmentDelay > 0 {
+			time.Sleep(s.opt.FragmentDelay)
+		}
+		sent = time.Now()
+		err := s.sender.send(p)
+		glog.V(2).Infof("sender.send(pkt %d/%d, %d bytes) = %v", i+1, len(pkts), len(p), err)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return sent, nil
+}
+
+func (s *session) close() {
+	s.listener.close()
+	if s.sender != nil {
+		s.sender.close()
+	}
+	if s.icmpConn != nil {
+		s.icmpConn.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// craftIP returns the IP packets for the payload pkt, including the IP
+// header, fragmented if requested.
+func craftIP(src, dest net.IP, proto int, pkt []byte, opt *Options) ([][]byte, error) {
+	if dest.To4() == nil {
+		ip := &ipv6Header{
+			trafficClass: opt.tos(),
+			flowLabel:    uint32(opt.FlowLabel),
+			nextHeader:   uint8(proto),
+			hopLimit:     opt.ttl(),
+			src:          src,
+			dest:         dest,
+		}
+		if !opt.fragmented() {
+			buf := make([]byte, ipv6HeaderSize+len(pkt))
+			n := ip.encode(buf, pkt)
+			glog.V(2).Infof("Encoded IPv6 header (%v): %v", ip, buf[:ipv6HeaderSize])
+			return [][]byte{buf[:n]}, nil
+		}
+		fragID, err := randomInt(1 << 31)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(2).Infof("Fragmenting IPv6 (%v, id %d) into %d byte fragments (%v)", ip, fragID, opt.FragmentSize, opt.FragmentOrder)
+		return fragmentIPv6(ip, uint32(fragID)+1, pkt, opt.FragmentSize, opt.FragmentOrder)
+	}
+
+	ip := &ipv4Header{
+		tos:          opt.tos(),
+		id:           uint16(opt.IPID),
+		dontFragment: opt.DontFragment,
+		ttl:          opt.ttl(),
+		protocol:     uint8(proto),
+		src:          src,
+		dest:         dest,
+	}
+	if !opt.fragmented() {
+		buf := make([]byte, ip.headerLen()+len(pkt))
+		n := ip.encode(buf, pkt)
+		glog.V(2).Infof("Encoded IPv4 header (%v): %v", ip, buf[:ip.headerLen()])
+		return [][]byte{buf[:n]}, nil
+	}
+	// The kernel picks a new ID for each packet sent with a zero ID, so it
+	// must be set for the fragments to be reassembled.
+	if ip.id == 0 {
+		id, err := randomInt(0xffff)
+		if err != nil {
+			return nil, err
+		}
+		ip.id = uint16(id) + 1
+	}
+	glog.V(2).Infof("Fragmenting IPv4 (%v) into %d byte fragments (%v)", ip, opt.FragmentSize, opt.FragmentOrder)
+	return fragmentIPv4(ip, pkt, opt.FragmentSize, opt.FragmentOrder)
 }
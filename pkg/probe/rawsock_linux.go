@@ -0,0 +1,141 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ipv6DontFrag is IPV6_DONTFRAG, which is missing from package syscall.
+const ipv6DontFrag = 62
+
+// rawIPSender sends packets that include the IP header (IP_HDRINCL or
+// IPV6_HDRINCL).
+type rawIPSender struct {
+	fd   int
+	addr syscall.Sockaddr
+}
+
+// newRawIPSender returns a sender for packets to dest. For IPv4, the kernel
+// fills in the IP ID if it is zero.
+func newRawIPSender(dest net.IP) (*rawIPSender, error) {
+	family := syscall.AF_INET
+	var addr syscall.Sockaddr
+	if dest4 := dest.To4(); dest4 != nil {
+		sa := &syscall.SockaddrInet4{}
+		copy(sa.Addr[:], dest4)
+		addr = sa
+	} else {
+		family = syscall.AF_INET6
+		sa := &syscall.SockaddrInet6{}
+		copy(sa.Addr[:], dest.To16())
+		addr = sa
+	}
+	// IPPROTO_RAW implies that the header is included.
+	fd, err := syscall.Socket(family, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, err
+	}
+	return &rawIPSender{fd: fd, addr: addr}, nil
+}
+
+func (s *rawIPSender) send(pkt []byte) error {
+	return syscall.Sendto(s.fd, pkt, 0, s.addr)
+}
+
+func (s *rawIPSender) close() error {
+	return syscall.Close(s.fd)
+}
+
+// setIPv6SendOptions sets the hop limit, traffic class and don't fragment
+// flag for packets sent on conn. Zero values are left as the system
+// default. With dontFragment, packets larger than the path MTU are
+// rejected with EMSGSIZE instead of being fragmented by the kernel.
+func setIPv6SendOptions(conn *net.IPConn, hopLimit, trafficClass int, dontFragment bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if hopLimit != 0 {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, hopLimit); sockErr != nil {
+				return
+			}
+		}
+		if trafficClass != 0 {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, trafficClass); sockErr != nil {
+				return
+			}
+		}
+		if dontFragment {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setReceiveTrafficClass asks for the traffic class of the IPv6 packets
+// received on conn, to be parsed with parseTrafficClass.
+func setReceiveTrafficClass(conn *net.IPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// parseTrafficClass returns the traffic class in the control messages oob,
+// if there is one.
+func parseTrafficClass(oob []byte) (uint8, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		// The traffic class is an int in host byte order.
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_TCLASS && len(m.Data) >= 4 {
+			return uint8(*(*int32)(unsafe.Pointer(&m.Data[0]))), true
+		}
+	}
+	return 0, false
+}
+
+// isMessageTooLong returns true if err is EMSGSIZE, i.e. the packet is
+// larger than the MTU of the route.
+func isMessageTooLong(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.EMSGSIZE
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestParseTrafficClass(t *testing.T) {
+	t.Parallel()
+
+	// cmsg returns a control message with an int of the given value.
+	cmsg := func(level, typ int32, value int32) []byte {
+		b := make([]byte, syscall.CmsgSpace(4))
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+		h.Level, h.Type = level, typ
+		h.SetLen(syscall.CmsgLen(4))
+		*(*int32)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = value
+		return b
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		oob    []byte
+		want   uint8
+		wantOK bool
+	}{
+		{desc: "none"},
+		{desc: "traffic class", oob: cmsg(syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 0xb9), want: 0xb9, wantOK: true},
+		{
+			desc:   "after hop limit",
+			oob:    append(cmsg(syscall.IPPROTO_IPV6, syscall.IPV6_HOPLIMIT, 64), cmsg(syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 0x02)...),
+			want:   0x02,
+			wantOK: true,
+		},
+		{desc: "other level", oob: cmsg(syscall.IPPROTO_IP, syscall.IPV6_TCLASS, 0xb9)},
+	} {
+		got, ok := parseTrafficClass(tc.oob)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("%s: parseTrafficClass() = %#x, %t; want %#x, %t", tc.desc, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
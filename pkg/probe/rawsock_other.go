@@ -0,0 +1,57 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"errors"
+	"net"
+)
+
+var errRawSocketUnsupported = errors.New("raw sockets are only supported on Linux")
+
+type rawIPSender struct{}
+
+func newRawIPSender(dest net.IP) (*rawIPSender, error) {
+	return nil, errRawSocketUnsupported
+}
+
+func (s *rawIPSender) send(pkt []byte) error {
+	return errRawSocketUnsupported
+}
+
+func (s *rawIPSender) close() error {
+	return errRawSocketUnsupported
+}
+
+func setIPv6SendOptions(conn *net.IPConn, hopLimit, trafficClass int, dontFragment bool) error {
+	return errRawSocketUnsupported
+}
+
+func setReceiveTrafficClass(conn *net.IPConn) error {
+	return errRawSocketUnsupported
+}
+
+func parseTrafficClass(oob []byte) (uint8, bool) {
+	return 0, false
+}
+
+func isMessageTooLong(err error) bool {
+	return false
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/packetsock"
+	"github.com/golang/glog"
+)
+
+const maxPacketSize = 65535
+
+// ProbeEvent is a probe packet seen by a Receiver.
+type ProbeEvent struct {
+	Identity *Identity
+	// Protocol is "tcp", "udp", "sctp" or "icmp".
+	Protocol  string
+	Src, Dest net.IP
+	// SrcPort and DestPort are zero for ICMP.
+	SrcPort, DestPort int
+	// Interface the probe arrived on.
+	Interface string
+	// Timestamp is the arrival time of the probe (of the last fragment,
+	// if it was fragmented).
+	Timestamp time.Time
+	// TTL is the IPv4 TTL or IPv6 hop limit on arrival.
+	TTL int
+	// Fragmented is true if the probe was reassembled from fragments.
+	Fragmented bool
+}
+
+func (e *ProbeEvent) String() string {
+	src, dest := e.Src.String(), e.Dest.String()
+	if e.Protocol != "icmp" {
+		src = net.JoinHostPort(src, fmt.Sprint(e.SrcPort))
+		dest = net.JoinHostPort(dest, fmt.Sprint(e.DestPort))
+	}
+	s := fmt.Sprintf("%s %s %v %s > %s ttl %d on %s", e.Timestamp.Format(time.RFC3339Nano), e.Identity, e.Protocol, src, dest, e.TTL, e.Interface)
+	if e.Fragmented {
+		s += " (fragmented)"
+	}
+	return s
+}
+
+// DecodePacket decodes an IPv4 or IPv6 packet and returns the probe it
+// carries. ErrNoIdentity is returned if the packet is not a probe. The
+// packet must not be a fragment; see Reassembler. Interface and Timestamp
+// are not set.
+func DecodePacket(pkt []byte) (*ProbeEvent, error) {
+	if len(pkt) == 0 {
+		return nil, ErrTruncated
+	}
+	var (
+		e       ProbeEvent
+		proto   int
+		payload []byte
+		err     error
+	)
+	switch pkt[0] >> 4 {
+	case 4:
+		var ip ipv4Header
+		if payload, err = ip.decode(pkt); err != nil && err != ErrBadChecksum {
+			return nil, err
+		}
+		e.Src, e.Dest, e.TTL, proto = ip.src, ip.dest, int(ip.ttl), int(ip.protocol)
+	case 6:
+		var ip ipv6Header
+		if payload, err = ip.decode(pkt); err != nil {
+			return nil, err
+		}
+		e.Src, e.Dest, e.TTL, proto = ip.src, ip.dest, int(ip.hopLimit), int(ip.nextHeader)
+	default:
+		return nil, fmt.Errorf("invalid IP version %d", pkt[0]>>4)
+	}
+
+	switch proto {
+	case tcpProtoNum, udpProtoNum, sctpProtoNum:
+		if len(payload) < 4 {
+			return nil, ErrTruncated
+		}
+		e.SrcPort = int(binary.BigEndian.Uint16(payload))
+		e.DestPort = int(binary.BigEndian.Uint16(payload[2:]))
+		e.Protocol = map[int]string{tcpProtoNum: "tcp", udpProtoNum: "udp", sctpProtoNum: "sctp"}[proto]
+	case icmpProtoNum, icmpv6ProtoNum:
+		// Only echo requests are probes. ICMP errors quote the probes
+		// that caused them, so they also carry identities.
+		if len(payload) < icmpHeaderSize {
+			return nil, ErrTruncated
+		}
+		if typ := payload[0]; typ != icmpTypeEchoRequest && typ != icmpv6TypeEchoRequest {
+			return nil, ErrNoIdentity
+		}
+		e.Protocol = "icmp"
+	default:
+		return nil, ErrNoIdentity
+	}
+
+	// The identity is searched for in the whole segment as it is in the
+	// data for TCP, UDP and ICMP, but in an INIT parameter for SCTP.
+	if e.Identity, err = FindIdentity(payload); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// packetConn receives IP packets from the network.
+type packetConn interface {
+	// read a packet into b, returning its length, the name of the
+	// interface it arrived on and the arrival time.
+	read(b []byte) (int, string, time.Time, error)
+	close() error
+}
+
+// socketConn receives IP packets with a packet socket, without the link
+// layer header.
+type socketConn struct {
+	sock *packetsock.Socket
+
+	// ifNames caches the names of interfaces by index.
+	mu      sync.Mutex
+	ifNames map[int]string
+}
+
+func newPacketConn(interfaces []string) (packetConn, error) {
+	c := &socketConn{ifNames: map[int]string{}}
+	cfg := &packetsock.Config{}
+	for _, name := range interfaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		c.ifNames[ifi.Index] = ifi.Name
+		cfg.Interfaces = append(cfg.Interfaces, ifi.Index)
+	}
+	sock, err := packetsock.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.sock = sock
+	return c, nil
+}
+
+func (c *socketConn) read(b []byte) (int, string, time.Time, error) {
+	for {
+		n, _, addr, ts, err := c.sock.Read(b)
+		if err != nil {
+			return 0, "", time.Time{}, err
+		}
+		if addr.Pkttype == packetsock.PacketOutgoing {
+			continue
+		}
+		return n, c.interfaceName(addr.Ifindex), ts, nil
+	}
+}
+
+// interfaceName returns the name of the interface with the given index.
+func (c *socketConn) interfaceName(index int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if name, ok := c.ifNames[index]; ok {
+		return name
+	}
+	name := ""
+	if ifi, err := net.InterfaceByIndex(index); err == nil {
+		name = ifi.Name
+	}
+	c.ifNames[index] = name
+	return name
+}
+
+func (c *socketConn) close() error {
+	return c.sock.Close()
+}
+
+// Receiver detects probes arriving on the network interfaces of this
+// host. Fragmented probes are reassembled.
+type Receiver struct {
+	// Magic, if set, restricts the probes to those with this magic.
+	Magic string
+
+	conn        packetConn
+	reassembler *Reassembler
+	buf         []byte
+}
+
+// NewReceiver returns a Receiver for the given interfaces, or all
+// interfaces if none are given. This needs CAP_NET_RAW.
+func NewReceiver(interfaces []string) (*Receiver, error) {
+	conn, err := newPacketConn(interfaces)
+	if err != nil {
+		return nil, err
+	}
+	return newReceiver(conn), nil
+}
+
+func newReceiver(conn packetConn) *Receiver {
+	return &Receiver{
+		conn:        conn,
+		reassembler: NewReassembler(),
+		buf:         make([]byte, maxPacketSize),
+	}
+}
+
+// Next blocks until a probe arrives and returns it. It returns an error
+// after Close.
+func (r *Receiver) Next() (*ProbeEvent, error) {
+	for {
+		n, ifName, at, err := r.conn.read(r.buf)
+		if err != nil {
+			return nil, err
+		}
+		pkt, fragmented, err := r.reassembler.Add(r.buf[:n])
+		if err != nil {
+			glog.V(4).Infof("Ignoring packet on %s: %v", ifName, err)
+			continue
+		}
+		if pkt == nil {
+			continue
+		}
+		e, err := DecodePacket(pkt)
+		if err != nil {
+			if err != ErrNoIdentity {
+				glog.V(4).Infof("Ignoring packet on %s: %v", ifName, err)
+			}
+			continue
+		}
+		if r.Magic != "" && e.Identity.Magic != r.Magic {
+			continue
+		}
+		e.Interface, e.Timestamp, e.Fragmented = ifName, at, fragmented
+		return e, nil
+	}
+}
+
+// Close the Receiver.
+func (r *Receiver) Close() error {
+	return r.conn.close()
+}
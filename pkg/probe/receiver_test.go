@@ -0,0 +1,190 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func testIdentityBytes(t *testing.T, magic string) []byte {
+	b, err := (&Identity{Magic: magic, ID: 42, Timestamp: time.Unix(1, 0), Sender: "host"}).Encode()
+	if err != nil {
+		t.Fatalf("Encode() = _, %v, want nil", err)
+	}
+	return b
+}
+
+// ipPacket wraps seg in an IPv4 or IPv6 header, depending on src.
+func ipPacket(src, dest net.IP, proto uint8, ttl uint8, seg []byte) []byte {
+	if src.To4() != nil {
+		ip := &ipv4Header{ttl: ttl, protocol: proto, src: src, dest: dest}
+		pkt := make([]byte, ip.headerLen()+len(seg))
+		return pkt[:ip.encode(pkt, seg)]
+	}
+	ip := &ipv6Header{nextHeader: proto, hopLimit: ttl, src: src, dest: dest}
+	pkt := make([]byte, ipv6HeaderSize+len(seg))
+	return pkt[:ip.encode(pkt, seg)]
+}
+
+func tcpSegment(src, dest net.IP, data []byte) []byte {
+	tcp := &tcpPacket{srcPort: 3000, destPort: 80, seq: 1, flags: tcpFlags{syn: true}}
+	seg := make([]byte, tcp.headerLen()+len(data))
+	n, _ := tcp.encode(seg, src, dest, data)
+	return seg[:n]
+}
+
+func TestDecodePacket(t *testing.T) {
+	t.Parallel()
+
+	id := testIdentityBytes(t, "magic")
+	src4, dest4 := net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()
+	src6, dest6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+
+	udp := func(src, dest net.IP) []byte {
+		seg := make([]byte, udpHeaderSize+len(id))
+		return seg[:(&udpPacket{srcPort: 3001, destPort: 53}).encode(seg, src, dest, id)]
+	}
+	echo := func(src, dest net.IP) []byte {
+		seg := make([]byte, icmpHeaderSize+len(id))
+		return seg[:newICMPEcho(dest, 1, 1).encode(seg, src, dest, id)]
+	}
+	// A port unreachable quoting a UDP probe.
+	unreach := func() []byte {
+		quote := ipPacket(src4, dest4, udpProtoNum, 64, udp(src4, dest4))
+		seg := make([]byte, icmpHeaderSize+len(quote))
+		seg[0], seg[1] = icmpTypeDestUnreach, icmpCodePortUnreach
+		copy(seg[icmpHeaderSize:], quote)
+		return seg
+	}
+	badChecksum := func() []byte {
+		pkt := ipPacket(src4, dest4, tcpProtoNum, 64, tcpSegment(src4, dest4, id))
+		pkt[10]++
+		return pkt
+	}()
+
+	for _, tc := range []struct {
+		desc      string
+		pkt       []byte
+		wantErr   error
+		wantProto string
+		wantPorts [2]int
+		wantTTL   int
+	}{
+		{desc: "tcp ipv4", pkt: ipPacket(src4, dest4, tcpProtoNum, 61, tcpSegment(src4, dest4, id)), wantProto: "tcp", wantPorts: [2]int{3000, 80}, wantTTL: 61},
+		{desc: "tcp ipv6", pkt: ipPacket(src6, dest6, tcpProtoNum, 60, tcpSegment(src6, dest6, id)), wantProto: "tcp", wantPorts: [2]int{3000, 80}, wantTTL: 60},
+		{desc: "udp ipv4", pkt: ipPacket(src4, dest4, udpProtoNum, 64, udp(src4, dest4)), wantProto: "udp", wantPorts: [2]int{3001, 53}, wantTTL: 64},
+		{desc: "icmp echo", pkt: ipPacket(src4, dest4, icmpProtoNum, 64, echo(src4, dest4)), wantProto: "icmp", wantTTL: 64},
+		{desc: "icmpv6 echo", pkt: ipPacket(src6, dest6, icmpv6ProtoNum, 64, echo(src6, dest6)), wantProto: "icmp", wantTTL: 64},
+		{desc: "bad ip checksum", pkt: badChecksum, wantProto: "tcp", wantPorts: [2]int{3000, 80}, wantTTL: 64},
+		{desc: "icmp error", pkt: ipPacket(dest4, src4, icmpProtoNum, 64, unreach()), wantErr: ErrNoIdentity},
+		{desc: "no identity", pkt: ipPacket(src4, dest4, tcpProtoNum, 64, tcpSegment(src4, dest4, nil)), wantErr: ErrNoIdentity},
+		{desc: "other protocol", pkt: ipPacket(src4, dest4, 47, 64, id), wantErr: ErrNoIdentity},
+		{desc: "truncated", pkt: ipPacket(src4, dest4, tcpProtoNum, 64, []byte{1, 2}), wantErr: ErrTruncated},
+		{desc: "empty", wantErr: ErrTruncated},
+	} {
+		e, err := DecodePacket(tc.pkt)
+		if err != tc.wantErr {
+			t.Errorf("%s: DecodePacket() = _, %v; want %v", tc.desc, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if e.Identity.Magic != "magic" || e.Identity.ID != 42 {
+			t.Errorf("%s: identity = %v; want magic/42", tc.desc, e.Identity)
+		}
+		if e.Protocol != tc.wantProto || e.SrcPort != tc.wantPorts[0] || e.DestPort != tc.wantPorts[1] || e.TTL != tc.wantTTL {
+			t.Errorf("%s: got %s %d > %d ttl %d; want %s %d > %d ttl %d", tc.desc, e.Protocol, e.SrcPort, e.DestPort, e.TTL, tc.wantProto, tc.wantPorts[0], tc.wantPorts[1], tc.wantTTL)
+		}
+	}
+}
+
+type fakePacket struct {
+	pkt    []byte
+	ifName string
+}
+
+// fakePacketConn returns its packets in order, then errFakeClosed.
+type fakePacketConn struct {
+	pkts []fakePacket
+	at   time.Time
+}
+
+var errFakeClosed = errors.New("closed")
+
+func (c *fakePacketConn) read(b []byte) (int, string, time.Time, error) {
+	if len(c.pkts) == 0 {
+		return 0, "", time.Time{}, errFakeClosed
+	}
+	p := c.pkts[0]
+	c.pkts = c.pkts[1:]
+	c.at = c.at.Add(time.Millisecond)
+	return copy(b, p.pkt), p.ifName, c.at, nil
+}
+
+func (c *fakePacketConn) close() error { return nil }
+
+func TestReceiver(t *testing.T) {
+	t.Parallel()
+
+	src, dest := net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()
+	probe := ipPacket(src, dest, tcpProtoNum, 60, tcpSegment(src, dest, testIdentityBytes(t, "magic")))
+	other := ipPacket(src, dest, tcpProtoNum, 60, tcpSegment(src, dest, testIdentityBytes(t, "other")))
+	seg := tcpSegment(src, dest, testIdentityBytes(t, "magic"))
+	frags, err := fragmentIPv4(&ipv4Header{id: 7, ttl: 59, protocol: tcpProtoNum, src: src, dest: dest}, seg, 16, FragmentReversed)
+	if err != nil {
+		t.Fatalf("fragmentIPv4() = _, %v; want nil", err)
+	}
+
+	conn := &fakePacketConn{at: time.Unix(100, 0)}
+	conn.pkts = append(conn.pkts,
+		fakePacket{[]byte{0x45}, "eth0"},
+		fakePacket{probe, "eth0"},
+		fakePacket{other, "eth0"},
+		fakePacket{ipPacket(src, dest, tcpProtoNum, 60, tcpSegment(src, dest, nil)), "eth0"},
+	)
+	for _, f := range frags {
+		conn.pkts = append(conn.pkts, fakePacket{f, "eth1"})
+	}
+
+	r := newReceiver(conn)
+	r.Magic = "magic"
+
+	e, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next() = _, %v; want nil", err)
+	}
+	if e.Interface != "eth0" || e.TTL != 60 || e.Fragmented || !e.Timestamp.Equal(time.Unix(100, 2e6)) || !e.Src.Equal(src) || !e.Dest.Equal(dest) {
+		t.Errorf("Next() = %v; want unfragmented probe on eth0 with ttl 60 at 100.002", e)
+	}
+
+	e, err = r.Next()
+	if err != nil {
+		t.Fatalf("Next() = _, %v; want nil", err)
+	}
+	wantAt := time.Unix(100, int64(4+len(frags))*1e6)
+	if e.Interface != "eth1" || e.TTL != 59 || !e.Fragmented || !e.Timestamp.Equal(wantAt) || e.Identity.Magic != "magic" {
+		t.Errorf("Next() = %v; want fragmented probe on eth1 with ttl 59 at %v", e, wantAt)
+	}
+
+	if _, err := r.Next(); err != errFakeClosed {
+		t.Errorf("Next() = _, %v; want %v", err, errFakeClosed)
+	}
+}
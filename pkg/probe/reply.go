@@ -0,0 +1,509 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	icmpProtoNum           = 1
+	icmpHeaderSize         = 8
+	icmpTypeDestUnreach    = 3
+	icmpCodePortUnreach    = 3
+	icmpCodeFragNeeded     = 4
+	icmpTypeTimeExceeded   = 11
+	icmpv6TypeDestUnreach  = 1
+	icmpv6CodePortUnreach  = 4
+	icmpv6TypePacketTooBig = 2
+	icmpv6TypeTimeExceeded = 3
+	ipv4MinHeaderSize      = 20
+)
+
+const (
+	maxReplyPacketSize   = 65535
+	replyChannelCapacity = 16
+
+	// maxReplyControlSize is enough for the traffic class control
+	// message.
+	maxReplyControlSize = 64
+)
+
+// reasonTimeout is the Result.Reason when there was no reply.
+const reasonTimeout = "timeout"
+
+// Verdict is the outcome of a probe.
+type Verdict int
+
+const (
+	// VerdictUnknown means the probe did not complete.
+	VerdictUnknown Verdict = iota
+	// VerdictOpen means the destination accepted the probe (e.g. replied
+	// with a SYN-ACK).
+	VerdictOpen
+	// VerdictClosed means the destination actively refused the probe (e.g.
+	// replied with a RST).
+	VerdictClosed
+	// VerdictFiltered means there was no reply or the probe was rejected
+	// with an ICMP unreachable message.
+	VerdictFiltered
+	// VerdictOpenFiltered means there was no reply to a probe for a
+	// protocol that does not require one (e.g. UDP).
+	VerdictOpenFiltered
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictOpen:
+		return "open"
+	case VerdictClosed:
+		return "closed"
+	case VerdictFiltered:
+		return "filtered"
+	case VerdictOpenFiltered:
+		return "open|filtered"
+	}
+	return "unknown"
+}
+
+// Result of a probe.
+type Result struct {
+	// Identity that was sent in the probe.
+	Identity *Identity
+	// Verdict for the probe.
+	Verdict Verdict
+	// Reason is a short description of the reply the verdict is based
+	// on, e.g. "syn-ack" or "timeout".
+	Reason string
+	// From is the address that sent the reply. This is nil if there was
+	// no reply.
+	From net.IP
+	// RTT is the time between sending the probe (its last fragment, if
+	// fragmented) and receiving the reply.
+	RTT time.Duration
+	// ECN reports on the ECN signals of a TCP probe. This is only set if
+	// ECN was requested in the Options.
+	ECN *ECNReport
+}
+
+// TimedOut returns true if there was no reply to the probe.
+func (r *Result) TimedOut() bool {
+	return r.From == nil && r.Reason == reasonTimeout
+}
+
+func (r *Result) String() string {
+	var s string
+	if r.From == nil {
+		s = fmt.Sprintf("%v %v (%s)", r.Identity, r.Verdict, r.Reason)
+	} else {
+		s = fmt.Sprintf("%v %v (%s from %v in %v)", r.Identity, r.Verdict, r.Reason, r.From, r.RTT)
+	}
+	if r.ECN != nil {
+		s += fmt.Sprintf(" [ecn: %v]", r.ECN)
+	}
+	return s
+}
+
+// reply is a packet received while waiting for the result of a probe.
+type reply struct {
+	proto int
+	from  net.IP
+	// data is the IP payload.
+	data []byte
+	at   time.Time
+	// tos is the IPv4 TOS (IPv6 traffic class) of the reply, if hasTOS.
+	tos    uint8
+	hasTOS bool
+}
+
+// classifier returns the verdict if the reply matches the probe. ok is
+// false if the reply is unrelated.
+type classifier func(r *reply) (verdict Verdict, reason string, ok bool)
+
+// replyListener reads replies from a set of raw sockets.
+type replyListener struct {
+	replies chan *reply
+	done    chan struct{}
+}
+
+func newReplyListener() *replyListener {
+	return &replyListener{
+		replies: make(chan *reply, replyChannelCapacity),
+		done:    make(chan struct{}),
+	}
+}
+
+// listen for packets of the given protocol on conn. The reader exits when
+// conn is closed.
+func (l *replyListener) listen(proto int, conn *net.IPConn) {
+	go func() {
+		for {
+			buf := make([]byte, maxReplyPacketSize)
+			oob := make([]byte, maxReplyControlSize)
+			n, oobn, _, addr, err := conn.ReadMsgIP(buf, oob)
+			if err != nil {
+				if isICMPReadError(err) {
+					glog.V(4).Infof("Reply listener for protocol %d: %v", proto, err)
+					continue
+				}
+				glog.V(4).Infof("Reply listener for protocol %d exiting: %v", proto, err)
+				return
+			}
+			r := &reply{proto: proto, from: addr.IP, data: buf[:n], at: time.Now()}
+			if addr.IP.To4() != nil {
+				// Unlike ReadFromIP, ReadMsgIP leaves the IPv4
+				// header in place.
+				if r.data, r.tos, r.hasTOS = stripIPv4Header(r.data); !r.hasTOS {
+					glog.V(4).Infof("Ignoring reply from %v: invalid IPv4 header", addr.IP)
+					continue
+				}
+			} else {
+				r.tos, r.hasTOS = parseTrafficClass(oob[:oobn])
+			}
+			select {
+			case l.replies <- r:
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+// isICMPReadError returns true if err is an ICMP error reported as a read
+// error on a connected raw socket. These are not fatal; any other error
+// would fail again on the next read.
+func isICMPReadError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+	switch sysErr.Err {
+	case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EMSGSIZE:
+		return true
+	}
+	return false
+}
+
+// stripIPv4Header returns the payload and TOS of the IPv4 packet pkt. ok is
+// false if pkt does not start with a valid IPv4 header.
+func stripIPv4Header(pkt []byte) (payload []byte, tos uint8, ok bool) {
+	if len(pkt) < ipv4MinHeaderSize || pkt[0]>>4 != 4 {
+		return nil, 0, false
+	}
+	ihl := int(pkt[0]&0xf) * 4
+	if ihl < ipv4MinHeaderSize || ihl > len(pkt) {
+		return nil, 0, false
+	}
+	return pkt[ihl:], pkt[1], true
+}
+
+// await a reply that matches the probe sent at the given time. The
+// timeoutVerdict is returned if nothing matches before the timeout.
+func (l *replyListener) await(sent time.Time, timeout time.Duration, classify classifier, timeoutVerdict Verdict) *Result {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case r := <-l.replies:
+			verdict, reason, ok := classify(r)
+			glog.V(4).Infof("Reply from %v (protocol %d, %d bytes): verdict=%v reason=%q match=%t", r.from, r.proto, len(r.data), verdict, reason, ok)
+			if ok {
+				return &Result{Verdict: verdict, Reason: reason, From: r.from, RTT: r.at.Sub(sent)}
+			}
+		case <-timer.C:
+			return &Result{Verdict: timeoutVerdict, Reason: reasonTimeout}
+		}
+	}
+}
+
+func (l *replyListener) close() {
+	close(l.done)
+}
+
+// classifyTCP matches replies to a TCP SYN probe sent from src to dest
+// carrying dataLen bytes of payload.
+func classifyTCP(tcp *tcpPacket, src, dest net.IP, dataLen int) classifier {
+	return func(r *reply) (Verdict, string, bool) {
+		switch r.proto {
+		case tcpProtoNum:
+			if !r.from.Equal(dest) {
+				return VerdictUnknown, "", false
+			}
+			var resp tcpPacket
+			// Locally generated replies (e.g. on loopback) may have
+			// checksums left for offload, so checksum errors are not
+			// fatal.
+			if _, err := resp.decode(r.data, dest, src); err != nil && err != ErrBadChecksum {
+				glog.V(4).Infof("Ignoring TCP reply from %v: %v", r.from, err)
+				return VerdictUnknown, "", false
+			}
+			if resp.srcPort != tcp.destPort || resp.destPort != tcp.srcPort {
+				return VerdictUnknown, "", false
+			}
+			// The ACK may or may not cover the data sent with the SYN.
+			if resp.ack-(tcp.seq+1) > uint32(dataLen) {
+				return VerdictUnknown, "", false
+			}
+			switch {
+			case resp.flags.rst:
+				return VerdictClosed, "rst", true
+			case resp.flags.syn && resp.flags.ack:
+				return VerdictOpen, "syn-ack", true
+			}
+		case icmpProtoNum, icmpv6ProtoNum:
+			code, ok := matchICMPUnreachable(r, tcpProtoNum, dest, func(quoted []byte) bool {
+				decoder := binary.BigEndian
+				return decoder.Uint16(quoted) == tcp.srcPort &&
+					decoder.Uint16(quoted[2:]) == tcp.destPort &&
+					decoder.Uint32(quoted[4:]) == tcp.seq
+			})
+			if ok {
+				return VerdictFiltered, unreachableReason(r.proto, code), true
+			}
+		}
+		return VerdictUnknown, "", false
+	}
+}
+
+// classifyUDP matches replies to a UDP probe sent from src to dest.
+func classifyUDP(udp *udpPacket, src, dest net.IP) classifier {
+	return func(r *reply) (Verdict, string, bool) {
+		switch r.proto {
+		case udpProtoNum:
+			if !r.from.Equal(dest) {
+				return VerdictUnknown, "", false
+			}
+			var resp udpPacket
+			if _, err := resp.decode(r.data, dest, src); err != nil && err != ErrBadChecksum {
+				glog.V(4).Infof("Ignoring UDP reply from %v: %v", r.from, err)
+				return VerdictUnknown, "", false
+			}
+			if resp.srcPort != udp.destPort || resp.destPort != udp.srcPort {
+				return VerdictUnknown, "", false
+			}
+			return VerdictOpen, "udp reply", true
+		case icmpProtoNum, icmpv6ProtoNum:
+			code, ok := matchICMPUnreachable(r, udpProtoNum, dest, func(quoted []byte) bool {
+				decoder := binary.BigEndian
+				return decoder.Uint16(quoted) == udp.srcPort && decoder.Uint16(quoted[2:]) == udp.destPort
+			})
+			if !ok {
+				break
+			}
+			if isPortUnreachable(r.proto, code) {
+				return VerdictClosed, "port unreachable", true
+			}
+			return VerdictFiltered, unreachableReason(r.proto, code), true
+		}
+		return VerdictUnknown, "", false
+	}
+}
+
+// classifyICMPEcho matches replies to an ICMP echo request sent from src to
+// dest carrying the identity id.
+func classifyICMPEcho(echo *icmpEcho, src, dest net.IP, id *Identity) classifier {
+	return func(r *reply) (Verdict, string, bool) {
+		if r.from.Equal(dest) {
+			var resp icmpEcho
+			data, err := resp.decode(r.data, dest, src)
+			if err != nil && err != ErrBadChecksum {
+				glog.V(4).Infof("Ignoring ICMP message from %v: %v", r.from, err)
+				return VerdictUnknown, "", false
+			}
+			if resp.isReply(r.proto == icmpv6ProtoNum) && resp.id == echo.id && resp.seq == echo.seq {
+				// Some hosts do not echo the data back in full.
+				respID, err := FindIdentity(data)
+				switch {
+				case err != nil:
+					return VerdictOpen, "echo reply without identity", true
+				case respID.ID == id.ID:
+					return VerdictOpen, "echo reply", true
+				}
+				glog.V(4).Infof("Ignoring echo reply from %v for another probe: %v", r.from, respID)
+				return VerdictUnknown, "", false
+			}
+		}
+		code, ok := matchICMPUnreachable(r, r.proto, dest, func(quoted []byte) bool {
+			decoder := binary.BigEndian
+			return decoder.Uint16(quoted[4:]) == echo.id && decoder.Uint16(quoted[6:]) == echo.seq
+		})
+		if ok {
+			return VerdictFiltered, unreachableReason(r.proto, code), true
+		}
+		return VerdictUnknown, "", false
+	}
+}
+
+// classifySCTP matches replies to an SCTP INIT probe with the given
+// initiate tag.
+func classifySCTP(sctp *sctpPacket, dest net.IP, initiateTag uint32) classifier {
+	return func(r *reply) (Verdict, string, bool) {
+		switch r.proto {
+		case sctpProtoNum:
+			if !r.from.Equal(dest) {
+				return VerdictUnknown, "", false
+			}
+			var resp sctpPacket
+			if err := resp.decode(r.data); err != nil && err != ErrBadChecksum {
+				glog.V(4).Infof("Ignoring SCTP reply from %v: %v", r.from, err)
+				return VerdictUnknown, "", false
+			}
+			if resp.srcPort != sctp.destPort || resp.destPort != sctp.srcPort {
+				return VerdictUnknown, "", false
+			}
+			for _, c := range resp.chunks {
+				switch {
+				case c.typ == sctpChunkInitAck && resp.verificationTag == initiateTag:
+					return VerdictOpen, "init-ack", true
+				case c.typ == sctpChunkAbort && (resp.verificationTag == initiateTag || c.flags&sctpChunkFlagT != 0):
+					return VerdictClosed, "abort", true
+				}
+			}
+		case icmpProtoNum, icmpv6ProtoNum:
+			code, ok := matchICMPUnreachable(r, sctpProtoNum, dest, func(quoted []byte) bool {
+				decoder := binary.BigEndian
+				return decoder.Uint16(quoted) == sctp.srcPort && decoder.Uint16(quoted[2:]) == sctp.destPort
+			})
+			if !ok {
+				break
+			}
+			if isPortUnreachable(r.proto, code) {
+				return VerdictClosed, "port unreachable", true
+			}
+			return VerdictFiltered, unreachableReason(r.proto, code), true
+		}
+		return VerdictUnknown, "", false
+	}
+}
+
+// icmpQuote is the packet quoted by an ICMP or ICMPv6 error message.
+type icmpQuote struct {
+	// typ and code of the ICMP message.
+	typ, code uint8
+	// mtu is the next-hop MTU of a fragmentation needed (IPv4) or packet
+	// too big (IPv6) message, zero otherwise.
+	mtu int
+	// ipv4 or ipv6 is the quoted IP header.
+	ipv4 *ipv4Header
+	ipv6 *ipv6Header
+	// tos is the quoted IPv4 TOS (IPv6 traffic class).
+	tos   uint8
+	proto int
+	dest  net.IP
+	// data is the quoted IP payload. Most routers only quote the first 8
+	// bytes.
+	data []byte
+}
+
+// decodeICMPQuote decodes the packet quoted by an ICMP or ICMPv6
+// destination unreachable, packet too big or time exceeded message.
+func decodeICMPQuote(r *reply) (*icmpQuote, bool) {
+	if len(r.data) < icmpHeaderSize {
+		return nil, false
+	}
+	q := &icmpQuote{typ: r.data[0], code: r.data[1]}
+	decoder := binary.BigEndian
+	if q.isPacketTooBig(r.proto) {
+		if r.proto == icmpv6ProtoNum {
+			q.mtu = int(decoder.Uint32(r.data[4:]))
+		} else {
+			q.mtu = int(decoder.Uint16(r.data[6:]))
+		}
+	}
+
+	var err error
+	// The quoted header may have been modified in flight, so checksum
+	// errors are ignored.
+	switch {
+	case r.proto == icmpProtoNum && (q.typ == icmpTypeDestUnreach || q.typ == icmpTypeTimeExceeded):
+		q.ipv4 = &ipv4Header{}
+		q.data, err = q.ipv4.decode(r.data[icmpHeaderSize:])
+		q.tos, q.proto, q.dest = q.ipv4.tos, int(q.ipv4.protocol), q.ipv4.dest
+	case r.proto == icmpv6ProtoNum && (q.typ == icmpv6TypeDestUnreach || q.typ == icmpv6TypePacketTooBig || q.typ == icmpv6TypeTimeExceeded):
+		q.ipv6 = &ipv6Header{}
+		q.data, err = q.ipv6.decode(r.data[icmpHeaderSize:])
+		q.tos, q.proto, q.dest = q.ipv6.trafficClass, int(q.ipv6.nextHeader), q.ipv6.dest
+	default:
+		return nil, false
+	}
+	if err != nil && err != ErrBadChecksum {
+		return nil, false
+	}
+	return q, true
+}
+
+// matches returns true if the quote is of a packet of the given protocol
+// sent to dest. match is called with the first 8 bytes of the quoted
+// transport header.
+func (q *icmpQuote) matches(proto int, dest net.IP, match func(quoted []byte) bool) bool {
+	return len(q.data) >= 8 && q.proto == proto && q.dest.Equal(dest) && match(q.data)
+}
+
+// isPacketTooBig returns true if the message is an ICMP fragmentation
+// needed or ICMPv6 packet too big. Some old routers report an MTU of zero.
+func (q *icmpQuote) isPacketTooBig(proto int) bool {
+	if proto == icmpv6ProtoNum {
+		return q.typ == icmpv6TypePacketTooBig
+	}
+	return q.typ == icmpTypeDestUnreach && q.code == icmpCodeFragNeeded
+}
+
+// matchICMPUnreachable matches an ICMP or ICMPv6 destination unreachable
+// message that quotes a packet of the given protocol sent to dest and
+// returns the ICMP code. match is called with the first 8 bytes of the
+// quoted transport header.
+func matchICMPUnreachable(r *reply, proto int, dest net.IP, match func(quoted []byte) bool) (uint8, bool) {
+	q, ok := decodeICMPQuote(r)
+	if !ok {
+		return 0, false
+	}
+	if r.proto == icmpProtoNum && q.typ != icmpTypeDestUnreach || r.proto == icmpv6ProtoNum && q.typ != icmpv6TypeDestUnreach {
+		return 0, false
+	}
+	if !q.matches(proto, dest, match) {
+		return 0, false
+	}
+	return q.code, true
+}
+
+// isPortUnreachable returns true if the unreachable code means that the
+// destination port is closed.
+func isPortUnreachable(proto int, code uint8) bool {
+	if proto == icmpv6ProtoNum {
+		return code == icmpv6CodePortUnreach
+	}
+	return code == icmpCodePortUnreach
+}
+
+func unreachableReason(proto int, code uint8) string {
+	if proto == icmpv6ProtoNum {
+		return fmt.Sprintf("icmpv6 unreachable code %d", code)
+	}
+	return fmt.Sprintf("icmp unreachable code %d", code)
+}
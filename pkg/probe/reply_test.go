@@ -0,0 +1,374 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyTCP(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.0.2")
+	probe := &tcpPacket{srcPort: 3000, destPort: 80, seq: 100, flags: tcpFlags{syn: true}}
+
+	tcpReply := func(t tcpPacket) []byte {
+		pkt := make([]byte, tcpHeaderSize)
+		t.encode(pkt, dest, src, nil)
+		return pkt
+	}
+	icmpReply := func(code byte, srcPort, destPort uint16, seq uint32) []byte {
+		quoted := make([]byte, tcpHeaderSize)
+		(&tcpPacket{srcPort: srcPort, destPort: destPort, seq: seq}).encode(quoted, src, dest, nil)
+		b := []byte{
+			icmpTypeDestUnreach, code, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x45, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x00,
+			0x40, tcpProtoNum, 0x00, 0x00,
+			10, 0, 0, 1,
+			10, 0, 0, 2,
+		}
+		return append(b, quoted[:8]...)
+	}
+
+	badChecksum := tcpReply(tcpPacket{srcPort: 80, destPort: 3000, ack: 101, flags: tcpFlags{rst: true, ack: true}})
+	badChecksum[16]++
+
+	for _, tc := range []struct {
+		desc        string
+		r           reply
+		wantOK      bool
+		wantVerdict Verdict
+	}{
+		{
+			desc:        "syn-ack",
+			r:           reply{proto: tcpProtoNum, from: dest, data: tcpReply(tcpPacket{srcPort: 80, destPort: 3000, ack: 101, flags: tcpFlags{syn: true, ack: true}})},
+			wantOK:      true,
+			wantVerdict: VerdictOpen,
+		},
+		{
+			desc:        "rst acking data",
+			r:           reply{proto: tcpProtoNum, from: dest, data: tcpReply(tcpPacket{srcPort: 80, destPort: 3000, ack: 111, flags: tcpFlags{rst: true, ack: true}})},
+			wantOK:      true,
+			wantVerdict: VerdictClosed,
+		},
+		{
+			desc: "wrong ack",
+			r:    reply{proto: tcpProtoNum, from: dest, data: tcpReply(tcpPacket{srcPort: 80, destPort: 3000, ack: 200, flags: tcpFlags{rst: true, ack: true}})},
+		},
+		{
+			desc: "wrong port",
+			r:    reply{proto: tcpProtoNum, from: dest, data: tcpReply(tcpPacket{srcPort: 81, destPort: 3000, ack: 101, flags: tcpFlags{syn: true, ack: true}})},
+		},
+		{
+			desc: "wrong host",
+			r:    reply{proto: tcpProtoNum, from: src, data: tcpReply(tcpPacket{srcPort: 80, destPort: 3000, ack: 101, flags: tcpFlags{syn: true, ack: true}})},
+		},
+		{
+			desc:        "bad checksum",
+			r:           reply{proto: tcpProtoNum, from: dest, data: badChecksum},
+			wantOK:      true,
+			wantVerdict: VerdictClosed,
+		},
+		{
+			desc: "truncated",
+			r:    reply{proto: tcpProtoNum, from: dest, data: []byte{0x00, 0x50}},
+		},
+		{
+			desc:        "icmp unreachable",
+			r:           reply{proto: icmpProtoNum, from: net.ParseIP("10.0.0.254"), data: icmpReply(13, 3000, 80, 100)},
+			wantOK:      true,
+			wantVerdict: VerdictFiltered,
+		},
+		{
+			desc: "icmp unreachable for another probe",
+			r:    reply{proto: icmpProtoNum, from: net.ParseIP("10.0.0.254"), data: icmpReply(13, 3000, 80, 99)},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			verdict, _, ok := classifyTCP(probe, src, dest, 10)(&tc.r)
+			if ok != tc.wantOK || verdict != tc.wantVerdict {
+				t.Errorf("classifyTCP()(%+v) = %v, _, %t; want %v, _, %t", tc.r, verdict, ok, tc.wantVerdict, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestClassifyTCPICMPv6(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("2001:db8::1")
+	dest := net.ParseIP("2001:db8::2")
+	probe := &tcpPacket{srcPort: 3000, destPort: 80, seq: 100, flags: tcpFlags{syn: true}}
+
+	quoted := make([]byte, tcpHeaderSize)
+	probe.encode(quoted, src, dest, nil)
+	data := []byte{
+		icmpv6TypeDestUnreach, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x60, 0x00, 0x00, 0x00, 0x00, 0x14, tcpProtoNum, 0x40,
+	}
+	data = append(data, src...)
+	data = append(data, dest...)
+	data = append(data, quoted...)
+
+	r := &reply{proto: icmpv6ProtoNum, from: net.ParseIP("2001:db8::fe"), data: data}
+	verdict, reason, ok := classifyTCP(probe, src, dest, 0)(r)
+	if !ok || verdict != VerdictFiltered {
+		t.Errorf("classifyTCP()(%+v) = %v, %q, %t; want %v, _, true", r, verdict, reason, ok, VerdictFiltered)
+	}
+
+	// ICMPv4 type numbers do not apply to ICMPv6.
+	data[0] = icmpTypeDestUnreach
+	if _, _, ok := classifyTCP(probe, src, dest, 0)(r); ok {
+		t.Errorf("classifyTCP()(%+v) = _, _, true; want false", r)
+	}
+}
+
+func TestClassifyUDP(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.0.2")
+	probe := &udpPacket{srcPort: 3000, destPort: 53}
+
+	udpReply := func(u udpPacket) []byte {
+		pkt := make([]byte, udpHeaderSize)
+		u.encode(pkt, dest, src, nil)
+		return pkt
+	}
+	icmpReply := func(code byte, destPort uint16) []byte {
+		quoted := make([]byte, udpHeaderSize)
+		(&udpPacket{srcPort: 3000, destPort: destPort}).encode(quoted, src, dest, nil)
+		b := []byte{
+			icmpTypeDestUnreach, code, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x45, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00,
+			0x40, udpProtoNum, 0x00, 0x00,
+			10, 0, 0, 1,
+			10, 0, 0, 2,
+		}
+		return append(b, quoted...)
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		r           reply
+		wantOK      bool
+		wantVerdict Verdict
+	}{
+		{
+			desc:        "reply",
+			r:           reply{proto: udpProtoNum, from: dest, data: udpReply(udpPacket{srcPort: 53, destPort: 3000})},
+			wantOK:      true,
+			wantVerdict: VerdictOpen,
+		},
+		{
+			desc: "reply from another port",
+			r:    reply{proto: udpProtoNum, from: dest, data: udpReply(udpPacket{srcPort: 54, destPort: 3000})},
+		},
+		{
+			desc:        "port unreachable",
+			r:           reply{proto: icmpProtoNum, from: dest, data: icmpReply(icmpCodePortUnreach, 53)},
+			wantOK:      true,
+			wantVerdict: VerdictClosed,
+		},
+		{
+			desc:        "admin prohibited",
+			r:           reply{proto: icmpProtoNum, from: dest, data: icmpReply(13, 53)},
+			wantOK:      true,
+			wantVerdict: VerdictFiltered,
+		},
+		{
+			desc: "unreachable for another port",
+			r:    reply{proto: icmpProtoNum, from: dest, data: icmpReply(icmpCodePortUnreach, 54)},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			verdict, _, ok := classifyUDP(probe, src, dest)(&tc.r)
+			if ok != tc.wantOK || verdict != tc.wantVerdict {
+				t.Errorf("classifyUDP()(%+v) = %v, _, %t; want %v, _, %t", tc.r, verdict, ok, tc.wantVerdict, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestClassifyICMPEcho(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.0.2")
+	id := &Identity{Magic: "magic", ID: 1}
+	other := &Identity{Magic: "magic", ID: 2}
+	probe := newICMPEcho(dest, 7, 8)
+
+	echoReply := func(id, seq uint16, ident *Identity) []byte {
+		var data []byte
+		if ident != nil {
+			data, _ = ident.Encode()
+		}
+		pkt := make([]byte, icmpHeaderSize+len(data))
+		(&icmpEcho{typ: icmpTypeEchoReply, id: id, seq: seq}).encode(pkt, dest, src, data)
+		return pkt
+	}
+	request := make([]byte, icmpHeaderSize)
+	probe.encode(request, src, dest, nil)
+
+	for _, tc := range []struct {
+		desc        string
+		r           reply
+		wantOK      bool
+		wantVerdict Verdict
+	}{
+		{
+			desc:        "reply",
+			r:           reply{proto: icmpProtoNum, from: dest, data: echoReply(7, 8, id)},
+			wantOK:      true,
+			wantVerdict: VerdictOpen,
+		},
+		{
+			desc:        "reply without data",
+			r:           reply{proto: icmpProtoNum, from: dest, data: echoReply(7, 8, nil)},
+			wantOK:      true,
+			wantVerdict: VerdictOpen,
+		},
+		{
+			desc: "reply for another probe",
+			r:    reply{proto: icmpProtoNum, from: dest, data: echoReply(7, 8, other)},
+		},
+		{
+			desc: "reply with wrong sequence",
+			r:    reply{proto: icmpProtoNum, from: dest, data: echoReply(7, 9, id)},
+		},
+		{
+			desc: "our own request",
+			r:    reply{proto: icmpProtoNum, from: dest, data: request},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			verdict, _, ok := classifyICMPEcho(probe, src, dest, id)(&tc.r)
+			if ok != tc.wantOK || verdict != tc.wantVerdict {
+				t.Errorf("classifyICMPEcho()(%+v) = %v, _, %t; want %v, _, %t", tc.r, verdict, ok, tc.wantVerdict, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestClassifySCTP(t *testing.T) {
+	t.Parallel()
+
+	dest := net.ParseIP("10.0.0.2")
+	probe := &sctpPacket{srcPort: 3000, destPort: 80}
+	const tag = 0x1234
+
+	sctpReply := func(vtag uint32, chunk sctpChunk) []byte {
+		s := sctpPacket{srcPort: 80, destPort: 3000, verificationTag: vtag, chunks: []sctpChunk{chunk}}
+		pkt := make([]byte, s.len())
+		s.encode(pkt)
+		return pkt
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		r           reply
+		wantOK      bool
+		wantVerdict Verdict
+	}{
+		{
+			desc:        "init-ack",
+			r:           reply{proto: sctpProtoNum, from: dest, data: sctpReply(tag, sctpChunk{typ: sctpChunkInitAck, value: make([]byte, 16)})},
+			wantOK:      true,
+			wantVerdict: VerdictOpen,
+		},
+		{
+			desc:        "abort",
+			r:           reply{proto: sctpProtoNum, from: dest, data: sctpReply(tag, sctpChunk{typ: sctpChunkAbort})},
+			wantOK:      true,
+			wantVerdict: VerdictClosed,
+		},
+		{
+			desc:        "abort with reflected tag",
+			r:           reply{proto: sctpProtoNum, from: dest, data: sctpReply(0, sctpChunk{typ: sctpChunkAbort, flags: sctpChunkFlagT})},
+			wantOK:      true,
+			wantVerdict: VerdictClosed,
+		},
+		{
+			desc: "init-ack with wrong tag",
+			r:    reply{proto: sctpProtoNum, from: dest, data: sctpReply(tag+1, sctpChunk{typ: sctpChunkInitAck, value: make([]byte, 16)})},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			verdict, _, ok := classifySCTP(probe, dest, tag)(&tc.r)
+			if ok != tc.wantOK || verdict != tc.wantVerdict {
+				t.Errorf("classifySCTP()(%+v) = %v, _, %t; want %v, _, %t", tc.r, verdict, ok, tc.wantVerdict, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestStripIPv4Header(t *testing.T) {
+	t.Parallel()
+
+	ip := &ipv4Header{tos: 0x2e, ttl: 64, protocol: tcpProtoNum, src: net.ParseIP("10.0.0.2"), dest: net.ParseIP("10.0.0.1"), options: []byte{1, 1, 1, 0}}
+	payload := []byte("payload")
+	pkt := make([]byte, ip.headerLen()+len(payload))
+	ip.encode(pkt, payload)
+
+	for _, tc := range []struct {
+		desc        string
+		pkt         []byte
+		wantPayload string
+		wantTOS     uint8
+		wantOK      bool
+	}{
+		{desc: "with options", pkt: pkt, wantPayload: "payload", wantTOS: 0x2e, wantOK: true},
+		{desc: "truncated", pkt: pkt[:ipv4MinHeaderSize+2]},
+		{desc: "ipv6", pkt: append([]byte{0x60}, pkt[1:]...)},
+	} {
+		payload, tos, ok := stripIPv4Header(tc.pkt)
+		if string(payload) != tc.wantPayload || tos != tc.wantTOS || ok != tc.wantOK {
+			t.Errorf("%s: stripIPv4Header() = %q, %#x, %t; want %q, %#x, %t", tc.desc, payload, tos, ok, tc.wantPayload, tc.wantTOS, tc.wantOK)
+		}
+	}
+}
+
+func TestIsICMPReadError(t *testing.T) {
+	t.Parallel()
+
+	readErr := func(err error) error {
+		return &net.OpError{Op: "read", Net: "ip4", Err: os.NewSyscallError("recvmsg", err)}
+	}
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{err: readErr(syscall.ECONNREFUSED), want: true},
+		{err: readErr(syscall.EHOSTUNREACH), want: true},
+		{err: readErr(syscall.ENETUNREACH), want: true},
+		{err: readErr(syscall.EMSGSIZE), want: true},
+		{err: readErr(syscall.EBADF)},
+		{err: readErr(syscall.ENOMEM)},
+		{err: &net.OpError{Op: "read", Net: "ip4", Err: errors.New("use of closed network connection")}},
+		{err: errors.New("other")},
+	} {
+		if got := isICMPReadError(tc.err); got != tc.want {
+			t.Errorf("isICMPReadError(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/bowei/lighthouse/pkg/flags"
+	"github.com/golang/glog"
+)
+
+var (
+	// rstFiltersMu protects rstFilters and the installed field of each
+	// filter.
+	rstFiltersMu sync.Mutex
+	// rstFilters are the installed filters, for RemoveRSTFilters.
+	rstFilters = map[*rstFilter]bool{}
+)
+
+// RemoveRSTFilters removes the iptables rules installed for handshakes that
+// are still running, e.g. when the process is interrupted.
+func RemoveRSTFilters() {
+	rstFiltersMu.Lock()
+	var filters []*rstFilter
+	for f := range rstFilters {
+		filters = append(filters, f)
+	}
+	rstFiltersMu.Unlock()
+	for _, f := range filters {
+		f.remove()
+	}
+}
+
+// rstFilter drops the RSTs the kernel sends for a TCP connection it does
+// not know about. Without it, the kernel resets connections that we open
+// from userspace as soon as the SYN-ACK arrives.
+type rstFilter struct {
+	executable string
+	rule       []string
+	installed  bool
+}
+
+// newRSTFilter installs an iptables rule dropping outgoing RSTs from
+// src:srcPort to dest:destPort.
+func newRSTFilter(src, dest net.IP, srcPort, destPort int) (*rstFilter, error) {
+	f := &rstFilter{
+		executable: flags.IPTablesExecutable,
+		rule: []string{
+			"OUTPUT",
+			"-p", "tcp",
+			"-s", src.String(), "--sport", fmt.Sprintf("%d", srcPort),
+			"-d", dest.String(), "--dport", fmt.Sprintf("%d", destPort),
+			"--tcp-flags", "RST", "RST",
+			"-j", "DROP",
+		},
+	}
+	if dest.To4() == nil {
+		f.executable = flags.IP6TablesExecutable
+	}
+	rstFiltersMu.Lock()
+	defer rstFiltersMu.Unlock()
+	if err := f.run("-I"); err != nil {
+		return nil, fmt.Errorf("cannot install rule to drop kernel RSTs: %v", err)
+	}
+	f.installed = true
+	rstFilters[f] = true
+	return f, nil
+}
+
+// remove the rule. It is safe to call remove more than once, concurrently.
+func (f *rstFilter) remove() {
+	rstFiltersMu.Lock()
+	defer rstFiltersMu.Unlock()
+	if !f.installed {
+		return
+	}
+	if err := f.run("-D"); err != nil {
+		glog.Errorf("Error removing RST filter: %v", err)
+		return
+	}
+	f.installed = false
+	delete(rstFilters, f)
+}
+
+func (f *rstFilter) run(op string) error {
+	args := append([]string{"-w", op}, f.rule...)
+	cmd := exec.Command(f.executable, args...)
+	glog.V(4).Infof("%s %s", f.executable, strings.Join(args, " "))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v (%s)", f.executable, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
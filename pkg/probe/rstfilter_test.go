@@ -0,0 +1,62 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bowei/lighthouse/pkg/flags"
+)
+
+func TestRemoveRSTFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptables")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	executable := filepath.Join(dir, "iptables")
+	if err := ioutil.WriteFile(executable, []byte("#!/bin/sh\necho $2 >> "+log+"\n"), 0755); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	saved := flags.IPTablesExecutable
+	flags.IPTablesExecutable = executable
+	defer func() { flags.IPTablesExecutable = saved }()
+
+	f, err := newRSTFilter(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 3000, 80)
+	if err != nil {
+		t.Fatalf("newRSTFilter() = _, %v; want nil", err)
+	}
+	RemoveRSTFilters()
+	// Removing the filter again, as the handshake does when it returns,
+	// does nothing.
+	f.remove()
+	RemoveRSTFilters()
+
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("ReadFile() = _, %v", err)
+	}
+	if got, want := strings.Fields(string(b)), []string{"-I", "-D"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("iptables ops = %q; want %q", got, want)
+	}
+}
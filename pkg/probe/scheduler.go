@@ -0,0 +1,264 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultSchedulerWorkers = 16
+	defaultSchedulerBackoff = 100 * time.Millisecond
+)
+
+// SendFunc sends a single probe, e.g. SendTCP.
+type SendFunc func(src string, srcPort int, dest string, destPort int, magic string, opt *Options) (*Result, error)
+
+// Job is a single probe for a Scheduler to send.
+type Job struct {
+	Src     string
+	SrcPort int
+	Dest    string
+	Port    int
+	Magic   string
+	// Timeout is the time to wait for a reply to each attempt. The
+	// Options.Timeout of the Scheduler is used if zero.
+	Timeout time.Duration
+}
+
+// JobResult is the outcome of a Job.
+type JobResult struct {
+	Job Job
+	// Result of the last attempt. This is nil if the last attempt failed
+	// with an error.
+	Result *Result
+	Err    error
+	// Attempts is the number of times the probe was sent.
+	Attempts int
+	// Timeouts is the number of attempts that got no reply.
+	Timeouts int
+	// Start is the time the first attempt was sent and Elapsed the time
+	// until the last attempt completed, including rate limiting and
+	// backoff.
+	Start   time.Time
+	Elapsed time.Duration
+}
+
+// SchedulerOptions configures a Scheduler. The zero value sends with the
+// default number of workers, no rate limits and no retries.
+type SchedulerOptions struct {
+	// Workers is the number of probes in flight at once.
+	Workers int
+	// Rate is the maximum number of probes per second across all
+	// destinations. Zero for no limit.
+	Rate float64
+	// PerDestRate is the maximum number of probes per second to each
+	// destination address. Zero for no limit.
+	PerDestRate float64
+	// PerDestInFlight is the maximum number of probes in flight to each
+	// destination address. Zero for no limit.
+	PerDestInFlight int
+	// Retries is the number of times a probe is resent after it timed out
+	// without a reply or could not be sent (send returned an error).
+	// Probes that got any reply are not resent.
+	Retries int
+	// Backoff is the delay before the first retry. It doubles with each
+	// retry. Defaults to 100ms.
+	Backoff time.Duration
+	// Shuffle sends the jobs in a random order, so that the probes to a
+	// block of addresses are spread out over time.
+	Shuffle bool
+}
+
+// Scheduler sends many probes concurrently, within global and
+// per-destination rate limits.
+type Scheduler struct {
+	send  SendFunc
+	opt   *Options
+	sched SchedulerOptions
+
+	rate    *pacer
+	mu      sync.Mutex
+	dests   map[string]*destLimit
+	shuffle func(n int, swap func(i, j int))
+	sleep   func(time.Duration)
+}
+
+// destLimit holds the limits for a single destination.
+type destLimit struct {
+	rate     *pacer
+	inFlight chan struct{}
+}
+
+// NewScheduler returns a Scheduler that sends probes with send and opt.
+func NewScheduler(send SendFunc, opt *Options, sched SchedulerOptions) *Scheduler {
+	if sched.Workers <= 0 {
+		sched.Workers = defaultSchedulerWorkers
+	}
+	if sched.Backoff <= 0 {
+		sched.Backoff = defaultSchedulerBackoff
+	}
+	if opt == nil {
+		opt = &Options{}
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &Scheduler{
+		send:    send,
+		opt:     opt,
+		sched:   sched,
+		rate:    newPacer(sched.Rate),
+		dests:   map[string]*destLimit{},
+		shuffle: r.Shuffle,
+		sleep:   time.Sleep,
+	}
+}
+
+// Run sends all of the jobs and returns their results, in the same order
+// as jobs.
+func (s *Scheduler) Run(jobs []Job) []JobResult {
+	order := make([]int, len(jobs))
+	for i := range order {
+		order[i] = i
+	}
+	if s.sched.Shuffle {
+		s.shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+
+	results := make([]JobResult, len(jobs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < s.sched.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = s.runJob(jobs[i])
+			}
+		}()
+	}
+	for _, i := range order {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return results
+}
+
+// runJob sends the job, retrying after errors and timeouts.
+func (s *Scheduler) runJob(job Job) JobResult {
+	opt := *s.opt
+	if job.Timeout > 0 {
+		opt.Timeout = job.Timeout
+	}
+	limit := s.destLimit(job.Dest)
+
+	jr := JobResult{Job: job}
+	backoff := s.sched.Backoff
+	for {
+		if jr.Attempts > 0 {
+			s.sleep(backoff)
+			backoff *= 2
+		}
+		if limit.inFlight != nil {
+			limit.inFlight <- struct{}{}
+		}
+		limit.rate.wait()
+		s.rate.wait()
+		if jr.Attempts == 0 {
+			jr.Start = time.Now()
+		}
+		jr.Attempts++
+		jr.Result, jr.Err = s.send(job.Src, job.SrcPort, job.Dest, job.Port, job.Magic, &opt)
+		if limit.inFlight != nil {
+			<-limit.inFlight
+		}
+		glog.V(2).Infof("send(%s:%d) attempt %d = %v, %v", job.Dest, job.Port, jr.Attempts, jr.Result, jr.Err)
+
+		if jr.Err == nil && jr.Result.TimedOut() {
+			jr.Timeouts++
+		} else if jr.Err == nil {
+			break
+		}
+		if jr.Attempts > s.sched.Retries {
+			break
+		}
+	}
+	jr.Elapsed = time.Since(jr.Start)
+	return jr
+}
+
+// destLimit returns the limits for dest, creating them on first use.
+func (s *Scheduler) destLimit(dest string) *destLimit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.dests[dest]; ok {
+		return l
+	}
+	l := &destLimit{rate: newPacer(s.sched.PerDestRate)}
+	if s.sched.PerDestInFlight > 0 {
+		l.inFlight = make(chan struct{}, s.sched.PerDestInFlight)
+	}
+	s.dests[dest] = l
+	return l
+}
+
+// pacer spaces events evenly at a fixed rate. A nil pacer does not limit
+// the rate.
+type pacer struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	next  time.Time
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// newPacer returns a pacer for rate events per second, or nil if rate is
+// not positive.
+func newPacer(rate float64) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacer{
+		interval: time.Duration(float64(time.Second) / rate),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// wait until the next event is allowed.
+func (p *pacer) wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	now := p.now()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(p.interval)
+	p.mu.Unlock()
+
+	if d := at.Sub(now); d > 0 {
+		p.sleep(d)
+	}
+}
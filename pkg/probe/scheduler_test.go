@@ -0,0 +1,285 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSender records the probes sent and replies with the next of its
+// results for each destination.
+type fakeSender struct {
+	mu       sync.Mutex
+	sent     []string
+	timeouts []time.Duration
+	replies  map[string][]*Result
+	errs     map[string][]error
+	inFlight map[string]int
+	maxIn    map[string]int
+	delay    time.Duration
+}
+
+func newFakeSender() *fakeSender {
+	return &fakeSender{
+		replies:  map[string][]*Result{},
+		errs:     map[string][]error{},
+		inFlight: map[string]int{},
+		maxIn:    map[string]int{},
+	}
+}
+
+func (f *fakeSender) send(src string, srcPort int, dest string, destPort int, magic string, opt *Options) (*Result, error) {
+	f.mu.Lock()
+	f.sent = append(f.sent, fmt.Sprintf("%s:%d", dest, destPort))
+	f.timeouts = append(f.timeouts, opt.Timeout)
+	f.inFlight[dest]++
+	if f.inFlight[dest] > f.maxIn[dest] {
+		f.maxIn[dest] = f.inFlight[dest]
+	}
+	f.mu.Unlock()
+
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight[dest]--
+	if errs := f.errs[dest]; len(errs) > 0 {
+		f.errs[dest] = errs[1:]
+		if errs[0] != nil {
+			return nil, errs[0]
+		}
+	}
+	if replies := f.replies[dest]; len(replies) > 0 {
+		f.replies[dest] = replies[1:]
+		return replies[0], nil
+	}
+	return &Result{Verdict: VerdictOpen, Reason: "syn-ack", From: []byte{1, 2, 3, 4}}, nil
+}
+
+func timeoutResult() *Result {
+	return &Result{Verdict: VerdictFiltered, Reason: reasonTimeout}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	t.Parallel()
+
+	var jobs []Job
+	for i := 0; i < 20; i++ {
+		jobs = append(jobs, Job{Dest: fmt.Sprintf("10.0.0.%d", i), Port: 80})
+	}
+
+	for _, shuffle := range []bool{false, true} {
+		f := newFakeSender()
+		s := NewScheduler(f.send, &Options{Timeout: time.Second}, SchedulerOptions{Workers: 1, Shuffle: shuffle})
+		// Reverse instead of shuffling so the order is predictable.
+		s.shuffle = func(n int, swap func(i, j int)) {
+			for i := 0; i < n/2; i++ {
+				swap(i, n-1-i)
+			}
+		}
+		results := s.Run(jobs)
+
+		if len(results) != len(jobs) {
+			t.Fatalf("shuffle=%t: got %d results; want %d", shuffle, len(results), len(jobs))
+		}
+		for i, r := range results {
+			if r.Job != jobs[i] || r.Attempts != 1 || r.Err != nil || r.Result.Verdict != VerdictOpen {
+				t.Errorf("shuffle=%t: results[%d] = %+v; want open result for %+v", shuffle, i, r, jobs[i])
+			}
+		}
+		first, last := "10.0.0.0:80", "10.0.0.19:80"
+		if shuffle {
+			first, last = last, first
+		}
+		if f.sent[0] != first || f.sent[len(f.sent)-1] != last {
+			t.Errorf("shuffle=%t: sent %v; want %s first and %s last", shuffle, f.sent, first, last)
+		}
+	}
+}
+
+func TestSchedulerRetries(t *testing.T) {
+	t.Parallel()
+
+	errSend := errors.New("send failed")
+	for _, tc := range []struct {
+		desc         string
+		retries      int
+		replies      []*Result
+		errs         []error
+		wantAttempts int
+		wantTimeouts int
+		wantVerdict  Verdict
+		wantErr      bool
+		wantBackoff  []time.Duration
+	}{
+		{
+			desc:         "no retries",
+			replies:      []*Result{timeoutResult()},
+			wantAttempts: 1,
+			wantTimeouts: 1,
+			wantVerdict:  VerdictFiltered,
+		},
+		{
+			desc:         "timeouts then reply",
+			retries:      3,
+			replies:      []*Result{timeoutResult(), timeoutResult()},
+			wantAttempts: 3,
+			wantTimeouts: 2,
+			wantVerdict:  VerdictOpen,
+			wantBackoff:  []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+		},
+		{
+			desc:         "out of retries",
+			retries:      1,
+			replies:      []*Result{timeoutResult(), timeoutResult(), timeoutResult()},
+			wantAttempts: 2,
+			wantTimeouts: 2,
+			wantVerdict:  VerdictFiltered,
+			wantBackoff:  []time.Duration{100 * time.Millisecond},
+		},
+		{
+			desc:         "error then reply",
+			retries:      2,
+			errs:         []error{errSend},
+			wantAttempts: 2,
+			wantVerdict:  VerdictOpen,
+			wantBackoff:  []time.Duration{100 * time.Millisecond},
+		},
+		{
+			desc:         "errors",
+			retries:      1,
+			errs:         []error{errSend, errSend},
+			wantAttempts: 2,
+			wantErr:      true,
+			wantBackoff:  []time.Duration{100 * time.Millisecond},
+		},
+		{
+			desc:         "closed is not retried",
+			retries:      2,
+			replies:      []*Result{{Verdict: VerdictClosed, Reason: "rst", From: []byte{1, 2, 3, 4}}},
+			wantAttempts: 1,
+			wantVerdict:  VerdictClosed,
+		},
+	} {
+		f := newFakeSender()
+		f.replies["10.0.0.1"] = tc.replies
+		f.errs["10.0.0.1"] = tc.errs
+		s := NewScheduler(f.send, nil, SchedulerOptions{Retries: tc.retries})
+		var backoff []time.Duration
+		s.sleep = func(d time.Duration) { backoff = append(backoff, d) }
+
+		r := s.Run([]Job{{Dest: "10.0.0.1", Port: 80}})[0]
+		if r.Attempts != tc.wantAttempts || r.Timeouts != tc.wantTimeouts {
+			t.Errorf("%s: attempts, timeouts = %d, %d; want %d, %d", tc.desc, r.Attempts, r.Timeouts, tc.wantAttempts, tc.wantTimeouts)
+		}
+		if gotErr := r.Err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: err = %v; want error %t", tc.desc, r.Err, tc.wantErr)
+		} else if !tc.wantErr && r.Result.Verdict != tc.wantVerdict {
+			t.Errorf("%s: verdict = %v; want %v", tc.desc, r.Result.Verdict, tc.wantVerdict)
+		}
+		if !reflect.DeepEqual(backoff, tc.wantBackoff) {
+			t.Errorf("%s: backoff = %v; want %v", tc.desc, backoff, tc.wantBackoff)
+		}
+	}
+}
+
+func TestSchedulerTimeout(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeSender()
+	s := NewScheduler(f.send, &Options{Timeout: time.Second}, SchedulerOptions{Workers: 1})
+	s.Run([]Job{{Dest: "10.0.0.1"}, {Dest: "10.0.0.2", Timeout: 5 * time.Second}})
+
+	want := []time.Duration{time.Second, 5 * time.Second}
+	if !reflect.DeepEqual(f.timeouts, want) {
+		t.Errorf("timeouts = %v; want %v", f.timeouts, want)
+	}
+}
+
+func TestSchedulerPerDestInFlight(t *testing.T) {
+	t.Parallel()
+
+	var jobs []Job
+	for i := 0; i < 8; i++ {
+		jobs = append(jobs, Job{Dest: "10.0.0.1", Port: 80 + i}, Job{Dest: "10.0.0.2", Port: 80 + i})
+	}
+	f := newFakeSender()
+	f.delay = 5 * time.Millisecond
+	s := NewScheduler(f.send, nil, SchedulerOptions{Workers: 8, PerDestInFlight: 2})
+	s.Run(jobs)
+
+	for _, dest := range []string{"10.0.0.1", "10.0.0.2"} {
+		if f.maxIn[dest] > 2 {
+			t.Errorf("%s had %d probes in flight; want at most 2", dest, f.maxIn[dest])
+		}
+	}
+	if len(f.sent) != len(jobs) {
+		t.Errorf("sent %d probes; want %d", len(f.sent), len(jobs))
+	}
+}
+
+func TestSchedulerRate(t *testing.T) {
+	t.Parallel()
+
+	var jobs []Job
+	for i := 0; i < 5; i++ {
+		jobs = append(jobs, Job{Dest: fmt.Sprintf("10.0.0.%d", i)})
+	}
+	f := newFakeSender()
+	s := NewScheduler(f.send, nil, SchedulerOptions{Workers: 5, Rate: 100})
+	start := time.Now()
+	s.Run(jobs)
+	// The first probe is sent immediately and the rest 10ms apart.
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("5 probes at 100/s took %v; want at least 40ms", elapsed)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	t.Parallel()
+
+	if p := newPacer(0); p != nil {
+		t.Errorf("newPacer(0) = %v; want nil", p)
+	}
+	// A nil pacer does not block.
+	var nilPacer *pacer
+	nilPacer.wait()
+
+	now := time.Unix(1000, 0)
+	var slept []time.Duration
+	p := newPacer(10)
+	p.now = func() time.Time { return now }
+	p.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	for i := 0; i < 3; i++ {
+		p.wait()
+	}
+	// After a pause, the next event is not delayed.
+	now = now.Add(time.Second)
+	p.wait()
+	p.wait()
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 100 * time.Millisecond}
+	if !reflect.DeepEqual(slept, want) {
+		t.Errorf("slept %v; want %v", slept, want)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	sctpProtoNum         = 132
+	sctpCommonHeaderSize = 12
+	sctpChunkHeaderSize  = 4
+	sctpInitValueSize    = 16
+
+	sctpChunkInit    = 1
+	sctpChunkInitAck = 2
+	sctpChunkAbort   = 6
+
+	// sctpParamProbeIdentity carries the probe identity in an INIT chunk.
+	// The two high bits (10) tell the receiver to skip the parameter
+	// without reporting it (RFC 4960 section 3.2.1).
+	sctpParamProbeIdentity = 0x8c48
+	sctpParamHeaderSize    = 4
+
+	// sctpChunkFlagT is the T bit in an ABORT chunk, which is set when the
+	// verification tag is reflected.
+	sctpChunkFlagT = 1
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type sctpChunk struct {
+	typ   uint8
+	flags uint8
+	// value is the chunk value without padding.
+	value []byte
+}
+
+type sctpPacket struct {
+	srcPort         uint16 // 0
+	destPort        uint16 // 2
+	verificationTag uint32 // 4
+	checksum        uint32 // 8 (only set by decode)
+	chunks          []sctpChunk
+}
+
+// newSCTPInit returns an INIT chunk. The identity is added as a parameter
+// that the receiver will skip. As it is the last parameter, its padding is
+// left to the chunk padding so that it is not counted in the chunk length
+// (RFC 4960 section 3.2).
+func newSCTPInit(initiateTag, initialTSN uint32, identity []byte) sctpChunk {
+	encoder := binary.BigEndian
+	paramLen := sctpParamHeaderSize + len(identity)
+	value := make([]byte, sctpInitValueSize+paramLen)
+	encoder.PutUint32(value, initiateTag)
+	encoder.PutUint32(value[4:], 65535) // a_rwnd
+	encoder.PutUint16(value[8:], 1)     // Outbound streams.
+	encoder.PutUint16(value[10:], 1)    // Inbound streams.
+	encoder.PutUint32(value[12:], initialTSN)
+	encoder.PutUint16(value[16:], sctpParamProbeIdentity)
+	encoder.PutUint16(value[18:], uint16(paramLen))
+	copy(value[20:], identity)
+
+	return sctpChunk{typ: sctpChunkInit, value: value}
+}
+
+// len is the length of the encoded packet.
+func (s *sctpPacket) len() int {
+	n := sctpCommonHeaderSize
+	for _, c := range s.chunks {
+		n += (sctpChunkHeaderSize + len(c.value) + 3) / 4 * 4
+	}
+	return n
+}
+
+func (s *sctpPacket) encode(pkt []byte) int {
+	encoder := binary.BigEndian
+	encoder.PutUint16(pkt, s.srcPort)
+	encoder.PutUint16(pkt[2:], s.destPort)
+	encoder.PutUint32(pkt[4:], s.verificationTag)
+	encoder.PutUint32(pkt[8:], 0)
+
+	n := sctpCommonHeaderSize
+	for _, c := range s.chunks {
+		chunkLen := sctpChunkHeaderSize + len(c.value)
+		pkt[n] = c.typ
+		pkt[n+1] = c.flags
+		encoder.PutUint16(pkt[n+2:], uint16(chunkLen))
+		copy(pkt[n+sctpChunkHeaderSize:], c.value)
+		n += chunkLen
+		// Chunks are padded to 4 bytes.
+		for ; chunkLen%4 != 0; chunkLen++ {
+			pkt[n] = 0
+			n++
+		}
+	}
+
+	// The CRC32c is stored in little endian byte order (RFC 4960
+	// appendix B).
+	binary.LittleEndian.PutUint32(pkt[8:], crc32.Checksum(pkt[:n], crc32c))
+
+	return n
+}
+
+// decode the packet from pkt. ErrBadChecksum is returned if the checksum is
+// invalid but the packet is still decoded.
+func (s *sctpPacket) decode(pkt []byte) error {
+	if len(pkt) < sctpCommonHeaderSize {
+		return ErrTruncated
+	}
+
+	decoder := binary.BigEndian
+	s.srcPort = decoder.Uint16(pkt)
+	s.destPort = decoder.Uint16(pkt[2:])
+	s.verificationTag = decoder.Uint32(pkt[4:])
+	s.checksum = binary.LittleEndian.Uint32(pkt[8:])
+	s.chunks = nil
+
+	for n := sctpCommonHeaderSize; n < len(pkt); {
+		if len(pkt)-n < sctpChunkHeaderSize {
+			return ErrTruncated
+		}
+		chunkLen := int(decoder.Uint16(pkt[n+2:]))
+		if chunkLen < sctpChunkHeaderSize {
+			return fmt.Errorf("invalid SCTP chunk length %d", chunkLen)
+		}
+		if len(pkt)-n < chunkLen {
+			return ErrTruncated
+		}
+		s.chunks = append(s.chunks, sctpChunk{
+			typ:   pkt[n],
+			flags: pkt[n+1],
+			value: append([]byte{}, pkt[n+sctpChunkHeaderSize:n+chunkLen]...),
+		})
+		n += (chunkLen + 3) / 4 * 4
+	}
+
+	chk := make([]byte, len(pkt))
+	copy(chk, pkt)
+	binary.LittleEndian.PutUint32(chk[8:], 0)
+	if crc32.Checksum(chk, crc32c) != s.checksum {
+		return ErrBadChecksum
+	}
+	return nil
+}
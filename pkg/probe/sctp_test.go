@@ -0,0 +1,122 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestSCTPEncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	identity := []byte{
+		'L', 'H', 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	sctp := sctpPacket{
+		srcPort:  3000,
+		destPort: 80,
+		chunks:   []sctpChunk{newSCTPInit(0x01020304, 0x05060708, identity)},
+	}
+	want := []byte{
+		0x0b, 0xb8, 0x00, 0x50, 0x00, 0x00, 0x00, 0x00, // Ports and verification tag.
+		0x66, 0x19, 0xf3, 0x78, // CRC32c.
+		0x01, 0x00, 0x00, 0x30, // INIT chunk.
+		0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0xff, 0xff,
+		0x00, 0x01, 0x00, 0x01, 0x05, 0x06, 0x07, 0x08,
+		0x8c, 0x48, 0x00, 0x1c, // Identity parameter.
+		'L', 'H', 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+
+	pkt := make([]byte, sctp.len())
+	n := sctp.encode(pkt)
+	if !reflect.DeepEqual(pkt[:n], want) {
+		t.Errorf("sctp.encode() = %v, want %v", pkt[:n], want)
+	}
+
+	var got sctpPacket
+	if err := got.decode(pkt[:n]); err != nil {
+		t.Fatalf("decode(%v) = %v, want nil", pkt[:n], err)
+	}
+	got.checksum = 0
+	if !reflect.DeepEqual(got, sctp) {
+		t.Errorf("decode(%v) = %+v, want %+v", pkt[:n], got, sctp)
+	}
+	if id, err := FindIdentity(got.chunks[0].value); err != nil || id.ID != 0 {
+		t.Errorf("FindIdentity(%v) = %v, %v; want identity", got.chunks[0].value, id, err)
+	}
+
+	pkt[20]++
+	if err := got.decode(pkt[:n]); err != ErrBadChecksum {
+		t.Errorf("decode(%v) = %v, want %v", pkt[:n], err, ErrBadChecksum)
+	}
+	if err := got.decode(pkt[:n-1]); err != ErrTruncated {
+		t.Errorf("decode(%v) = %v, want %v", pkt[:n-1], err, ErrTruncated)
+	}
+}
+
+func TestSCTPPadding(t *testing.T) {
+	t.Parallel()
+
+	sctp := sctpPacket{
+		chunks: []sctpChunk{
+			{typ: sctpChunkAbort, flags: sctpChunkFlagT, value: []byte{0x01}},
+			{typ: sctpChunkInitAck, value: []byte{0x02, 0x03, 0x04, 0x05}},
+		},
+	}
+	pkt := make([]byte, sctp.len())
+	if n := sctp.encode(pkt); n != sctpCommonHeaderSize+8+8 {
+		t.Errorf("sctp.encode() = %d, want %d", n, sctpCommonHeaderSize+8+8)
+	}
+	var got sctpPacket
+	if err := got.decode(pkt); err != nil {
+		t.Fatalf("decode(%v) = %v, want nil", pkt, err)
+	}
+	if !reflect.DeepEqual(got.chunks, sctp.chunks) {
+		t.Errorf("decode(%v).chunks = %+v, want %+v", pkt, got.chunks, sctp.chunks)
+	}
+}
+
+func TestSCTPInitLength(t *testing.T) {
+	t.Parallel()
+
+	// The padding of the identity parameter, the last in the chunk, is
+	// not counted in the chunk length.
+	identity := []byte{1, 2, 3, 4, 5}
+	sctp := sctpPacket{chunks: []sctpChunk{newSCTPInit(1, 2, identity)}}
+	pkt := make([]byte, sctp.len())
+	n := sctp.encode(pkt)
+	wantChunkLen := sctpChunkHeaderSize + sctpInitValueSize + sctpParamHeaderSize + len(identity)
+	if got := int(binary.BigEndian.Uint16(pkt[sctpCommonHeaderSize+2:])); got != wantChunkLen {
+		t.Errorf("chunk length = %d, want %d", got, wantChunkLen)
+	}
+	if want := sctpCommonHeaderSize + (wantChunkLen+3)/4*4; n != want {
+		t.Errorf("sctp.encode() = %d, want %d", n, want)
+	}
+	var got sctpPacket
+	if err := got.decode(pkt[:n]); err != nil {
+		t.Fatalf("decode(%v) = %v, want nil", pkt[:n], err)
+	}
+	if !reflect.DeepEqual(got.chunks, sctp.chunks) {
+		t.Errorf("decode(%v).chunks = %+v, want %+v", pkt[:n], got.chunks, sctp.chunks)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// portRangeFile contains the local ephemeral port range.
+	portRangeFile = "/proc/sys/net/ipv4/ip_local_port_range"
+	// socketTables lists the sockets in use for each protocol.
+	socketTables = map[int][]string{
+		tcpProtoNum: {"/proc/net/tcp", "/proc/net/tcp6"},
+		udpProtoNum: {"/proc/net/udp", "/proc/net/udp6"},
+		// SCTP ports are in use by endpoints (listening or not) and
+		// associations.
+		sctpProtoNum: {"/proc/net/sctp/eps", "/proc/net/sctp/assocs"},
+	}
+)
+
+const (
+	defaultPortRangeLow  = 32768
+	defaultPortRangeHigh = 60999
+	maxPortAttempts      = 100
+)
+
+// SourceFor returns the local address the kernel would use to send to
+// dest, based on the routing table.
+func SourceFor(dest net.IP) (net.IP, error) {
+	// Connecting a UDP socket does a route lookup without sending anything.
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dest, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// EphemeralPort returns a random port from the local ephemeral port range
+// that is not in use by a local socket of the given protocol (e.g. 6 for
+// TCP). For protocols other than TCP, UDP and SCTP, ports in use by TCP or
+// UDP are avoided.
+func EphemeralPort(proto int) (int, error) {
+	low, high := localPortRange()
+	inUse, err := portsInUse(proto)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < maxPortAttempts; i++ {
+		port, err := randomInt(high - low + 1)
+		if err != nil {
+			return 0, err
+		}
+		port += low
+		if !inUse[port] {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port in range %d-%d after %d attempts", low, high, maxPortAttempts)
+}
+
+// sourcePort returns port, or an ephemeral port if it is zero.
+func sourcePort(port int, proto int) (int, error) {
+	if port != 0 {
+		return port, nil
+	}
+	port, err := EphemeralPort(proto)
+	glog.V(2).Infof("EphemeralPort(%d) = %d, %v", proto, port, err)
+	return port, err
+}
+
+// localPortRange returns the ephemeral port range configured in the kernel.
+func localPortRange() (int, int) {
+	b, err := ioutil.ReadFile(portRangeFile)
+	if err != nil {
+		glog.V(4).Infof("Using default port range: %v", err)
+		return defaultPortRangeLow, defaultPortRangeHigh
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return defaultPortRangeLow, defaultPortRangeHigh
+	}
+	low, err1 := strconv.Atoi(fields[0])
+	high, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || low <= 0 || high < low || high > 0xffff {
+		return defaultPortRangeLow, defaultPortRangeHigh
+	}
+	return low, high
+}
+
+// portsInUse returns the local ports of the sockets for the protocol.
+func portsInUse(proto int) (map[int]bool, error) {
+	files, ok := socketTables[proto]
+	if !ok {
+		files = append(append([]string{}, socketTables[tcpProtoNum]...), socketTables[udpProtoNum]...)
+	}
+	ports := map[int]bool{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			// e.g. IPv6 is disabled, or the SCTP module is not
+			// loaded (so there are no SCTP sockets).
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if proto == sctpProtoNum {
+			err = parseSCTPSocketTable(f, ports)
+		} else {
+			err = parseSocketTable(f, ports)
+		}
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return ports, nil
+}
+
+// parseSocketTable adds the local ports in a /proc/net/{tcp,udp}[6] file to
+// ports.
+func parseSocketTable(r io.Reader, ports map[int]bool) error {
+	scanner := bufio.NewScanner(r)
+	// Skip the header.
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		// local_address is <hex address>:<hex port>.
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			return fmt.Errorf("invalid local address %q", fields[1])
+		}
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			return fmt.Errorf("invalid local address %q: %v", fields[1], err)
+		}
+		ports[int(port)] = true
+	}
+	return scanner.Err()
+}
+
+// parseSCTPSocketTable adds the local ports in /proc/net/sctp/eps or
+// /proc/net/sctp/assocs to ports. The port is in decimal, in the LPORT
+// column.
+func parseSCTPSocketTable(r io.Reader, ports map[int]bool) error {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return scanner.Err()
+	}
+	column := -1
+	for i, name := range strings.Fields(scanner.Text()) {
+		if name == "LPORT" {
+			column = i
+		}
+	}
+	if column < 0 {
+		return fmt.Errorf("no LPORT column in header %q", scanner.Text())
+	}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= column {
+			continue
+		}
+		port, err := strconv.ParseUint(fields[column], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid local port %q: %v", fields[column], err)
+		}
+		ports[int(port)] = true
+	}
+	return scanner.Err()
+}
+
+// randomInt returns a random number in [0, n).
+func randomInt(n int) (int, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(b[:]) % uint32(n)), nil
+}
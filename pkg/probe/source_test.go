@@ -0,0 +1,104 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSocketTable(t *testing.T) {
+	t.Parallel()
+
+	const table = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:07E8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 662 1 0000000078210fe0 100 0 0 10 0
+   1: 0100007F:BC8F 00000000:0000 0A 00000000:00000000 00:00000000 00000000 65534        0 913 1 0000000073a6fd31 100 0 0 10 0
+   2: 00000000000000000000000001000000:1FA2 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21925 1 00000000aca8d5d5 100 0 0 10 0
+`
+	ports := map[int]bool{}
+	if err := parseSocketTable(strings.NewReader(table), ports); err != nil {
+		t.Fatalf("parseSocketTable() = %v, want nil", err)
+	}
+	want := map[int]bool{2024: true, 48271: true, 8098: true}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("parseSocketTable() = %v, want %v", ports, want)
+	}
+
+	bad := "header\n 0: 0100007F:XYZ 00000000:0000\n"
+	if err := parseSocketTable(strings.NewReader(bad), map[int]bool{}); err == nil {
+		t.Errorf("parseSocketTable(%q) = nil, want error", bad)
+	}
+}
+
+func TestParseSCTPSocketTable(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc  string
+		table string
+		want  map[int]bool
+	}{
+		{
+			desc: "eps",
+			table: ` ENDPT     SOCK   STY SST HBKT LPORT   UID INODE LADDRS
+ffff8f1e8b2ba000 ffff8f1e87f3c000 10  10  20   9899      0 40567 10.0.0.1 127.0.0.1
+ffff8f1e8b2bb000 ffff8f1e87f3d000 1   10  21   36412     0 40570 ::1
+`,
+			want: map[int]bool{9899: true, 36412: true},
+		},
+		{
+			desc: "assocs",
+			table: ` ASSOC     SOCK   STY SST ST HBKT ASSOC-ID TX_QUEUE RX_QUEUE UID INODE LPORT RPORT LADDRS <-> RADDRS HBINT INS OUTS MAXRT T1X T2X RTXC wmema wmemq sndbuf rcvbuf
+ffff8f1e8c1e2000 ffff8f1e87f3e000 2   1   3  0       2        0        0     0 40571 36413  9899  127.0.0.1 <-> *127.0.0.1 	    7500    10    10   10    0    0        0        1        0   212992   212992
+`,
+			want: map[int]bool{36413: true},
+		},
+	} {
+		ports := map[int]bool{}
+		if err := parseSCTPSocketTable(strings.NewReader(tc.table), ports); err != nil {
+			t.Errorf("%s: parseSCTPSocketTable() = %v, want nil", tc.desc, err)
+		}
+		if !reflect.DeepEqual(ports, tc.want) {
+			t.Errorf("%s: parseSCTPSocketTable() = %v, want %v", tc.desc, ports, tc.want)
+		}
+	}
+
+	for _, bad := range []string{
+		"ENDPT SOCK\n1 2\n",
+		"ENDPT LPORT\n1 99999\n",
+	} {
+		if err := parseSCTPSocketTable(strings.NewReader(bad), map[int]bool{}); err == nil {
+			t.Errorf("parseSCTPSocketTable(%q) = nil, want error", bad)
+		}
+	}
+}
+
+func TestEphemeralPort(t *testing.T) {
+	t.Parallel()
+
+	low, high := localPortRange()
+	for i := 0; i < 10; i++ {
+		port, err := EphemeralPort(tcpProtoNum)
+		if err != nil {
+			t.Fatalf("EphemeralPort() = _, %v, want nil", err)
+		}
+		if port < low || port > high {
+			t.Errorf("EphemeralPort() = %d, want in range [%d, %d]", port, low, high)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+)
+
+// TCPCase is a TCP packet with a known expected outcome, e.g. a packet that
+// a strict stateful firewall must drop.
+type TCPCase struct {
+	// Name of the case, e.g. "xmas".
+	Name string
+	// Description of the packet sent.
+	Description string
+	// Want is the expected verdict.
+	Want Verdict
+
+	flags tcpFlags
+	// dataOffset overrides the TCP data offset if non-zero.
+	dataOffset uint16
+	// mangle, if set, modifies the encoded segment before it is sent.
+	mangle func(seg []byte)
+	// noPayload sends the segment without the identity payload.
+	noPayload bool
+	// repliesOpen and repliesClosed are set if an unfiltered destination
+	// replies to the packet when the port is open (LISTEN) or closed.
+	// Only then does a missing reply show that the packet was dropped on
+	// the way.
+	repliesOpen, repliesClosed bool
+}
+
+// controlCase is a valid SYN, sent before the cases of a suite to find out
+// whether the port is open or closed.
+var controlCase = &TCPCase{Name: "control", Description: "valid SYN", flags: tcpFlags{syn: true}}
+
+// conclusive returns true if a destination whose port got the control
+// verdict replies to the case when nothing filters it.
+func (c *TCPCase) conclusive(control Verdict) bool {
+	switch control {
+	case VerdictOpen:
+		return c.repliesOpen
+	case VerdictClosed:
+		return c.repliesClosed
+	}
+	return false
+}
+
+// tcpSuites are the named TCP test suites.
+var tcpSuites = map[string][]*TCPCase{
+	// Packets that are invalid or not part of any connection. A correct
+	// stateful firewall drops all of them, so no reply is expected.
+	//
+	// The destination's own TCP stack drops some of them too: RFC 793
+	// answers anything but a RST with a RST on a closed port, but on an
+	// open port it only answers the ACK (FIN, null and xmas segments are
+	// dropped in LISTEN, and Linux drops SYN+FIN). Segments with a bad
+	// checksum or data offset are dropped on any port. A missing reply
+	// only shows that a firewall dropped the packet where the destination
+	// would have replied; the other cases are inconclusive. Use a closed
+	// port to test the most cases.
+	"invalid-tcp": {
+		{Name: "ack", Description: "ACK without a preceding SYN", Want: VerdictFiltered, flags: tcpFlags{ack: true}, repliesOpen: true, repliesClosed: true},
+		{Name: "fin", Description: "FIN without a connection", Want: VerdictFiltered, flags: tcpFlags{fin: true}, repliesClosed: true},
+		{Name: "null", Description: "no flags set", Want: VerdictFiltered, repliesClosed: true},
+		{Name: "xmas", Description: "FIN, PSH and URG set", Want: VerdictFiltered, flags: tcpFlags{fin: true, psh: true, urg: true}, repliesClosed: true},
+		{Name: "syn-fin", Description: "SYN and FIN set", Want: VerdictFiltered, flags: tcpFlags{syn: true, fin: true}, repliesClosed: true},
+		{
+			Name:        "bad-checksum",
+			Description: "SYN with an invalid checksum",
+			Want:        VerdictFiltered,
+			flags:       tcpFlags{syn: true},
+			mangle:      func(seg []byte) { seg[16] ^= 0xff },
+		},
+		{Name: "short-data-offset", Description: "SYN with a data offset below the minimum header", Want: VerdictFiltered, flags: tcpFlags{syn: true}, dataOffset: 3},
+		// The maximum offset of 60 bytes is only past the end of a
+		// segment without payload.
+		{Name: "long-data-offset", Description: "SYN with a data offset past the end of the segment", Want: VerdictFiltered, flags: tcpFlags{syn: true}, dataOffset: 15, noPayload: true},
+	},
+}
+
+// TCPSuites returns the names of the TCP test suites.
+func TCPSuites() []string {
+	var names []string
+	for name := range tcpSuites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CaseResult is the outcome of a single case in a suite.
+type CaseResult struct {
+	Case   *TCPCase
+	Result *Result
+	// Err is set if the case could not be sent.
+	Err error
+	// Inconclusive is set if the case got the expected verdict, but the
+	// destination would have given it anyway, so it says nothing about
+	// the path.
+	Inconclusive bool
+}
+
+// newCaseResult returns the result of c, given the verdict of the control
+// case.
+func newCaseResult(c *TCPCase, control Verdict, result *Result, err error) *CaseResult {
+	r := &CaseResult{Case: c, Result: result, Err: err}
+	r.Inconclusive = err == nil && result.Verdict == c.Want && !c.conclusive(control)
+	return r
+}
+
+// Pass returns true if the case got the expected verdict and it shows that
+// the path filtered the packet.
+func (r *CaseResult) Pass() bool {
+	return r.Err == nil && !r.Inconclusive && r.Result.Verdict == r.Case.Want
+}
+
+// Fail returns true if the case could not be sent or got an unexpected
+// verdict.
+func (r *CaseResult) Fail() bool {
+	return !r.Pass() && !r.Inconclusive
+}
+
+// SuiteReport is the outcome of running a test suite.
+type SuiteReport struct {
+	Suite string
+	Dest  string
+	Port  int
+	// Control is the result of the valid SYN sent before the cases.
+	Control *Result
+	Results []*CaseResult
+}
+
+// Passed returns the number of cases that passed.
+func (r *SuiteReport) Passed() int {
+	var n int
+	for _, c := range r.Results {
+		if c.Pass() {
+			n++
+		}
+	}
+	return n
+}
+
+// Inconclusive returns the number of inconclusive cases.
+func (r *SuiteReport) Inconclusive() int {
+	var n int
+	for _, c := range r.Results {
+		if c.Inconclusive {
+			n++
+		}
+	}
+	return n
+}
+
+// OK returns true if no case failed and at least one passed.
+func (r *SuiteReport) OK() bool {
+	for _, c := range r.Results {
+		if c.Fail() {
+			return false
+		}
+	}
+	return r.Passed() > 0
+}
+
+func (r *SuiteReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "suite %s against %s:%d\n", r.Suite, r.Dest, r.Port)
+	fmt.Fprintf(&buf, "control SYN: %v (%s)\n", r.Control.Verdict, r.Control.Reason)
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CASE\tWANT\tGOT\tRESULT\tDETAIL")
+	for _, c := range r.Results {
+		status := "FAIL"
+		switch {
+		case c.Pass():
+			status = "PASS"
+		case c.Inconclusive:
+			status = "INCONCLUSIVE"
+		}
+		var got, detail string
+		if c.Err != nil {
+			got, detail = "error", c.Err.Error()
+		} else {
+			got, detail = c.Result.Verdict.String(), c.Result.Reason
+			if c.Result.From != nil {
+				detail = fmt.Sprintf("%s from %v", detail, c.Result.From)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%v\t%s\t%s\t%s (%s)\n", c.Case.Name, c.Case.Want, got, status, detail, c.Case.Description)
+	}
+	w.Flush()
+	fmt.Fprintf(&buf, "%d/%d passed, %d inconclusive", r.Passed(), len(r.Results), r.Inconclusive())
+	switch r.Control.Verdict {
+	case VerdictOpen:
+		fmt.Fprintf(&buf, "\nthe port is open; use a closed port to test more cases")
+	case VerdictClosed:
+		// Every case the destination replies to is conclusive.
+	default:
+		fmt.Fprintf(&buf, "\nthe control SYN got no reply, so no case can tell a firewall from the destination")
+	}
+	return buf.String()
+}
+
+// RunTCPSuite sends each case of the named suite to dest:destPort and
+// compares the replies with the expected verdicts. A valid SYN is sent
+// first to find out whether the port is open or closed, which decides the
+// cases for which a missing reply is conclusive. Each packet is sent from a
+// new ephemeral port unless srcPort is set, so that earlier cases do not
+// create state for later ones. opt may be nil.
+func RunTCPSuite(suite string, src string, srcPort int, dest string, destPort int, magic string, opt *Options) (*SuiteReport, error) {
+	cases, ok := tcpSuites[suite]
+	if !ok {
+		return nil, fmt.Errorf("unknown TCP suite %q", suite)
+	}
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	control, err := sendTCPCase(controlCase, srcAddr, srcPort, destAddr, destPort, magic, opt)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("Control: %v", control)
+	report := &SuiteReport{Suite: suite, Dest: destAddr.IP.String(), Port: destPort, Control: control}
+	for _, c := range cases {
+		result, err := sendTCPCase(c, srcAddr, srcPort, destAddr, destPort, magic, opt)
+		glog.V(2).Infof("Case %s: %v, %v", c.Name, result, err)
+		report.Results = append(report.Results, newCaseResult(c, control.Verdict, result, err))
+	}
+	return report, nil
+}
+
+func sendTCPCase(c *TCPCase, srcAddr *net.IPAddr, srcPort int, destAddr *net.IPAddr, destPort int, magic string, opt *Options) (*Result, error) {
+	srcPort, err := sourcePort(srcPort, tcpProtoNum)
+	if err != nil {
+		return nil, err
+	}
+	id, payload, err := newPayload(magic)
+	if err != nil {
+		return nil, err
+	}
+
+	tcp, seg, err := c.encode(uint16(srcPort), uint16(destPort), srcAddr.IP, destAddr.IP, id, payload)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("Encoded TCP case %s (%d bytes, flags %v, identity %v): %v", c.Name, len(seg), c.flags, id, seg)
+
+	classify := classifyTCPAny(tcp, destAddr.IP)
+	return send(srcAddr, destAddr, tcpProtoNum, id, seg, classify, VerdictFiltered, opt)
+}
+
+// encode the segment for the case, carrying the identity id encoded in
+// payload unless the case has no payload.
+func (c *TCPCase) encode(srcPort, destPort uint16, src, dest net.IP, id *Identity, payload []byte) (*tcpPacket, []byte, error) {
+	if c.noPayload {
+		payload = nil
+	}
+	tcp := &tcpPacket{
+		srcPort:    srcPort,
+		destPort:   destPort,
+		flags:      c.flags,
+		seq:        uint32(id.ID),
+		windowSize: 1024,
+
+		forceDataOffset: c.dataOffset,
+	}
+	if c.flags.ack {
+		tcp.ack = uint32(id.ID >> 32)
+	}
+
+	pkt := make([]byte, tcp.headerLen()+len(payload))
+	n, err := tcp.encode(pkt, src, dest, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.mangle != nil {
+		c.mangle(pkt[:n])
+	}
+	return tcp, pkt[:n], nil
+}
+
+// classifyTCPAny matches any reply to a TCP packet sent to dest, not only
+// the replies expected for a SYN. A RST means the packet reached a closed
+// port (or was rejected) and any other segment means it reached the
+// destination's TCP stack.
+func classifyTCPAny(tcp *tcpPacket, dest net.IP) classifier {
+	return func(r *reply) (Verdict, string, bool) {
+		switch r.proto {
+		case tcpProtoNum:
+			if !r.from.Equal(dest) {
+				return VerdictUnknown, "", false
+			}
+			var resp tcpPacket
+			if _, err := resp.decode(r.data, nil, nil); err != nil {
+				glog.V(4).Infof("Ignoring TCP reply from %v: %v", r.from, err)
+				return VerdictUnknown, "", false
+			}
+			if resp.srcPort != tcp.destPort || resp.destPort != tcp.srcPort {
+				return VerdictUnknown, "", false
+			}
+			if resp.flags.rst {
+				return VerdictClosed, "rst", true
+			}
+			return VerdictOpen, fmt.Sprintf("reply with flags %v", resp.flags), true
+		case icmpProtoNum, icmpv6ProtoNum:
+			code, ok := matchICMPUnreachable(r, tcpProtoNum, dest, func(quoted []byte) bool {
+				decoder := binary.BigEndian
+				return decoder.Uint16(quoted) == tcp.srcPort &&
+					decoder.Uint16(quoted[2:]) == tcp.destPort &&
+					decoder.Uint32(quoted[4:]) == tcp.seq
+			})
+			if ok {
+				return VerdictFiltered, unreachableReason(r.proto, code), true
+			}
+		}
+		return VerdictUnknown, "", false
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPSuiteCases(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.0.2")
+	for _, sender := range []string{"", "a-rather-long-hostname.example.com"} {
+		id := &Identity{Magic: "magic", ID: 0x0102030405060708, Timestamp: time.Unix(1, 0), Sender: sender}
+		payload, err := id.Encode()
+		if err != nil {
+			t.Fatalf("Encode() = _, %v, want nil", err)
+		}
+
+		for _, c := range tcpSuites["invalid-tcp"] {
+			_, seg, err := c.encode(3000, 80, src, dest, id, payload)
+			if err != nil {
+				t.Fatalf("%s: encode() = _, _, %v, want nil", c.Name, err)
+			}
+			var got tcpPacket
+			_, err = got.decode(seg, src, dest)
+			switch c.Name {
+			case "bad-checksum":
+				if err != ErrBadChecksum {
+					t.Errorf("%s: decode() = _, %v, want %v", c.Name, err, ErrBadChecksum)
+				}
+			case "short-data-offset":
+				if err == nil {
+					t.Errorf("%s: decode() = _, nil, want error", c.Name)
+				}
+				continue
+			case "long-data-offset":
+				if err == nil {
+					t.Errorf("%s: decode() = _, nil, want error", c.Name)
+				}
+				if offset := int(seg[12]>>4) * 4; offset <= len(seg) {
+					t.Errorf("%s: data offset %d is within the %d byte segment (sender %q)", c.Name, offset, len(seg), sender)
+				}
+				continue
+			default:
+				if err != nil {
+					t.Errorf("%s: decode() = _, %v, want nil", c.Name, err)
+				}
+			}
+			if got.flags != c.flags {
+				t.Errorf("%s: flags = %v, want %v", c.Name, got.flags, c.flags)
+			}
+			if got.seq != 0x05060708 {
+				t.Errorf("%s: seq = %#x, want %#x", c.Name, got.seq, 0x05060708)
+			}
+			if _, err := FindIdentity(seg); err != nil {
+				t.Errorf("%s: FindIdentity() = _, %v, want nil", c.Name, err)
+			}
+		}
+	}
+}
+
+func TestClassifyTCPAny(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.0.2")
+	probe := &tcpPacket{srcPort: 3000, destPort: 80, seq: 100, flags: tcpFlags{fin: true, psh: true, urg: true}}
+
+	tcpReply := func(t tcpPacket) []byte {
+		pkt := make([]byte, tcpHeaderSize)
+		t.encode(pkt, dest, src, nil)
+		return pkt
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		r           reply
+		wantOK      bool
+		wantVerdict Verdict
+	}{
+		{
+			desc:        "rst",
+			r:           reply{proto: tcpProtoNum, from: dest, data: tcpReply(tcpPacket{srcPort: 80, destPort: 3000, seq: 7, flags: tcpFlags{rst: true}})},
+			wantOK:      true,
+			wantVerdict: VerdictClosed,
+		},
+		{
+			desc:        "challenge ack",
+			r:           reply{proto: tcpProtoNum, from: dest, data: tcpReply(tcpPacket{srcPort: 80, destPort: 3000, ack: 5, flags: tcpFlags{ack: true}})},
+			wantOK:      true,
+			wantVerdict: VerdictOpen,
+		},
+		{
+			desc: "wrong port",
+			r:    reply{proto: tcpProtoNum, from: dest, data: tcpReply(tcpPacket{srcPort: 81, destPort: 3000, flags: tcpFlags{rst: true}})},
+		},
+		{
+			desc: "wrong host",
+			r:    reply{proto: tcpProtoNum, from: src, data: tcpReply(tcpPacket{srcPort: 80, destPort: 3000, flags: tcpFlags{rst: true}})},
+		},
+	} {
+		verdict, _, ok := classifyTCPAny(probe, dest)(&tc.r)
+		if ok != tc.wantOK || verdict != tc.wantVerdict {
+			t.Errorf("%s: classify() = %v, _, %t; want %v, _, %t", tc.desc, verdict, ok, tc.wantVerdict, tc.wantOK)
+		}
+	}
+}
+
+func TestSuiteReport(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]*TCPCase{}
+	for _, c := range tcpSuites["invalid-tcp"] {
+		cases[c.Name] = c
+	}
+	filtered := &Result{Verdict: VerdictFiltered, Reason: "timeout"}
+	rst := &Result{Verdict: VerdictClosed, Reason: "rst", From: net.ParseIP("10.0.0.2")}
+
+	for _, tc := range []struct {
+		desc    string
+		control *Result
+		results []*CaseResult
+		// want is the status of each result: "pass", "fail" or
+		// "inconclusive".
+		want     []string
+		wantOK   bool
+		wantText []string
+	}{
+		{
+			desc:    "closed port",
+			control: rst,
+			results: []*CaseResult{
+				newCaseResult(cases["fin"], VerdictClosed, filtered, nil),
+				newCaseResult(cases["xmas"], VerdictClosed, rst, nil),
+				newCaseResult(cases["bad-checksum"], VerdictClosed, filtered, nil),
+				newCaseResult(cases["null"], VerdictClosed, nil, errors.New("boom")),
+			},
+			want:     []string{"pass", "fail", "inconclusive", "fail"},
+			wantText: []string{"control SYN: closed", "PASS", "FAIL", "INCONCLUSIVE", "rst from 10.0.0.2", "boom", "1/4 passed, 1 inconclusive"},
+		},
+		{
+			desc:    "open port",
+			control: &Result{Verdict: VerdictOpen, Reason: "reply with flags SA"},
+			results: []*CaseResult{
+				newCaseResult(cases["ack"], VerdictOpen, filtered, nil),
+				newCaseResult(cases["fin"], VerdictOpen, filtered, nil),
+				newCaseResult(cases["syn-fin"], VerdictOpen, filtered, nil),
+			},
+			want:     []string{"pass", "inconclusive", "inconclusive"},
+			wantOK:   true,
+			wantText: []string{"1/3 passed, 2 inconclusive", "use a closed port"},
+		},
+		{
+			desc:    "filtered port",
+			control: filtered,
+			results: []*CaseResult{
+				newCaseResult(cases["ack"], VerdictFiltered, filtered, nil),
+				newCaseResult(cases["fin"], VerdictFiltered, filtered, nil),
+			},
+			want:     []string{"inconclusive", "inconclusive"},
+			wantText: []string{"0/2 passed, 2 inconclusive", "no case can tell"},
+		},
+	} {
+		report := &SuiteReport{Suite: "invalid-tcp", Dest: "10.0.0.2", Port: 80, Control: tc.control, Results: tc.results}
+		for i, r := range report.Results {
+			got := "fail"
+			switch {
+			case r.Pass():
+				got = "pass"
+			case r.Inconclusive:
+				got = "inconclusive"
+			}
+			if got != tc.want[i] || r.Fail() != (got == "fail") {
+				t.Errorf("%s: %s is %s (Fail() = %t), want %s", tc.desc, r.Case.Name, got, r.Fail(), tc.want[i])
+			}
+		}
+		if got := report.OK(); got != tc.wantOK {
+			t.Errorf("%s: OK() = %t, want %t", tc.desc, got, tc.wantOK)
+		}
+		s := report.String()
+		for _, want := range tc.wantText {
+			if !strings.Contains(s, want) {
+				t.Errorf("%s: String() = %q, want it to contain %q", tc.desc, s, want)
+			}
+		}
+	}
+}
@@ -18,6 +18,7 @@ package probe
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
 )
 
@@ -31,32 +32,45 @@ type tcpFlags struct {
 }
 
 type tcpPacket struct {
-	srcPort    uint16 // 0
-	destPort   uint16 // 2
-	seq        uint32 // 4
-	ack        uint32 // 8
-	dataOffset uint16
-	flags      tcpFlags // 12
-	windowSize uint16   // 14
-	urgentPtr  uint16   // 18
+	srcPort    uint16      // 0
+	destPort   uint16      // 2
+	seq        uint32      // 4
+	ack        uint32      // 8
+	dataOffset uint16      // 12 (only set by decode)
+	flags      tcpFlags    // 12
+	windowSize uint16      // 14
+	checksum   uint16      // 16 (only set by decode)
+	urgentPtr  uint16      // 18
+	options    []TCPOption // 20
+
+	// forceDataOffset, if non-zero, is encoded as the data offset instead
+	// of the computed one, to send invalid segments.
+	forceDataOffset uint16
 }
 
-func (t *tcpPacket) encode(pkt []byte, src, dest net.IP, data []byte) int {
+// headerLen is the length of the encoded header, including options.
+func (t *tcpPacket) headerLen() int {
+	return tcpHeaderSize + tcpOptionsLen(t.options)
+}
+
+// encode the segment with data into pkt, which must be at least
+// headerLen()+len(data) long, and return its length.
+func (t *tcpPacket) encode(pkt []byte, src, dest net.IP, data []byte) (int, error) {
 	encoder := binary.BigEndian
 	encoder.PutUint16(pkt, t.srcPort)
 	encoder.PutUint16(pkt[2:], t.destPort)
 	encoder.PutUint32(pkt[4:], t.seq)
 	encoder.PutUint32(pkt[8:], t.ack)
 
-	if t.dataOffset == 0 {
-		// If nil-initialized, then assume standard size (5*32 bits).
-		pkt[12] = 5 << 4
+	headerLen := t.headerLen()
+	if t.forceDataOffset == 0 {
+		pkt[12] = uint8(headerLen/4) << 4
 	} else {
-		pkt[12] = uint8(t.dataOffset&0xf) << 4
+		pkt[12] = uint8(t.forceDataOffset&0xf) << 4
 	}
 
 	if t.flags.ns {
-		pkt[12] |= 1 << 7
+		pkt[12] |= 1
 	}
 
 	var flags uint8
@@ -77,29 +91,108 @@ func (t *tcpPacket) encode(pkt []byte, src, dest net.IP, data []byte) int {
 	pkt[13] = flags
 
 	encoder.PutUint16(pkt[14:], t.windowSize)
+	pkt[16] = 0
+	pkt[17] = 0
 	encoder.PutUint16(pkt[18:], t.urgentPtr)
+
+	if _, err := encodeTCPOptions(pkt[tcpHeaderSize:headerLen], t.options); err != nil {
+		return 0, err
+	}
+
 	// Checksum is last (compute with pseudoheader and zeros).
-	checksum := checksumTCP(src, dest, pkt[:tcpHeaderSize], data)
+	checksum := checksumTCP(src, dest, pkt[:headerLen], data)
 	pkt[16] = uint8(checksum & 0xff)
 	pkt[17] = uint8(checksum >> 8)
 
-	copy(pkt[tcpHeaderSize:], data)
+	copy(pkt[headerLen:], data)
 
-	return tcpHeaderSize + len(data)
+	return headerLen + len(data), nil
 }
 
-func checksumTCP(src, dest net.IP, tcpHeader, data []byte) uint16 {
-	chk := &tcpChecksumer{}
+// decode the packet from pkt and return the data. The checksum is validated
+// if src and dest are given; ErrBadChecksum is returned if it is invalid
+// but the packet is still decoded.
+func (t *tcpPacket) decode(pkt []byte, src, dest net.IP) ([]byte, error) {
+	if len(pkt) < tcpHeaderSize {
+		return nil, ErrTruncated
+	}
 
-	// Encode pseudoheader.
-	chk.add(src.To4())
-	chk.add(dest.To4())
+	decoder := binary.BigEndian
+	t.srcPort = decoder.Uint16(pkt)
+	t.destPort = decoder.Uint16(pkt[2:])
+	t.seq = decoder.Uint32(pkt[4:])
+	t.ack = decoder.Uint32(pkt[8:])
+	t.dataOffset = uint16(pkt[12] >> 4)
+	t.flags = tcpFlags{
+		ns:  pkt[12]&1 != 0,
+		cwr: pkt[13]&(1<<7) != 0,
+		ece: pkt[13]&(1<<6) != 0,
+		urg: pkt[13]&(1<<5) != 0,
+		ack: pkt[13]&(1<<4) != 0,
+		psh: pkt[13]&(1<<3) != 0,
+		rst: pkt[13]&(1<<2) != 0,
+		syn: pkt[13]&(1<<1) != 0,
+		fin: pkt[13]&1 != 0,
+	}
+	t.windowSize = decoder.Uint16(pkt[14:])
+	t.checksum = decoder.Uint16(pkt[16:])
+	t.urgentPtr = decoder.Uint16(pkt[18:])
+
+	headerLen := int(t.dataOffset) * 4
+	if headerLen < tcpHeaderSize {
+		return nil, fmt.Errorf("invalid TCP data offset %d", t.dataOffset)
+	}
+	if len(pkt) < headerLen {
+		return nil, ErrTruncated
+	}
+	var err error
+	if t.options, err = decodeTCPOptions(pkt[tcpHeaderSize:headerLen]); err != nil {
+		return nil, err
+	}
+	data := pkt[headerLen:]
+
+	if src != nil && dest != nil && checksumTCP(src, dest, pkt[:headerLen], data) != 0 {
+		return data, ErrBadChecksum
+	}
+	return data, nil
+}
 
-	var pseudoHeader [4]byte
-	pseudoHeader[1] = tcpProtoNum
-	binary.BigEndian.PutUint16(pseudoHeader[2:], uint16(len(data)+len(tcpHeader)))
-	chk.add(pseudoHeader[:])
-	chk.add(tcpHeader)
+func (f tcpFlags) String() string {
+	var ret []byte
+	for _, x := range []struct {
+		set  bool
+		name byte
+	}{
+		{f.ns, 'N'},
+		{f.cwr, 'C'},
+		{f.ece, 'E'},
+		{f.urg, 'U'},
+		{f.ack, 'A'},
+		{f.psh, 'P'},
+		{f.rst, 'R'},
+		{f.syn, 'S'},
+		{f.fin, 'F'},
+	} {
+		if x.set {
+			ret = append(ret, x.name)
+		}
+	}
+	if len(ret) == 0 {
+		return "-"
+	}
+	return string(ret)
+}
+
+func checksumTCP(src, dest net.IP, tcpHeader, data []byte) uint16 {
+	return checksumPseudo(src, dest, tcpProtoNum, tcpHeader, data)
+}
+
+// checksumPseudo computes the checksum for an upper layer protocol that
+// covers the IP pseudo-header (e.g. TCP, UDP and ICMPv6).
+func checksumPseudo(src, dest net.IP, proto uint8, header, data []byte) uint16 {
+	chk := &tcpChecksumer{}
+	chk.addPseudoHeader(src, dest, proto, len(header)+len(data))
+	chk.add(header)
 	chk.add(data)
 
 	return chk.finalize()
@@ -122,6 +215,27 @@ func (c *tcpChecksumer) finalize() uint16 {
 	return ^uint16(ret)
 }
 
+// addPseudoHeader adds the IPv4 (RFC 793) or IPv6 (RFC 8200) pseudo-header
+// for an upper layer packet of the given protocol and length.
+func (c *tcpChecksumer) addPseudoHeader(src, dest net.IP, proto uint8, length int) {
+	if src4, dest4 := src.To4(), dest.To4(); src4 != nil && dest4 != nil {
+		var pseudoHeader [4]byte
+		pseudoHeader[1] = proto
+		binary.BigEndian.PutUint16(pseudoHeader[2:], uint16(length))
+		c.add(src4)
+		c.add(dest4)
+		c.add(pseudoHeader[:])
+		return
+	}
+
+	var pseudoHeader [8]byte
+	binary.BigEndian.PutUint32(pseudoHeader[:], uint32(length))
+	pseudoHeader[7] = proto
+	c.add(src.To16())
+	c.add(dest.To16())
+	c.add(pseudoHeader[:])
+}
+
 func (c *tcpChecksumer) add(data []byte) {
 	if len(data) == 0 {
 		return
@@ -0,0 +1,276 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// TCP option kinds (https://www.iana.org/assignments/tcp-parameters).
+const (
+	tcpOptionKindEnd           = 0
+	tcpOptionKindNOP           = 1
+	tcpOptionKindMSS           = 2
+	tcpOptionKindWindowScale   = 3
+	tcpOptionKindSACKPermitted = 4
+	tcpOptionKindTimestamps    = 8
+	tcpOptionKindExperiment1   = 253
+	tcpOptionKindExperiment2   = 254
+
+	// tcpOptionExIDProbeID is the experiment ID (RFC 6994) of the option
+	// carrying the probe ID.
+	tcpOptionExIDProbeID = 0x4c48
+	// tcpOptionProbeIDLen is the length of the data of the probe ID
+	// option: the experiment ID, the hash of the magic and the ID.
+	tcpOptionProbeIDLen = 2 + 4 + 8
+
+	// maxTCPOptionsSize is the most that fits in the data offset.
+	maxTCPOptionsSize = 40
+)
+
+// ErrTCPOptionsTooLong is returned when encoding TCP options that do not fit
+// in the header.
+var ErrTCPOptionsTooLong = errors.New("TCP options are longer than 40 bytes")
+
+// TCPOption is a TCP header option.
+type TCPOption struct {
+	Kind uint8
+	// Data is the option data, without the kind and length bytes.
+	Data []byte
+}
+
+// TCPOptionNOP returns a no-operation option.
+func TCPOptionNOP() TCPOption {
+	return TCPOption{Kind: tcpOptionKindNOP}
+}
+
+// TCPOptionMSS returns a maximum segment size option.
+func TCPOptionMSS(mss uint16) TCPOption {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, mss)
+	return TCPOption{Kind: tcpOptionKindMSS, Data: data}
+}
+
+// TCPOptionWindowScale returns a window scale option.
+func TCPOptionWindowScale(shift uint8) TCPOption {
+	return TCPOption{Kind: tcpOptionKindWindowScale, Data: []byte{shift}}
+}
+
+// TCPOptionSACKPermitted returns a SACK-permitted option.
+func TCPOptionSACKPermitted() TCPOption {
+	return TCPOption{Kind: tcpOptionKindSACKPermitted}
+}
+
+// TCPOptionTimestamps returns a timestamps option.
+func TCPOptionTimestamps(val, echo uint32) TCPOption {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, val)
+	binary.BigEndian.PutUint32(data[4:], echo)
+	return TCPOption{Kind: tcpOptionKindTimestamps, Data: data}
+}
+
+// TCPOptionExperimental returns an experimental option (kind 253 or 254)
+// with the given experiment ID (RFC 6994).
+func TCPOptionExperimental(kind uint8, exid uint16, data []byte) TCPOption {
+	b := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(b, exid)
+	copy(b[2:], data)
+	return TCPOption{Kind: kind, Data: b}
+}
+
+// TCPOptionProbeID returns an experimental option of the given kind that
+// carries a 32-bit hash of the magic and the probe ID. When sent with
+// SendTCP, the magic and ID are replaced with those of the probe.
+func TCPOptionProbeID(kind uint8, magic string, id uint64) TCPOption {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, magicHash(magic))
+	binary.BigEndian.PutUint64(data[4:], id)
+	return TCPOptionExperimental(kind, tcpOptionExIDProbeID, data)
+}
+
+// magicHash is the FNV-1a hash of magic, which fits in a TCP option where
+// the magic itself may not.
+func magicHash(magic string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(magic))
+	return h.Sum32()
+}
+
+// isProbeID returns true if the option carries a probe ID.
+func (o TCPOption) isProbeID() bool {
+	return (o.Kind == tcpOptionKindExperiment1 || o.Kind == tcpOptionKindExperiment2) &&
+		len(o.Data) == tcpOptionProbeIDLen && binary.BigEndian.Uint16(o.Data) == tcpOptionExIDProbeID
+}
+
+// ProbeID returns the probe ID carried by the option, if it is a probe ID
+// option for magic.
+func (o TCPOption) ProbeID(magic string) (uint64, bool) {
+	if !o.isProbeID() || binary.BigEndian.Uint32(o.Data[2:]) != magicHash(magic) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(o.Data[6:]), true
+}
+
+// singleByte returns true if the option is encoded as only the kind.
+func (o TCPOption) singleByte() bool {
+	return o.Kind == tcpOptionKindEnd || o.Kind == tcpOptionKindNOP
+}
+
+func (o TCPOption) String() string {
+	decoder := binary.BigEndian
+	switch {
+	case o.Kind == tcpOptionKindEnd:
+		return "eol"
+	case o.Kind == tcpOptionKindNOP:
+		return "nop"
+	case o.Kind == tcpOptionKindMSS && len(o.Data) == 2:
+		return fmt.Sprintf("mss=%d", decoder.Uint16(o.Data))
+	case o.Kind == tcpOptionKindWindowScale && len(o.Data) == 1:
+		return fmt.Sprintf("wscale=%d", o.Data[0])
+	case o.Kind == tcpOptionKindSACKPermitted && len(o.Data) == 0:
+		return "sackok"
+	case o.Kind == tcpOptionKindTimestamps && len(o.Data) == 8:
+		return fmt.Sprintf("ts=%d/%d", decoder.Uint32(o.Data), decoder.Uint32(o.Data[4:]))
+	case o.isProbeID():
+		return fmt.Sprintf("probeid(%d)=%08x/%016x", o.Kind, decoder.Uint32(o.Data[2:]), decoder.Uint64(o.Data[6:]))
+	}
+	return fmt.Sprintf("opt(%d)=%x", o.Kind, o.Data)
+}
+
+// tcpOptionsLen is the length of the encoded options, including padding.
+func tcpOptionsLen(opts []TCPOption) int {
+	var n int
+	for _, o := range opts {
+		if o.singleByte() {
+			n++
+		} else {
+			n += 2 + len(o.Data)
+		}
+	}
+	return (n + 3) / 4 * 4
+}
+
+// encodeTCPOptions into pkt, padding with zeros (end of option list) to a
+// multiple of 4 bytes. pkt must be at least tcpOptionsLen(opts) long.
+// ErrTCPOptionsTooLong is returned if the options do not fit in the header.
+func encodeTCPOptions(pkt []byte, opts []TCPOption) (int, error) {
+	if tcpOptionsLen(opts) > maxTCPOptionsSize {
+		return 0, ErrTCPOptionsTooLong
+	}
+	var n int
+	for _, o := range opts {
+		pkt[n] = o.Kind
+		n++
+		if o.singleByte() {
+			continue
+		}
+		pkt[n] = uint8(2 + len(o.Data))
+		n += 1 + copy(pkt[n+1:], o.Data)
+	}
+	for ; n%4 != 0; n++ {
+		pkt[n] = tcpOptionKindEnd
+	}
+	return n, nil
+}
+
+// decodeTCPOptions from b. Decoding stops at the end of option list; the
+// remaining bytes are padding.
+func decodeTCPOptions(b []byte) ([]TCPOption, error) {
+	var opts []TCPOption
+	for i := 0; i < len(b); {
+		kind := b[i]
+		switch kind {
+		case tcpOptionKindEnd:
+			return opts, nil
+		case tcpOptionKindNOP:
+			opts = append(opts, TCPOption{Kind: kind})
+			i++
+			continue
+		}
+		if i+1 >= len(b) {
+			return opts, fmt.Errorf("truncated TCP option %d", kind)
+		}
+		optLen := int(b[i+1])
+		if optLen < 2 || i+optLen > len(b) {
+			return opts, fmt.Errorf("invalid TCP option %d length %d", kind, optLen)
+		}
+		var data []byte
+		if optLen > 2 {
+			data = append([]byte{}, b[i+2:i+optLen]...)
+		}
+		opts = append(opts, TCPOption{Kind: kind, Data: data})
+		i += optLen
+	}
+	return opts, nil
+}
+
+// ParseTCPOptions parses a comma separated list of options:
+//
+//	mss=N       maximum segment size
+//	wscale=N    window scale
+//	sackok      SACK permitted
+//	ts          timestamps
+//	probeid     hash of the magic and probe ID in experimental option 253
+//	probeid254  hash of the magic and probe ID in experimental option 254
+//	nop         no-operation
+func ParseTCPOptions(spec string) ([]TCPOption, error) {
+	var opts []TCPOption
+	if spec == "" {
+		return opts, nil
+	}
+	for _, s := range strings.Split(spec, ",") {
+		name, value := s, ""
+		if i := strings.Index(s, "="); i >= 0 {
+			name, value = s[:i], s[i+1:]
+		}
+		switch name {
+		case "mss":
+			mss, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mss %q: %v", value, err)
+			}
+			opts = append(opts, TCPOptionMSS(uint16(mss)))
+		case "wscale":
+			shift, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid wscale %q: %v", value, err)
+			}
+			opts = append(opts, TCPOptionWindowScale(uint8(shift)))
+		case "sackok":
+			opts = append(opts, TCPOptionSACKPermitted())
+		case "ts":
+			opts = append(opts, TCPOptionTimestamps(0, 0))
+		case "probeid":
+			opts = append(opts, TCPOptionProbeID(tcpOptionKindExperiment1, "", 0))
+		case "probeid254":
+			opts = append(opts, TCPOptionProbeID(tcpOptionKindExperiment2, "", 0))
+		case "nop":
+			opts = append(opts, TCPOptionNOP())
+		default:
+			return nil, fmt.Errorf("invalid TCP option %q", s)
+		}
+	}
+	if n := tcpOptionsLen(opts); n > maxTCPOptionsSize {
+		return nil, fmt.Errorf("TCP options are too long (%d bytes, max %d)", n, maxTCPOptionsSize)
+	}
+	return opts, nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTCPOptionsEncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc string
+		opts []TCPOption
+		want []byte
+	}{
+		{
+			desc: "empty",
+			want: []byte{},
+		},
+		{
+			desc: "mss",
+			opts: []TCPOption{TCPOptionMSS(1460)},
+			want: []byte{0x02, 0x04, 0x05, 0xb4},
+		},
+		{
+			desc: "padding",
+			opts: []TCPOption{TCPOptionWindowScale(7)},
+			want: []byte{0x03, 0x03, 0x07, 0x00},
+		},
+		{
+			desc: "linux syn",
+			opts: []TCPOption{
+				TCPOptionMSS(65495),
+				TCPOptionSACKPermitted(),
+				TCPOptionTimestamps(0x01020304, 0),
+				TCPOptionNOP(),
+				TCPOptionWindowScale(7),
+			},
+			want: []byte{
+				0x02, 0x04, 0xff, 0xd7, 0x04, 0x02, 0x08, 0x0a,
+				0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x00,
+				0x01, 0x03, 0x03, 0x07,
+			},
+		},
+		{
+			desc: "probe id",
+			opts: []TCPOption{TCPOptionProbeID(tcpOptionKindExperiment2, "magic", 0x0102030405060708)},
+			want: []byte{
+				0xfe, 0x10, 0x4c, 0x48, 0xe4, 0xeb, 0x25, 0x8c,
+				0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			n := tcpOptionsLen(tc.opts)
+			if n != len(tc.want) {
+				t.Fatalf("tcpOptionsLen(%v) = %d, want %d", tc.opts, n, len(tc.want))
+			}
+			b := make([]byte, n)
+			if _, err := encodeTCPOptions(b, tc.opts); err != nil || !reflect.DeepEqual(b, tc.want) {
+				t.Errorf("encodeTCPOptions(%v) = %v, %v; want %v, nil", tc.opts, b, err, tc.want)
+			}
+			got, err := decodeTCPOptions(b)
+			if err != nil {
+				t.Fatalf("decodeTCPOptions(%v) = _, %v, want nil", b, err)
+			}
+			if !reflect.DeepEqual(got, tc.opts) {
+				t.Errorf("decodeTCPOptions(%v) = %v, want %v", b, got, tc.opts)
+			}
+		})
+	}
+}
+
+func TestEncodeTCPOptionsTooLong(t *testing.T) {
+	t.Parallel()
+
+	opts := []TCPOption{TCPOptionProbeID(tcpOptionKindExperiment1, "magic", 1), TCPOptionProbeID(tcpOptionKindExperiment2, "magic", 2), TCPOptionProbeID(tcpOptionKindExperiment1, "magic", 3)}
+	b := make([]byte, tcpOptionsLen(opts))
+	if _, err := encodeTCPOptions(b, opts); err != ErrTCPOptionsTooLong {
+		t.Errorf("encodeTCPOptions(%v) = _, %v; want %v", opts, err, ErrTCPOptionsTooLong)
+	}
+	tcp := &tcpPacket{options: opts}
+	pkt := make([]byte, tcp.headerLen())
+	if _, err := tcp.encode(pkt, nil, nil, nil); err != ErrTCPOptionsTooLong {
+		t.Errorf("encode() = _, %v; want %v", err, ErrTCPOptionsTooLong)
+	}
+}
+
+func TestTCPOptionProbeID(t *testing.T) {
+	t.Parallel()
+
+	o := TCPOptionProbeID(tcpOptionKindExperiment1, "magic", 42)
+	if id, ok := o.ProbeID("magic"); !ok || id != 42 {
+		t.Errorf("ProbeID(magic) = %d, %t; want 42, true", id, ok)
+	}
+	if _, ok := o.ProbeID("other"); ok {
+		t.Errorf("ProbeID(other) = _, true; want false")
+	}
+	if _, ok := TCPOptionMSS(1460).ProbeID("magic"); ok {
+		t.Errorf("MSS ProbeID(magic) = _, true; want false")
+	}
+	// probeTCPOptions fills in the magic and ID of the probe.
+	opts := probeTCPOptions([]TCPOption{TCPOptionProbeID(tcpOptionKindExperiment2, "", 0)}, &Identity{Magic: "magic", ID: 7})
+	if id, ok := opts[0].ProbeID("magic"); !ok || id != 7 {
+		t.Errorf("probeTCPOptions() ProbeID(magic) = %d, %t; want 7, true", id, ok)
+	}
+}
+
+func TestDecodeTCPOptionsErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, b := range [][]byte{
+		{0x02},
+		{0x02, 0x01, 0x00, 0x00},
+		{0x02, 0x08, 0x05, 0xb4},
+	} {
+		if _, err := decodeTCPOptions(b); err == nil {
+			t.Errorf("decodeTCPOptions(%v) = _, nil, want error", b)
+		}
+	}
+}
+
+func TestParseTCPOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		spec    string
+		want    []TCPOption
+		wantErr bool
+	}{
+		{spec: ""},
+		{spec: "mss=1460,sackok", want: []TCPOption{TCPOptionMSS(1460), TCPOptionSACKPermitted()}},
+		{spec: "nop,wscale=14", want: []TCPOption{TCPOptionNOP(), TCPOptionWindowScale(14)}},
+		{spec: "ts,probeid", want: []TCPOption{TCPOptionTimestamps(0, 0), TCPOptionProbeID(tcpOptionKindExperiment1, "", 0)}},
+		{spec: "mss=70000", wantErr: true},
+		{spec: "wscale", wantErr: true},
+		{spec: "bogus", wantErr: true},
+		{spec: "ts,ts,ts,ts,ts", wantErr: true},
+	} {
+		got, err := ParseTCPOptions(tc.spec)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("ParseTCPOptions(%q) = _, %v; want error %t", tc.spec, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseTCPOptions(%q) = %v, want %v", tc.spec, got, tc.want)
+		}
+	}
+}
@@ -60,6 +60,30 @@ func TestTCPEncode(t *testing.T) {
 	}
 }
 
+func TestTCPEncodeIPv6(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("2001:db8::1")
+	dest := net.ParseIP("2001:db8::2")
+	tcp := tcpPacket{srcPort: 80, destPort: 8080, seq: 0x1, flags: tcpFlags{syn: true}}
+	want := []byte{
+		0x00, 0x50, 0x1f, 0x90, 0x00,
+		0x00, 0x00, 0x01, 0x00, 0x00,
+		0x00, 0x00, 0x50, 0x02, 0x00,
+		0x00, 0x34, 0x8d, 0x00, 0x00,
+	}
+
+	pkt := make([]byte, tcpHeaderSize)
+	tcp.encode(pkt, src, dest, nil)
+	if !reflect.DeepEqual(want, pkt) {
+		t.Errorf("tcp.Encode() = %v, want %v; tcp = %+v", pkt, want, tcp)
+	}
+	var got tcpPacket
+	if _, err := got.decode(pkt, src, dest); err != nil {
+		t.Errorf("decode(%v) = _, %v, want nil", pkt, err)
+	}
+}
+
 func TestTCPChecksummer(t *testing.T) {
 	t.Parallel()
 
@@ -127,3 +151,122 @@ func TestTCPChecksummer(t *testing.T) {
 		})
 	}
 }
+
+func TestTCPDecode(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.0.2")
+
+	for _, tc := range []struct {
+		desc string
+		tcp  tcpPacket
+		data []byte
+	}{
+		{
+			desc: "syn",
+			tcp:  tcpPacket{srcPort: 80, destPort: 8080, seq: 1, flags: tcpFlags{syn: true}},
+		},
+		{
+			desc: "all flags",
+			tcp: tcpPacket{
+				srcPort:    1,
+				destPort:   2,
+				seq:        0xdeadbeef,
+				ack:        0xfeedface,
+				flags:      tcpFlags{ns: true, cwr: true, ece: true, urg: true, ack: true, psh: true, rst: true, syn: true, fin: true},
+				windowSize: 0xffff,
+				urgentPtr:  0x1234,
+			},
+		},
+		{
+			desc: "options and data",
+			tcp: tcpPacket{
+				srcPort:  3000,
+				destPort: 443,
+				flags:    tcpFlags{syn: true, ece: true, cwr: true},
+				options:  []TCPOption{TCPOptionMSS(1460), TCPOptionSACKPermitted()},
+			},
+			data: []byte("hello"),
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			pkt := make([]byte, tc.tcp.headerLen()+len(tc.data))
+			n, err := tc.tcp.encode(pkt, src, dest, tc.data)
+			if err != nil {
+				t.Fatalf("encode() = _, %v, want nil", err)
+			}
+
+			var got tcpPacket
+			data, err := got.decode(pkt[:n], src, dest)
+			if err != nil {
+				t.Fatalf("decode(%v) = _, %v, want nil", pkt[:n], err)
+			}
+			if string(data) != string(tc.data) {
+				t.Errorf("decode(%v) = %q, want %q", pkt[:n], data, tc.data)
+			}
+			if got.srcPort != tc.tcp.srcPort || got.destPort != tc.tcp.destPort || got.seq != tc.tcp.seq ||
+				got.ack != tc.tcp.ack || got.flags != tc.tcp.flags || got.windowSize != tc.tcp.windowSize ||
+				got.urgentPtr != tc.tcp.urgentPtr || !reflect.DeepEqual(got.options, tc.tcp.options) {
+				t.Errorf("decode(%v) = %+v, want %+v", pkt[:n], got, tc.tcp)
+			}
+
+			// Re-encoding the decoded packet must give the same bytes.
+			pkt2 := make([]byte, n)
+			if n2, err := got.encode(pkt2, src, dest, data); err != nil || n2 != n || !reflect.DeepEqual(pkt[:n], pkt2) {
+				t.Errorf("encode(decode(%v)) = %v, %v", pkt[:n], pkt2[:n2], err)
+			}
+
+			// With other options, the data offset follows them.
+			got.options = append(got.options, TCPOptionTimestamps(1, 2))
+			pkt3 := make([]byte, got.headerLen()+len(data))
+			n3, err := got.encode(pkt3, src, dest, data)
+			if err != nil {
+				t.Fatalf("encode() = _, %v, want nil", err)
+			}
+			var again tcpPacket
+			if data3, err := again.decode(pkt3[:n3], src, dest); err != nil || string(data3) != string(data) || !reflect.DeepEqual(again.options, got.options) {
+				t.Errorf("decode(%v) = %q, %v with options %v; want %q, nil with %v", pkt3[:n3], data3, err, again.options, data, got.options)
+			}
+		})
+	}
+}
+
+func TestTCPDecodeErrors(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.0.2")
+	tcp := tcpPacket{srcPort: 80, destPort: 8080, seq: 1, flags: tcpFlags{syn: true}}
+	valid := make([]byte, tcpHeaderSize)
+	tcp.encode(valid, src, dest, nil)
+
+	badChecksum := append([]byte{}, valid...)
+	badChecksum[17]++
+	badOffset := append([]byte{}, valid...)
+	badOffset[12] = 4 << 4
+	longOffset := append([]byte{}, valid...)
+	longOffset[12] = 6 << 4
+
+	for _, tc := range []struct {
+		desc    string
+		pkt     []byte
+		wantErr error
+	}{
+		{desc: "truncated", pkt: valid[:tcpHeaderSize-1], wantErr: ErrTruncated},
+		{desc: "bad checksum", pkt: badChecksum, wantErr: ErrBadChecksum},
+		{desc: "data offset too small", pkt: badOffset},
+		{desc: "data offset past end", pkt: longOffset, wantErr: ErrTruncated},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var got tcpPacket
+			_, err := got.decode(tc.pkt, src, dest)
+			if err == nil {
+				t.Fatalf("decode(%v) = _, nil, want error", tc.pkt)
+			}
+			if tc.wantErr != nil && err != tc.wantErr {
+				t.Errorf("decode(%v) = _, %v, want %v", tc.pkt, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+)
+
+const defaultMaxTTL = 30
+
+// Hop is the reply to a trace probe sent with a given TTL.
+type Hop struct {
+	TTL int
+	// Result of the probe. The verdict is VerdictUnknown if the probe
+	// expired in transit ("time exceeded") or there was no reply
+	// ("timeout").
+	Result *Result
+}
+
+// final returns true if the probe reached the destination or was
+// rejected, so that larger TTLs would not get any further.
+func (h *Hop) final() bool {
+	return h.Result.Verdict != VerdictUnknown
+}
+
+// TraceReport is the outcome of a trace.
+type TraceReport struct {
+	Dest string
+	Port int
+	Hops []*Hop
+}
+
+// Reached returns true if the destination replied to the trace.
+func (r *TraceReport) Reached() bool {
+	if len(r.Hops) == 0 {
+		return false
+	}
+	v := r.Hops[len(r.Hops)-1].Result.Verdict
+	return v == VerdictOpen || v == VerdictClosed
+}
+
+func (r *TraceReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "trace to %s:%d\n", r.Dest, r.Port)
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, h := range r.Hops {
+		if h.Result.From == nil {
+			fmt.Fprintf(w, "%d\t*\t\t%s\n", h.TTL, h.Result.Reason)
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%v\t%v\t%s\n", h.TTL, h.Result.From, h.Result.RTT, h.Result.Reason)
+	}
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// TraceTCP sends TCP SYNs to dest:destPort with increasing TTLs, starting
+// at 1, and lists the hops that reply with ICMP time exceeded. The trace
+// stops at the SYN-ACK or RST from the destination, an ICMP unreachable or
+// maxTTL (30 if zero). All probes use the same source port so that they
+// follow the same path through load balancers. opt.TTL is ignored; opt may
+// be nil.
+func TraceTCP(src string, srcPort int, dest string, destPort int, magic string, maxTTL int, opt *Options) (*TraceReport, error) {
+	if maxTTL == 0 {
+		maxTTL = defaultMaxTTL
+	}
+	if maxTTL < 0 || maxTTL > 255 {
+		return nil, fmt.Errorf("invalid max TTL %d", maxTTL)
+	}
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
+	if err != nil {
+		return nil, err
+	}
+	if srcPort, err = sourcePort(srcPort, tcpProtoNum); err != nil {
+		return nil, err
+	}
+
+	report := &TraceReport{Dest: destAddr.IP.String(), Port: destPort}
+	for ttl := 1; ttl <= maxTTL; ttl++ {
+		hop, err := traceHop(srcAddr, destAddr, srcPort, destPort, ttl, magic, opt)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(2).Infof("Trace hop %d: %v", ttl, hop.Result)
+		report.Hops = append(report.Hops, hop)
+		if hop.final() {
+			break
+		}
+	}
+	return report, nil
+}
+
+// traceHop sends a single trace probe with the given TTL.
+func traceHop(srcAddr, destAddr *net.IPAddr, srcPort, destPort, ttl int, magic string, opt *Options) (*Hop, error) {
+	id, payload, err := newPayload(magic)
+	if err != nil {
+		return nil, err
+	}
+
+	tcp := &tcpPacket{
+		srcPort:  uint16(srcPort),
+		destPort: uint16(destPort),
+		flags:    tcpFlags{syn: true},
+		seq:      traceSeq(id.ID, ttl),
+	}
+	if opt != nil {
+		tcp.options = probeTCPOptions(opt.TCPOptions, id)
+	}
+	pkt := make([]byte, tcp.headerLen()+len(payload))
+	n, err := tcp.encode(pkt, srcAddr.IP, destAddr.IP, payload)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("Encoded trace TCP (ttl %d, %d bytes, identity %v): %v", ttl, n, id, pkt[:n])
+
+	classify := classifyTrace(tcp, srcAddr.IP, destAddr.IP, len(payload))
+	result, err := send(srcAddr, destAddr, tcpProtoNum, id, pkt[:n], classify, VerdictUnknown, opt.withTTL(ttl))
+	if err != nil {
+		return nil, err
+	}
+	return &Hop{TTL: ttl, Result: result}, nil
+}
+
+// traceSeq returns the sequence number for a trace probe. The low byte is
+// the TTL so that the hop can be recovered from the quoted header (e.g. in
+// a packet capture).
+func traceSeq(id uint64, ttl int) uint32 {
+	return uint32(id)&^0xff | uint32(ttl&0xff)
+}
+
+// classifyTrace matches ICMP time exceeded messages quoting the TCP probe
+// as well as the replies matched by classifyTCP. Time exceeded has
+// VerdictUnknown.
+func classifyTrace(tcp *tcpPacket, src, dest net.IP, dataLen int) classifier {
+	classify := classifyTCP(tcp, src, dest, dataLen)
+	return func(r *reply) (Verdict, string, bool) {
+		if q, ok := decodeICMPQuote(r); ok && isTimeExceeded(r.proto, q.typ) {
+			if q.matches(tcpProtoNum, dest, func(quoted []byte) bool {
+				decoder := binary.BigEndian
+				return decoder.Uint16(quoted) == tcp.srcPort &&
+					decoder.Uint16(quoted[2:]) == tcp.destPort &&
+					decoder.Uint32(quoted[4:]) == tcp.seq
+			}) {
+				return VerdictUnknown, "time exceeded", true
+			}
+		}
+		return classify(r)
+	}
+}
+
+// isTimeExceeded returns true if the ICMP (or ICMPv6) type is time
+// exceeded.
+func isTimeExceeded(proto int, typ uint8) bool {
+	if proto == icmpv6ProtoNum {
+		return typ == icmpv6TypeTimeExceeded
+	}
+	return typ == icmpTypeTimeExceeded
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// timeExceeded returns an ICMP time exceeded message quoting the first 8
+// bytes of the TCP segment tcp sent from src to dest.
+func timeExceeded(tcp *tcpPacket, src, dest net.IP) []byte {
+	seg := make([]byte, tcpHeaderSize)
+	tcp.encode(seg, src, dest, nil)
+	if dest.To4() == nil {
+		ip := &ipv6Header{nextHeader: tcpProtoNum, hopLimit: 1, src: src, dest: dest}
+		pkt := make([]byte, ipv6HeaderSize+len(seg))
+		ip.encode(pkt, seg)
+		return append([]byte{icmpv6TypeTimeExceeded, 0, 0, 0, 0, 0, 0, 0}, pkt[:ipv6HeaderSize+8]...)
+	}
+	ip := &ipv4Header{ttl: 1, protocol: tcpProtoNum, src: src, dest: dest}
+	pkt := make([]byte, ip.headerLen()+len(seg))
+	ip.encode(pkt, seg)
+	return append([]byte{icmpTypeTimeExceeded, 0, 0, 0, 0, 0, 0, 0}, pkt[:ip.headerLen()+8]...)
+}
+
+func TestTraceSeq(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		id   uint64
+		ttl  int
+		want uint32
+	}{
+		{id: 0x1122334455667788, ttl: 1, want: 0x55667701},
+		{id: 0x1122334455667788, ttl: 30, want: 0x5566771e},
+		{id: 0xff, ttl: 255, want: 0xff},
+	} {
+		if got := traceSeq(tc.id, tc.ttl); got != tc.want {
+			t.Errorf("traceSeq(%#x, %d) = %#x, want %#x", tc.id, tc.ttl, got, tc.want)
+		}
+	}
+}
+
+func TestClassifyTrace(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc              string
+		src, dest, router net.IP
+		icmp              int
+	}{
+		{desc: "ipv4", src: net.ParseIP("10.0.0.1"), dest: net.ParseIP("10.0.1.2"), router: net.ParseIP("10.0.0.254"), icmp: icmpProtoNum},
+		{desc: "ipv6", src: net.ParseIP("2001:db8::1"), dest: net.ParseIP("2001:db8:1::2"), router: net.ParseIP("2001:db8::fe"), icmp: icmpv6ProtoNum},
+	} {
+		probe := &tcpPacket{srcPort: 3000, destPort: 80, seq: 0x1234, flags: tcpFlags{syn: true}}
+		classify := classifyTrace(probe, tc.src, tc.dest, 0)
+
+		r := &reply{proto: tc.icmp, from: tc.router, data: timeExceeded(probe, tc.src, tc.dest)}
+		if verdict, reason, ok := classify(r); !ok || verdict != VerdictUnknown || reason != "time exceeded" {
+			t.Errorf("%s: classify(time exceeded) = %v, %q, %t; want %v, %q, true", tc.desc, verdict, reason, ok, VerdictUnknown, "time exceeded")
+		}
+
+		other := *probe
+		other.seq++
+		r = &reply{proto: tc.icmp, from: tc.router, data: timeExceeded(&other, tc.src, tc.dest)}
+		if _, _, ok := classify(r); ok {
+			t.Errorf("%s: classify(time exceeded for another probe) = _, _, true, want false", tc.desc)
+		}
+
+		seg := make([]byte, tcpHeaderSize)
+		(&tcpPacket{srcPort: 80, destPort: 3000, ack: 0x1235, flags: tcpFlags{syn: true, ack: true}}).encode(seg, tc.dest, tc.src, nil)
+		r = &reply{proto: tcpProtoNum, from: tc.dest, data: seg}
+		if verdict, _, ok := classify(r); !ok || verdict != VerdictOpen {
+			t.Errorf("%s: classify(syn-ack) = %v, _, %t; want %v, _, true", tc.desc, verdict, ok, VerdictOpen)
+		}
+	}
+}
+
+func TestTraceReport(t *testing.T) {
+	t.Parallel()
+
+	report := &TraceReport{
+		Dest: "10.0.1.2",
+		Port: 80,
+		Hops: []*Hop{
+			{TTL: 1, Result: &Result{Verdict: VerdictUnknown, Reason: "time exceeded", From: net.ParseIP("10.0.0.254")}},
+			{TTL: 2, Result: &Result{Verdict: VerdictUnknown, Reason: "timeout"}},
+		},
+	}
+	if report.Reached() || report.Hops[1].final() {
+		t.Errorf("Reached() = true, want false")
+	}
+	report.Hops = append(report.Hops, &Hop{TTL: 3, Result: &Result{Verdict: VerdictClosed, Reason: "rst", From: net.ParseIP("10.0.1.2")}})
+	if !report.Reached() || !report.Hops[2].final() {
+		t.Errorf("Reached() = false, want true")
+	}
+	s := report.String()
+	for _, want := range []string{"trace to 10.0.1.2:80", "10.0.0.254", "*", "rst"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String() = %q, want it to contain %q", s, want)
+		}
+	}
+}
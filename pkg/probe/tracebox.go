@@ -0,0 +1,371 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// defaultTraceboxOptions are sent if no TCP options are given, so that
+// MSS clamping and stripped options show up.
+var defaultTraceboxOptions = []TCPOption{
+	TCPOptionMSS(1460),
+	TCPOptionSACKPermitted(),
+	TCPOptionTimestamps(0, 0),
+	TCPOptionNOP(),
+	TCPOptionWindowScale(7),
+}
+
+// FieldChange is a header field that differs between the probe that was
+// sent and the quotation of it.
+type FieldChange struct {
+	// Field is the name of the field, e.g. "ip.ttl" or "tcp.mss".
+	Field string
+	// Sent and Quoted are the values. Quoted is "-" if the field was
+	// removed and Sent is "-" if it was added.
+	Sent, Quoted string
+}
+
+func (c *FieldChange) String() string {
+	return fmt.Sprintf("%s %s -> %s", c.Field, c.Sent, c.Quoted)
+}
+
+// BoxHop is the outcome of a tracebox probe with a given TTL.
+type BoxHop struct {
+	TTL    int
+	Result *Result
+	// Quoted is the number of bytes of the TCP segment in the quotation,
+	// zero if the probe was not quoted.
+	Quoted int
+	// Changes are the fields of the quotation that differ from the probe.
+	Changes []*FieldChange
+}
+
+// BoxReport is the outcome of Tracebox.
+type BoxReport struct {
+	Dest string
+	Port int
+	Hops []*BoxHop
+}
+
+func (r *BoxReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "tracebox to %s:%d\n", r.Dest, r.Port)
+	// first maps a field to the first hop where the change was seen.
+	first := map[string]*BoxHop{}
+	var fields []string
+	for _, h := range r.Hops {
+		if h.Result.From == nil {
+			fmt.Fprintf(&buf, "%d *\n", h.TTL)
+			continue
+		}
+		fmt.Fprintf(&buf, "%d %v %s", h.TTL, h.Result.From, h.Result.Reason)
+		if h.Quoted == 0 {
+			buf.WriteString("\n")
+			continue
+		}
+		var changes []string
+		for _, c := range h.Changes {
+			changes = append(changes, c.String())
+			if _, ok := first[c.Field]; !ok {
+				first[c.Field] = h
+				fields = append(fields, c.Field)
+			}
+		}
+		if len(changes) == 0 {
+			changes = []string{"no changes"}
+		}
+		fmt.Fprintf(&buf, ", %d bytes quoted: %s\n", h.Quoted, strings.Join(changes, ", "))
+	}
+	if len(fields) == 0 {
+		buf.WriteString("no modifications seen")
+		return buf.String()
+	}
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		h := first[f]
+		fmt.Fprintf(&buf, "%s first modified before hop %d (%v)", f, h.TTL, h.Result.From)
+	}
+	return buf.String()
+}
+
+// Tracebox detects middleboxes that modify the probe in transit. Like
+// TraceTCP, it sends SYNs with increasing TTLs; the header of the probe
+// that each hop quotes in its ICMP time exceeded message is compared field
+// by field against the probe that was sent. Routers that follow RFC 1812
+// quote the whole header, so rewritten TCP options (e.g. MSS clamping) are
+// visible; others only quote the first 8 bytes of the TCP header. The
+// probes carry opt.TCPOptions, or a typical set of options if there are
+// none. opt.TTL is ignored; opt may be nil.
+func Tracebox(src string, srcPort int, dest string, destPort int, magic string, maxTTL int, opt *Options) (*BoxReport, error) {
+	if maxTTL == 0 {
+		maxTTL = defaultMaxTTL
+	}
+	if maxTTL < 0 || maxTTL > 255 {
+		return nil, fmt.Errorf("invalid max TTL %d", maxTTL)
+	}
+	srcAddr, destAddr, err := resolveAddrs(src, dest)
+	if err != nil {
+		return nil, err
+	}
+	if srcPort, err = sourcePort(srcPort, tcpProtoNum); err != nil {
+		return nil, err
+	}
+
+	report := &BoxReport{Dest: destAddr.IP.String(), Port: destPort}
+	for ttl := 1; ttl <= maxTTL; ttl++ {
+		hop, err := traceboxHop(srcAddr, destAddr, srcPort, destPort, ttl, magic, opt)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(2).Infof("Tracebox hop %d: %v %v", ttl, hop.Result, hop.Changes)
+		report.Hops = append(report.Hops, hop)
+		if hop.Result.Verdict != VerdictUnknown {
+			break
+		}
+	}
+	return report, nil
+}
+
+func traceboxHop(srcAddr, destAddr *net.IPAddr, srcPort, destPort, ttl int, magic string, opt *Options) (*BoxHop, error) {
+	id, payload, err := newPayload(magic)
+	if err != nil {
+		return nil, err
+	}
+	hopOpt := opt.withTTL(ttl)
+	v6 := destAddr.IP.To4() == nil
+	if !v6 && hopOpt.IPID == 0 {
+		// The IP ID must be known to tell if it was changed.
+		ipID, err := randomInt(0xffff)
+		if err != nil {
+			return nil, err
+		}
+		hopOpt.IPID = ipID + 1
+	}
+
+	tcp := &tcpPacket{
+		srcPort:  uint16(srcPort),
+		destPort: uint16(destPort),
+		flags:    tcpFlags{syn: true},
+		seq:      traceSeq(id.ID, ttl),
+		options:  defaultTraceboxOptions,
+	}
+	if len(hopOpt.TCPOptions) > 0 {
+		tcp.options = hopOpt.TCPOptions
+	}
+	tcp.options = probeTCPOptions(tcp.options, id)
+	pkt := make([]byte, tcp.headerLen()+len(payload))
+	n, err := tcp.encode(pkt, srcAddr.IP, destAddr.IP, payload)
+	if err != nil {
+		return nil, err
+	}
+	seg := pkt[:n]
+
+	var quote *icmpQuote
+	classify := classifyTracebox(tcp, srcAddr.IP, destAddr.IP, len(payload), &quote)
+	result, err := send(srcAddr, destAddr, tcpProtoNum, id, seg, classify, VerdictUnknown, hopOpt)
+	if err != nil {
+		return nil, err
+	}
+
+	hop := &BoxHop{TTL: ttl, Result: result}
+	if quote == nil {
+		return hop, nil
+	}
+	hop.Quoted = len(quote.data)
+	if quote.ipv4 != nil {
+		sent := &ipv4Header{
+			tos:          hopOpt.tos(),
+			totalLen:     uint16(ipv4MinHeaderSize + len(seg)),
+			id:           uint16(hopOpt.IPID),
+			dontFragment: hopOpt.DontFragment,
+			protocol:     tcpProtoNum,
+			src:          srcAddr.IP,
+			dest:         destAddr.IP,
+		}
+		hop.Changes = diffIPv4(sent, quote.ipv4)
+	} else {
+		sent := &ipv6Header{
+			trafficClass: hopOpt.tos(),
+			flowLabel:    uint32(hopOpt.FlowLabel),
+			payloadLen:   uint16(len(seg)),
+			nextHeader:   tcpProtoNum,
+			src:          srcAddr.IP,
+			dest:         destAddr.IP,
+		}
+		hop.Changes = diffIPv6(sent, quote.ipv6)
+	}
+	hop.Changes = append(hop.Changes, diffTCP(seg, quote.data)...)
+	return hop, nil
+}
+
+// classifyTracebox matches ICMP time exceeded messages quoting the TCP
+// probe, stores them in quote and otherwise behaves like classifyTCP. The
+// quote matches if either the source port or the sequence number is
+// unchanged, as either may be rewritten.
+func classifyTracebox(tcp *tcpPacket, src, dest net.IP, dataLen int, quote **icmpQuote) classifier {
+	classify := classifyTCP(tcp, src, dest, dataLen)
+	return func(r *reply) (Verdict, string, bool) {
+		if q, ok := decodeICMPQuote(r); ok && isTimeExceeded(r.proto, q.typ) {
+			if q.matches(tcpProtoNum, dest, func(quoted []byte) bool {
+				decoder := binary.BigEndian
+				return decoder.Uint16(quoted[2:]) == tcp.destPort &&
+					(decoder.Uint16(quoted) == tcp.srcPort || decoder.Uint32(quoted[4:]) == tcp.seq)
+			}) {
+				*quote = q
+				return VerdictUnknown, "time exceeded", true
+			}
+		}
+		return classify(r)
+	}
+}
+
+// diffIPv4 compares the quoted IPv4 header against the one that was sent.
+// The TTL of the quote should be 1 (or 0 if the router quotes the header
+// after decrementing it).
+func diffIPv4(sent, quoted *ipv4Header) []*FieldChange {
+	var changes fieldChanges
+	changes.add("ip.dscp", sent.tos>>2, quoted.tos>>2)
+	changes.add("ip.ecn", ECNCodepoint(sent.tos&ecnMask), ECNCodepoint(quoted.tos&ecnMask))
+	changes.add("ip.len", sent.totalLen, quoted.totalLen)
+	changes.add("ip.id", sent.id, quoted.id)
+	changes.add("ip.df", sent.dontFragment, quoted.dontFragment)
+	if quoted.ttl > 1 {
+		changes.add("ip.ttl", 1, quoted.ttl)
+	}
+	changes.add("ip.proto", sent.protocol, quoted.protocol)
+	changes.add("ip.src", sent.src, quoted.src)
+	changes.add("ip.dst", sent.dest, quoted.dest)
+	changes.add("ip.options", fmt.Sprintf("%x", sent.options), fmt.Sprintf("%x", quoted.options))
+	return changes
+}
+
+// diffIPv6 compares the quoted IPv6 header against the one that was sent.
+// The flow label is only compared if it was set.
+func diffIPv6(sent, quoted *ipv6Header) []*FieldChange {
+	var changes fieldChanges
+	changes.add("ip.dscp", sent.trafficClass>>2, quoted.trafficClass>>2)
+	changes.add("ip.ecn", ECNCodepoint(sent.trafficClass&ecnMask), ECNCodepoint(quoted.trafficClass&ecnMask))
+	if sent.flowLabel != 0 {
+		changes.add("ip.flowlabel", sent.flowLabel, quoted.flowLabel)
+	}
+	changes.add("ip.len", sent.payloadLen, quoted.payloadLen)
+	changes.add("ip.next", sent.nextHeader, quoted.nextHeader)
+	if quoted.hopLimit > 1 {
+		changes.add("ip.hlim", 1, quoted.hopLimit)
+	}
+	changes.add("ip.src", sent.src, quoted.src)
+	changes.add("ip.dst", sent.dest, quoted.dest)
+	return changes
+}
+
+// diffTCP compares the quoted TCP segment against the encoded segment that
+// was sent. Only the fields that are fully quoted are compared; the
+// options are compared if the whole header was quoted.
+func diffTCP(sent, quoted []byte) []*FieldChange {
+	var s, q tcpPacket
+	// Decoding the sent segment cannot fail.
+	s.decode(sent, nil, nil)
+
+	var changes fieldChanges
+	decoder := binary.BigEndian
+	if len(quoted) >= 8 {
+		changes.add("tcp.sport", s.srcPort, decoder.Uint16(quoted))
+		changes.add("tcp.dport", s.destPort, decoder.Uint16(quoted[2:]))
+		changes.add("tcp.seq", s.seq, decoder.Uint32(quoted[4:]))
+	}
+	if len(quoted) < tcpHeaderSize {
+		return changes
+	}
+	// The fixed fields are decoded even if the options are truncated.
+	if _, err := q.decode(quoted, nil, nil); err != nil && err != ErrTruncated {
+		return append(changes, &FieldChange{Field: "tcp.header", Sent: "valid", Quoted: err.Error()})
+	}
+	changes.add("tcp.ack", s.ack, q.ack)
+	changes.add("tcp.off", s.dataOffset, q.dataOffset)
+	changes.add("tcp.flags", s.flags, q.flags)
+	changes.add("tcp.win", s.windowSize, q.windowSize)
+	changes.add("tcp.urg", s.urgentPtr, q.urgentPtr)
+	if len(quoted) < int(q.dataOffset)*4 {
+		return changes
+	}
+	changes = append(changes, diffTCPOptions(s.options, q.options)...)
+	// The checksum changes with any other field, so it is only reported
+	// if nothing else in the segment changed.
+	if len(changes) == 0 && len(quoted) >= len(sent) {
+		changes.add("tcp.checksum", s.checksum, q.checksum)
+	}
+	return changes
+}
+
+// diffTCPOptions compares TCP options by kind, ignoring padding.
+func diffTCPOptions(sent, quoted []TCPOption) []*FieldChange {
+	var changes fieldChanges
+	used := make([]bool, len(quoted))
+	for _, s := range sent {
+		if s.singleByte() {
+			continue
+		}
+		name := "tcp." + tcpOptionName(s)
+		found := false
+		for i, q := range quoted {
+			if used[i] || q.Kind != s.Kind {
+				continue
+			}
+			used[i], found = true, true
+			changes.add(name, s, q)
+			break
+		}
+		if !found {
+			changes = append(changes, &FieldChange{Field: name, Sent: s.String(), Quoted: "-"})
+		}
+	}
+	for i, q := range quoted {
+		if !used[i] && !q.singleByte() {
+			changes = append(changes, &FieldChange{Field: "tcp." + tcpOptionName(q), Sent: "-", Quoted: q.String()})
+		}
+	}
+	return changes
+}
+
+// tcpOptionName returns the name of the option without its value, e.g.
+// "mss".
+func tcpOptionName(o TCPOption) string {
+	name := o.String()
+	if i := strings.IndexByte(name, '='); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// fieldChanges accumulates the fields that differ.
+type fieldChanges []*FieldChange
+
+func (c *fieldChanges) add(field string, sent, quoted interface{}) {
+	s, q := fmt.Sprint(sent), fmt.Sprint(quoted)
+	if s != q {
+		*c = append(*c, &FieldChange{Field: field, Sent: s, Quoted: q})
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffTCP(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.1.2")
+	encode := func(tcp *tcpPacket) []byte {
+		b := make([]byte, tcp.headerLen())
+		tcp.encode(b, src, dest, nil)
+		return b
+	}
+	sentTCP := &tcpPacket{
+		srcPort:    3000,
+		destPort:   80,
+		seq:        100,
+		flags:      tcpFlags{syn: true},
+		windowSize: 1024,
+		options:    []TCPOption{TCPOptionMSS(1460), TCPOptionSACKPermitted(), TCPOptionNOP(), TCPOptionWindowScale(7)},
+	}
+	sent := encode(sentTCP)
+
+	modified := func(f func(tcp *tcpPacket)) []byte {
+		tcp := *sentTCP
+		f(&tcp)
+		return encode(&tcp)
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		quoted []byte
+		want   []FieldChange
+	}{
+		{desc: "unchanged", quoted: sent},
+		{desc: "unchanged 8 bytes", quoted: sent[:8]},
+		{
+			desc:   "seq randomized, 8 bytes",
+			quoted: modified(func(tcp *tcpPacket) { tcp.seq = 5000 })[:8],
+			want:   []FieldChange{{"tcp.seq", "100", "5000"}},
+		},
+		{
+			desc: "mss clamped and window changed",
+			quoted: modified(func(tcp *tcpPacket) {
+				tcp.windowSize = 512
+				tcp.options = []TCPOption{TCPOptionMSS(1360), TCPOptionSACKPermitted(), TCPOptionNOP(), TCPOptionWindowScale(7)}
+			}),
+			want: []FieldChange{{"tcp.win", "1024", "512"}, {"tcp.mss", "mss=1460", "mss=1360"}},
+		},
+		{
+			desc: "option stripped",
+			quoted: modified(func(tcp *tcpPacket) {
+				tcp.options = []TCPOption{TCPOptionMSS(1460), TCPOptionNOP(), TCPOptionNOP(), TCPOptionNOP(), TCPOptionWindowScale(7)}
+			}),
+			want: []FieldChange{{"tcp.sackok", "sackok", "-"}},
+		},
+		{
+			desc: "options truncated",
+			quoted: modified(func(tcp *tcpPacket) {
+				tcp.windowSize = 512
+			})[:tcpHeaderSize+2],
+			want: []FieldChange{{"tcp.win", "1024", "512"}},
+		},
+	} {
+		var got []FieldChange
+		for _, c := range diffTCP(sent, tc.quoted) {
+			got = append(got, *c)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: diffTCP() = %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestDiffIP(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.1.2")
+	sent4 := &ipv4Header{tos: 0xb8, totalLen: 60, id: 7, protocol: tcpProtoNum, src: src, dest: dest}
+	quoted4 := *sent4
+	quoted4.ttl = 1
+	if got := diffIPv4(sent4, &quoted4); len(got) != 0 {
+		t.Errorf("diffIPv4(unchanged) = %v, want none", got)
+	}
+	quoted4.tos = 0x01
+	quoted4.ttl = 3
+	quoted4.src = net.ParseIP("192.168.0.1")
+	var got []FieldChange
+	for _, c := range diffIPv4(sent4, &quoted4) {
+		got = append(got, *c)
+	}
+	want := []FieldChange{
+		{"ip.dscp", "46", "0"},
+		{"ip.ecn", "not-ect", "ect1"},
+		{"ip.ttl", "1", "3"},
+		{"ip.src", "10.0.0.1", "192.168.0.1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffIPv4() = %v, want %v", got, want)
+	}
+
+	sent6 := &ipv6Header{payloadLen: 40, nextHeader: tcpProtoNum, src: net.ParseIP("2001:db8::1"), dest: net.ParseIP("2001:db8::2")}
+	quoted6 := *sent6
+	quoted6.flowLabel = 0x12345
+	quoted6.trafficClass = 0x02
+	got = nil
+	for _, c := range diffIPv6(sent6, &quoted6) {
+		got = append(got, *c)
+	}
+	want = []FieldChange{{"ip.ecn", "not-ect", "ect0"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffIPv6() = %v, want %v", got, want)
+	}
+}
+
+func TestClassifyTracebox(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("10.0.0.1")
+	dest := net.ParseIP("10.0.1.2")
+	router := net.ParseIP("10.0.0.254")
+	probe := &tcpPacket{srcPort: 3000, destPort: 80, seq: 0x1234, flags: tcpFlags{syn: true}}
+
+	for _, tc := range []struct {
+		desc   string
+		quoted tcpPacket
+		want   bool
+	}{
+		{desc: "unchanged", quoted: *probe, want: true},
+		{desc: "source port rewritten", quoted: tcpPacket{srcPort: 4000, destPort: 80, seq: 0x1234}, want: true},
+		{desc: "seq rewritten", quoted: tcpPacket{srcPort: 3000, destPort: 80, seq: 0x9999}, want: true},
+		{desc: "both rewritten", quoted: tcpPacket{srcPort: 4000, destPort: 80, seq: 0x9999}},
+		{desc: "other port", quoted: tcpPacket{srcPort: 3000, destPort: 81, seq: 0x1234}},
+	} {
+		var quote *icmpQuote
+		classify := classifyTracebox(probe, src, dest, 0, &quote)
+		_, _, ok := classify(&reply{proto: icmpProtoNum, from: router, data: timeExceeded(&tc.quoted, src, dest)})
+		if ok != tc.want || (quote != nil) != tc.want {
+			t.Errorf("%s: classify() = _, _, %t (quote %v), want %t", tc.desc, ok, quote, tc.want)
+		}
+	}
+}
+
+func TestBoxReport(t *testing.T) {
+	t.Parallel()
+
+	report := &BoxReport{
+		Dest: "10.0.1.2",
+		Port: 80,
+		Hops: []*BoxHop{
+			{TTL: 1, Result: &Result{Reason: "time exceeded", From: net.ParseIP("10.0.0.254")}, Quoted: 8},
+			{TTL: 2, Result: &Result{Reason: "timeout"}},
+			{TTL: 3, Result: &Result{Reason: "time exceeded", From: net.ParseIP("10.0.2.254")}, Quoted: 28, Changes: []*FieldChange{{"tcp.mss", "mss=1460", "mss=1360"}}},
+			{TTL: 4, Result: &Result{Verdict: VerdictOpen, Reason: "syn-ack", From: net.ParseIP("10.0.1.2")}},
+		},
+	}
+	s := report.String()
+	for _, want := range []string{"1 10.0.0.254 time exceeded, 8 bytes quoted: no changes", "2 *", "tcp.mss mss=1460 -> mss=1360", "tcp.mss first modified before hop 3 (10.0.2.254)"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String() = %q, want it to contain %q", s, want)
+		}
+	}
+}
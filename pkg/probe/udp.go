@@ -0,0 +1,89 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	udpHeaderSize = 8
+	udpProtoNum   = 17
+)
+
+type udpPacket struct {
+	srcPort  uint16 // 0
+	destPort uint16 // 2
+	length   uint16 // 4 (only set by decode)
+	checksum uint16 // 6 (only set by decode)
+}
+
+func (u *udpPacket) encode(pkt []byte, src, dest net.IP, data []byte) int {
+	encoder := binary.BigEndian
+	encoder.PutUint16(pkt, u.srcPort)
+	encoder.PutUint16(pkt[2:], u.destPort)
+	encoder.PutUint16(pkt[4:], uint16(udpHeaderSize+len(data)))
+	pkt[6] = 0
+	pkt[7] = 0
+
+	checksum := checksumUDP(src, dest, pkt[:udpHeaderSize], data)
+	pkt[6] = uint8(checksum & 0xff)
+	pkt[7] = uint8(checksum >> 8)
+
+	copy(pkt[udpHeaderSize:], data)
+
+	return udpHeaderSize + len(data)
+}
+
+// decode the packet from pkt and return the data. The checksum is validated
+// if src and dest are given; ErrBadChecksum is returned if it is invalid
+// but the packet is still decoded.
+func (u *udpPacket) decode(pkt []byte, src, dest net.IP) ([]byte, error) {
+	if len(pkt) < udpHeaderSize {
+		return nil, ErrTruncated
+	}
+
+	decoder := binary.BigEndian
+	u.srcPort = decoder.Uint16(pkt)
+	u.destPort = decoder.Uint16(pkt[2:])
+	u.length = decoder.Uint16(pkt[4:])
+	u.checksum = decoder.Uint16(pkt[6:])
+
+	if int(u.length) < udpHeaderSize || int(u.length) > len(pkt) {
+		return nil, ErrTruncated
+	}
+	data := pkt[udpHeaderSize:u.length]
+
+	// A zero checksum means the sender did not compute one (IPv4 only).
+	if u.checksum == 0 && src.To4() != nil {
+		return data, nil
+	}
+	if src != nil && dest != nil && checksumPseudo(src, dest, udpProtoNum, pkt[:udpHeaderSize], data) != 0 {
+		return data, ErrBadChecksum
+	}
+	return data, nil
+}
+
+func checksumUDP(src, dest net.IP, udpHeader, data []byte) uint16 {
+	checksum := checksumPseudo(src, dest, udpProtoNum, udpHeader, data)
+	// Zero is reserved to mean "no checksum" (RFC 768).
+	if checksum == 0 {
+		return 0xffff
+	}
+	return checksum
+}
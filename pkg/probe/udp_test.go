@@ -0,0 +1,67 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestUDPEncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("127.0.0.1")
+	dest := net.ParseIP("127.0.0.1")
+	udp := udpPacket{srcPort: 53, destPort: 5353}
+	data := []byte("hi")
+	want := []byte{
+		0x00, 0x35, 0x14, 0xe9, 0x00, 0x0a, 0x84, 0x50,
+		'h', 'i',
+	}
+
+	pkt := make([]byte, udpHeaderSize+len(data))
+	n := udp.encode(pkt, src, dest, data)
+	if !reflect.DeepEqual(pkt[:n], want) {
+		t.Errorf("udp.encode() = %v, want %v", pkt[:n], want)
+	}
+
+	var got udpPacket
+	gotData, err := got.decode(append(pkt[:n], 0x00, 0x00), src, dest)
+	if err != nil {
+		t.Fatalf("decode(%v) = _, %v, want nil", pkt[:n], err)
+	}
+	if got.srcPort != udp.srcPort || got.destPort != udp.destPort || got.length != 10 {
+		t.Errorf("decode(%v) = %+v, want ports %d > %d, length 10", pkt[:n], got, udp.srcPort, udp.destPort)
+	}
+	if !reflect.DeepEqual(gotData, data) {
+		t.Errorf("decode(%v) = %v, want %v", pkt[:n], gotData, data)
+	}
+
+	pkt[7]++
+	if _, err := got.decode(pkt[:n], src, dest); err != ErrBadChecksum {
+		t.Errorf("decode(%v) = _, %v, want %v", pkt[:n], err, ErrBadChecksum)
+	}
+	// Zero means no checksum for IPv4.
+	pkt[6], pkt[7] = 0, 0
+	if _, err := got.decode(pkt[:n], src, dest); err != nil {
+		t.Errorf("decode(%v) = _, %v, want nil", pkt[:n], err)
+	}
+	if _, err := got.decode(pkt[:n-1], src, dest); err != ErrTruncated {
+		t.Errorf("decode(%v) = _, %v, want %v", pkt[:n-1], err, ErrTruncated)
+	}
+}
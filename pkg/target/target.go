@@ -0,0 +1,267 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package target expands target specifications (addresses, CIDR blocks,
+// hostnames, port ranges and target files) into the list of endpoints to
+// probe.
+package target
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxTargets is the largest number of targets a specification may expand
+// to. This guards against typos such as 10.0.0.0/8.
+var MaxTargets = 1 << 16
+
+// lookupIP resolves hostnames. It is a variable for testing.
+var lookupIP = net.LookupIP
+
+// Target is a single address and port.
+type Target struct {
+	// Name is the part of the specification the target came from, e.g.
+	// the hostname or CIDR block.
+	Name string
+	IP   net.IP
+	Port int
+}
+
+func (t Target) String() string {
+	return net.JoinHostPort(t.IP.String(), strconv.Itoa(t.Port))
+}
+
+// ParseAddrs parses a comma separated list of IP addresses, CIDR blocks
+// and hostnames. Hostnames are expanded to all of their A and AAAA
+// records. Duplicate addresses are removed.
+func ParseAddrs(spec string) ([]net.IP, []string, error) {
+	var (
+		ips   []net.IP
+		names []string
+		seen  = map[string]bool{}
+	)
+	add := func(ip net.IP, name string) error {
+		if seen[ip.String()] {
+			return nil
+		}
+		if len(ips) >= MaxTargets {
+			return fmt.Errorf("%q expands to more than %d addresses", spec, MaxTargets)
+		}
+		seen[ip.String()] = true
+		ips = append(ips, ip)
+		names = append(names, name)
+		return nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if ip := net.ParseIP(item); ip != nil {
+			if err := add(ip, item); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if strings.Contains(item, "/") {
+			_, ipNet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, nil, err
+			}
+			ones, bits := ipNet.Mask.Size()
+			if bits-ones >= 31 || 1<<uint(bits-ones) > MaxTargets {
+				return nil, nil, fmt.Errorf("%q expands to more than %d addresses", item, MaxTargets)
+			}
+			for ip := ipNet.IP; ipNet.Contains(ip); ip = nextIP(ip) {
+				if err := add(ip, item); err != nil {
+					return nil, nil, err
+				}
+			}
+			continue
+		}
+		resolved, err := lookupIP(item)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(resolved) == 0 {
+			return nil, nil, fmt.Errorf("%q has no addresses", item)
+		}
+		for _, ip := range resolved {
+			if err := add(ip, item); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, nil, fmt.Errorf("no addresses in %q", spec)
+	}
+	return ips, names, nil
+}
+
+// nextIP returns the address after ip. It wraps around to zero at the end
+// of the address space.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// ParsePorts parses a comma separated list of ports and port ranges, e.g.
+// "80,443,8000-8010". The ports are returned sorted, without duplicates.
+func ParsePorts(spec string) ([]int, error) {
+	seen := map[int]bool{}
+	var ports []int
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		low, high := item, item
+		if i := strings.IndexByte(item, '-'); i >= 0 {
+			low, high = item[:i], item[i+1:]
+		}
+		lo, err := parsePort(low)
+		if err != nil {
+			return nil, err
+		}
+		hi, err := parsePort(high)
+		if err != nil {
+			return nil, err
+		}
+		if lo > hi {
+			return nil, fmt.Errorf("invalid port range %q", item)
+		}
+		for p := lo; p <= hi; p++ {
+			if !seen[p] {
+				seen[p] = true
+				ports = append(ports, p)
+			}
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports in %q", spec)
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 0 || p > 0xffff {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return p, nil
+}
+
+// Expand returns the targets for every combination of the addresses in
+// addrSpec (see ParseAddrs) and the ports in portSpec (see ParsePorts).
+func Expand(addrSpec, portSpec string) ([]Target, error) {
+	ips, names, err := ParseAddrs(addrSpec)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := ParsePorts(portSpec)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips)*len(ports) > MaxTargets {
+		return nil, fmt.Errorf("%q and ports %q expand to more than %d targets", addrSpec, portSpec, MaxTargets)
+	}
+	var targets []Target
+	for i, ip := range ips {
+		for _, port := range ports {
+			targets = append(targets, Target{Name: names[i], IP: ip, Port: port})
+		}
+	}
+	return targets, nil
+}
+
+// Single returns the target for modes that probe one target. If targets
+// are the addresses of a single hostname and port (e.g. its A and AAAA
+// records), the first address is used.
+func Single(targets []Target) (Target, error) {
+	if len(targets) == 0 {
+		return Target{}, fmt.Errorf("no targets")
+	}
+	first := targets[0]
+	hostname := net.ParseIP(first.Name) == nil && !strings.Contains(first.Name, "/")
+	for _, t := range targets[1:] {
+		if !hostname || t.Name != first.Name || t.Port != first.Port {
+			return Target{}, fmt.Errorf("need a single target, got %d", len(targets))
+		}
+	}
+	return first, nil
+}
+
+// ReadFile reads targets from r. Each line has an address specification
+// (see ParseAddrs) and optionally a port specification (see ParsePorts),
+// separated by whitespace; defaultPorts is used if there is none. Blank
+// lines and lines starting with '#' are ignored. Duplicate targets are
+// removed.
+func ReadFile(r io.Reader, defaultPorts string) ([]Target, error) {
+	var (
+		targets []Target
+		seen    = map[string]bool{}
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		ports := defaultPorts
+		switch len(fields) {
+		case 1:
+		case 2:
+			ports = fields[1]
+		default:
+			return nil, fmt.Errorf("line %d: want \"<addresses> [ports]\", got %q", line, text)
+		}
+		expanded, err := Expand(fields[0], ports)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		for _, t := range expanded {
+			if seen[t.String()] {
+				continue
+			}
+			if len(targets) >= MaxTargets {
+				return nil, fmt.Errorf("line %d: more than %d targets", line, MaxTargets)
+			}
+			seen[t.String()] = true
+			targets = append(targets, t)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
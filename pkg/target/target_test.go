@@ -0,0 +1,225 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func fakeLookup(host string) ([]net.IP, error) {
+	switch host {
+	case "pool.example":
+		return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("fd00::1")}, nil
+	case "empty.example":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("no such host %q", host)
+}
+
+func init() {
+	lookupIP = fakeLookup
+}
+
+func ipStrings(ips []net.IP) []string {
+	var ret []string
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
+
+func TestParseAddrs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{spec: "1.2.3.4", want: []string{"1.2.3.4"}},
+		{spec: "1.2.3.4, ::1", want: []string{"1.2.3.4", "::1"}},
+		{spec: "1.2.3.4,1.2.3.4", want: []string{"1.2.3.4"}},
+		{spec: "10.0.0.0/30", want: []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{spec: "10.0.0.5/31", want: []string{"10.0.0.4", "10.0.0.5"}},
+		{spec: "10.0.0.255/31", want: []string{"10.0.0.254", "10.0.0.255"}},
+		{spec: "fd00::/126", want: []string{"fd00::", "fd00::1", "fd00::2", "fd00::3"}},
+		{spec: "pool.example", want: []string{"10.0.0.1", "10.0.0.2", "fd00::1"}},
+		{spec: "10.0.0.1,pool.example", want: []string{"10.0.0.1", "10.0.0.2", "fd00::1"}},
+		{spec: "10.0.0.0/8", wantErr: true},
+		{spec: "fd00::/64", wantErr: true},
+		{spec: "10.0.0.0/33", wantErr: true},
+		{spec: "bad.example", wantErr: true},
+		{spec: "empty.example", wantErr: true},
+		{spec: "", wantErr: true},
+		{spec: " , ", wantErr: true},
+	} {
+		ips, names, err := ParseAddrs(tc.spec)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("ParseAddrs(%q) = _, _, %v; want error %t", tc.spec, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		if got := ipStrings(ips); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseAddrs(%q) = %v; want %v", tc.spec, got, tc.want)
+		}
+		if len(names) != len(ips) {
+			t.Errorf("ParseAddrs(%q) returned %d names for %d addresses", tc.spec, len(names), len(ips))
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{spec: "80", want: []int{80}},
+		{spec: "443,80", want: []int{80, 443}},
+		{spec: "8000-8003", want: []int{8000, 8001, 8002, 8003}},
+		{spec: "80,79-81", want: []int{79, 80, 81}},
+		{spec: "0,65535", want: []int{0, 65535}},
+		{spec: "65536", wantErr: true},
+		{spec: "-1", wantErr: true},
+		{spec: "90-80", wantErr: true},
+		{spec: "http", wantErr: true},
+		{spec: "", wantErr: true},
+	} {
+		got, err := ParsePorts(tc.spec)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("ParsePorts(%q) = _, %v; want error %t", tc.spec, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParsePorts(%q) = %v; want %v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func targetStrings(targets []Target) []string {
+	var ret []string
+	for _, t := range targets {
+		ret = append(ret, t.String())
+	}
+	return ret
+}
+
+func TestExpand(t *testing.T) {
+	t.Parallel()
+
+	targets, err := Expand("10.0.0.0/31,::1", "80,443")
+	if err != nil {
+		t.Fatalf("Expand() = _, %v; want nil", err)
+	}
+	want := []string{"10.0.0.0:80", "10.0.0.0:443", "10.0.0.1:80", "10.0.0.1:443", "[::1]:80", "[::1]:443"}
+	if got := targetStrings(targets); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expand() = %v; want %v", got, want)
+	}
+	if targets[0].Name != "10.0.0.0/31" || targets[4].Name != "::1" {
+		t.Errorf("Expand() names = %q, %q; want \"10.0.0.0/31\", \"::1\"", targets[0].Name, targets[4].Name)
+	}
+
+	if _, err := Expand("10.0.0.0/16", "1-2"); err == nil {
+		t.Errorf("Expand(/16, 2 ports) = _, nil; want error")
+	}
+}
+
+func TestSingle(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		addrs, ports string
+		want         string
+		wantErr      bool
+	}{
+		{addrs: "10.0.0.1", ports: "80", want: "10.0.0.1:80"},
+		{addrs: "pool.example", ports: "80", want: "10.0.0.1:80"},
+		{addrs: "pool.example", ports: "80,443", wantErr: true},
+		{addrs: "10.0.0.0/31", ports: "80", wantErr: true},
+		{addrs: "10.0.0.1,10.0.0.2", ports: "80", wantErr: true},
+	} {
+		targets, err := Expand(tc.addrs, tc.ports)
+		if err != nil {
+			t.Fatalf("Expand(%q, %q) = _, %v; want nil", tc.addrs, tc.ports, err)
+		}
+		got, err := Single(targets)
+		if gotErr := err != nil; gotErr != tc.wantErr || !tc.wantErr && got.String() != tc.want {
+			t.Errorf("Single(%q, %q) = %v, %v; want %s, error %t", tc.addrs, tc.ports, got, err, tc.want, tc.wantErr)
+		}
+	}
+	if _, err := Single(nil); err == nil {
+		t.Errorf("Single(nil) = _, nil; want error")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{
+			desc: "default ports",
+			in:   "# nodes\n10.0.0.1\n\n  10.0.0.2  \n",
+			want: []string{"10.0.0.1:80", "10.0.0.2:80"},
+		},
+		{
+			desc: "per line ports",
+			in:   "10.0.0.1 443\npool.example 8000-8001\n",
+			want: []string{"10.0.0.1:443", "10.0.0.1:8000", "10.0.0.1:8001", "10.0.0.2:8000", "10.0.0.2:8001", "[fd00::1]:8000", "[fd00::1]:8001"},
+		},
+		{
+			desc: "duplicates",
+			in:   "10.0.0.1\n10.0.0.0/31\n",
+			want: []string{"10.0.0.1:80", "10.0.0.0:80"},
+		},
+		{
+			desc:    "too many fields",
+			in:      "10.0.0.1 80 443\n",
+			wantErr: true,
+		},
+		{
+			desc:    "bad address",
+			in:      "10.0.0.1\nbad.example\n",
+			wantErr: true,
+		},
+		{
+			desc: "empty",
+			in:   "# nothing\n",
+		},
+	} {
+		targets, err := ReadFile(strings.NewReader(tc.in), "80")
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: ReadFile() = _, %v; want error %t", tc.desc, err, tc.wantErr)
+			continue
+		}
+		if got := targetStrings(targets); !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: ReadFile() = %v; want %v", tc.desc, got, tc.want)
+		}
+	}
+}
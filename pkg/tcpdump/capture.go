@@ -0,0 +1,213 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpdump
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/flags"
+	"github.com/golang/glog"
+)
+
+// readyMessage is printed by tcpdump to stderr once it is capturing.
+const readyMessage = "listening on"
+
+// StopGracePeriod is how long Stop waits for tcpdump to exit after SIGINT
+// before killing it. It is read when the capture is started.
+var StopGracePeriod = 5 * time.Second
+
+// Capture is a running tcpdump.
+type Capture struct {
+	cmd         *exec.Cmd
+	ready       chan struct{}
+	done        chan struct{}
+	gracePeriod time.Duration
+
+	mu      sync.Mutex
+	stderr  []string
+	stopped bool
+	err     error
+}
+
+// Start tcpdump. The capture is stopped, as by Stop, when ctx is done.
+func (r *Runner) Start(ctx context.Context, opt *Options, filter string) (*Capture, error) {
+	if err := r.checkOptions(opt); err != nil {
+		return nil, err
+	}
+	if err := r.CheckFilter(filter); err != nil {
+		return nil, err
+	}
+	return startCapture(ctx, args(opt, filter), nil)
+}
+
+// startCapture runs tcpdump with args, writing its output to stdout, or
+// to the null device if stdout is nil.
+func startCapture(ctx context.Context, args []string, stdout io.Writer) (*Capture, error) {
+	cmd := &exec.Cmd{
+		Args:   append([]string{flags.TCPDumpExecutable}, args...),
+		Path:   flags.TCPDumpExecutable,
+		Stdout: stdout,
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	glog.V(4).Infof("tcpdump = %+v", cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	c := &Capture{
+		cmd:         cmd,
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+		gracePeriod: StopGracePeriod,
+	}
+	go c.wait(stderr)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Stop()
+		case <-c.done:
+		}
+	}()
+	return c, nil
+}
+
+// wait reads stderr until tcpdump exits, then reaps it.
+func (c *Capture) wait(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		glog.V(4).Infof("tcpdump: %s", line)
+		c.mu.Lock()
+		c.stderr = append(c.stderr, line)
+		c.mu.Unlock()
+		if strings.Contains(line, readyMessage) {
+			select {
+			case <-c.ready:
+			default:
+				close(c.ready)
+			}
+		}
+	}
+	// Drain stderr if a line was too long to scan.
+	io.Copy(ioutil.Discard, stderr)
+
+	err := c.cmd.Wait()
+	c.mu.Lock()
+	// tcpdump exits cleanly on SIGINT, unless the signal arrives before
+	// its handler is installed.
+	if c.stopped && err != nil && !c.cmd.ProcessState.Exited() {
+		err = nil
+	}
+	c.err = err
+	c.mu.Unlock()
+	close(c.done)
+}
+
+// Ready returns a channel that is closed once tcpdump is capturing.
+func (c *Capture) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// WaitReady blocks until tcpdump is capturing. It returns an error if
+// tcpdump exits first or ctx is done.
+func (c *Capture) WaitReady(ctx context.Context) error {
+	select {
+	case <-c.ready:
+		return nil
+	case <-c.done:
+		select {
+		case <-c.ready:
+			return nil
+		default:
+		}
+		if err := c.Wait(); err != nil {
+			return fmt.Errorf("tcpdump exited before capturing: %v (%s)", err, c.lastStderr())
+		}
+		return errors.New("tcpdump exited before capturing")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel that is closed when tcpdump exits.
+func (c *Capture) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait for tcpdump to exit. The error is nil if it exited successfully or
+// was stopped with Stop.
+func (c *Capture) Wait() error {
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Stop tcpdump with SIGINT, so that it flushes the capture, and wait for
+// it to exit. It is killed if it does not exit within StopGracePeriod.
+func (c *Capture) Stop() error {
+	c.mu.Lock()
+	c.stopped = true
+	c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.Wait()
+	default:
+	}
+	if err := c.cmd.Process.Signal(os.Interrupt); err != nil {
+		glog.V(2).Infof("Error interrupting tcpdump: %v", err)
+	}
+	timer := time.NewTimer(c.gracePeriod)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+	case <-timer.C:
+		glog.Warningf("tcpdump did not exit %v after SIGINT, killing it", c.gracePeriod)
+		c.cmd.Process.Kill()
+	}
+	return c.Wait()
+}
+
+// Stderr returns the lines tcpdump has written to stderr.
+func (c *Capture) Stderr() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.stderr...)
+}
+
+func (c *Capture) lastStderr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.stderr) == 0 {
+		return "no output"
+	}
+	return c.stderr[len(c.stderr)-1]
+}
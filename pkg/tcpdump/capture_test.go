@@ -0,0 +1,187 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpdump
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trapScript prints the ready message, then runs until SIGINT, on which it
+// writes "flushed" to marker and exits.
+func trapScript(marker string) string {
+	return fmt.Sprintf(`trap 'echo flushed > %s; exit 0' INT
+echo "tcpdump: listening on eth0, link-type EN10MB (Ethernet), snapshot length 262144 bytes" >&2
+while true; do sleep 0.01; done`, marker)
+}
+
+func checkFlushed(t *testing.T, marker string) {
+	if b, err := ioutil.ReadFile(marker); err != nil || strings.TrimSpace(string(b)) != "flushed" {
+		t.Errorf("tcpdump was not stopped with SIGINT (marker: %q, %v)", b, err)
+	}
+}
+
+func TestCaptureStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+	_, restore := fakeTCPDump(t, trapScript(marker))
+	defer restore()
+
+	c, err := (&Runner{}).Start(context.Background(), &Options{Interface: "eth0"}, "")
+	if err != nil {
+		t.Fatalf("Start() = _, %v; want nil", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady() = %v; want nil", err)
+	}
+	select {
+	case <-c.Done():
+		t.Fatalf("Done() is closed before Stop()")
+	default:
+	}
+	if err := c.Stop(); err != nil {
+		t.Errorf("Stop() = %v; want nil", err)
+	}
+	checkFlushed(t, marker)
+	if err := c.Wait(); err != nil {
+		t.Errorf("Wait() = %v; want nil", err)
+	}
+	if stderr := c.Stderr(); len(stderr) != 1 || !strings.Contains(stderr[0], readyMessage) {
+		t.Errorf("Stderr() = %q; want the ready message", stderr)
+	}
+}
+
+func TestCaptureContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+	_, restore := fakeTCPDump(t, trapScript(marker))
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := (&Runner{}).Start(ctx, &Options{}, "")
+	if err != nil {
+		t.Fatalf("Start() = _, %v; want nil", err)
+	}
+	<-c.Ready()
+	cancel()
+
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tcpdump still running 5s after the context was cancelled")
+	}
+	if err := c.Wait(); err != nil {
+		t.Errorf("Wait() = %v; want nil", err)
+	}
+	checkFlushed(t, marker)
+}
+
+func TestCaptureKill(t *testing.T) {
+	saved := StopGracePeriod
+	StopGracePeriod = 50 * time.Millisecond
+	defer func() { StopGracePeriod = saved }()
+
+	_, restore := fakeTCPDump(t, `trap '' INT
+echo "listening on eth0" >&2
+while true; do sleep 0.01; done`)
+	defer restore()
+
+	c, err := (&Runner{}).Start(context.Background(), &Options{}, "")
+	if err != nil {
+		t.Fatalf("Start() = _, %v; want nil", err)
+	}
+	<-c.Ready()
+	if err := c.Stop(); err != nil {
+		t.Errorf("Stop() = %v; want nil after killing tcpdump", err)
+	}
+}
+
+func TestCaptureNotReady(t *testing.T) {
+	_, restore := fakeTCPDump(t, `echo "tcpdump: eth9: No such device exists" >&2; exit 1`)
+	defer restore()
+
+	c, err := (&Runner{}).Start(context.Background(), &Options{Interface: "eth9"}, "")
+	if err != nil {
+		t.Fatalf("Start() = _, %v; want nil", err)
+	}
+	err = c.WaitReady(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "No such device") {
+		t.Errorf("WaitReady() = %v; want an error with the tcpdump message", err)
+	}
+	if err := c.Wait(); err == nil {
+		t.Errorf("Wait() = nil; want the exit status")
+	}
+	if err := c.Stop(); err == nil {
+		t.Errorf("Stop() after exit = nil; want the exit status")
+	}
+}
+
+func TestCaptureWaitReadyContext(t *testing.T) {
+	_, restore := fakeTCPDump(t, "exec sleep 60")
+	defer restore()
+
+	c, err := (&Runner{}).Start(context.Background(), &Options{}, "")
+	if err != nil {
+		t.Fatalf("Start() = _, %v; want nil", err)
+	}
+	defer c.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitReady() = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRun(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		filter  string
+		wantErr bool
+	}{
+		{body: "exit 0"},
+		{body: "exit 3", wantErr: true},
+		{body: "exit 0", filter: "bad", wantErr: true},
+		// tcpdump's text output goes to the null device, not a closed fd
+		// (which the args file would have reused).
+		{body: "[ -c /proc/$$/fd/1 ] || exit 3"},
+	} {
+		func() {
+			_, restore := fakeTCPDump(t, tc.body)
+			defer restore()
+			err := (&Runner{}).Run(&Options{}, tc.filter)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("Run() with %q = %v; want error %t", tc.body, err, tc.wantErr)
+			}
+		}()
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpdump
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+var (
+	// tcpdump: listening on eth0, link-type EN10MB (Ethernet), snapshot length 262144 bytes
+	// Older versions say "capture size" instead of "snapshot length".
+	listeningRE = regexp.MustCompile(`listening on (\S+), link-type (\S+) \(([^)]*)\), (?:snapshot length|capture size) (\d+) bytes`)
+	// 12 packets captured
+	counterRE = regexp.MustCompile(`^(\d+) packets? (captured|received by filter|dropped by kernel|dropped by interface)$`)
+)
+
+// CaptureStats are the statistics tcpdump reports on stderr.
+type CaptureStats struct {
+	// Interface, LinkType (e.g. "EN10MB"), LinkTypeDescription (e.g.
+	// "Ethernet") and SnapLen are reported when tcpdump starts.
+	Interface           string
+	LinkType            string
+	LinkTypeDescription string
+	SnapLen             int
+
+	// Reported is true if tcpdump reported the counters, which it does
+	// when it exits normally.
+	Reported           bool
+	Captured           int
+	ReceivedByFilter   int
+	DroppedByKernel    int
+	DroppedByInterface int
+}
+
+// parseStats parses the stderr output of tcpdump.
+func parseStats(lines []string) *CaptureStats {
+	s := &CaptureStats{}
+	for _, line := range lines {
+		if m := listeningRE.FindStringSubmatch(line); m != nil {
+			s.Interface, s.LinkType, s.LinkTypeDescription = m[1], m[2], m[3]
+			s.SnapLen, _ = strconv.Atoi(m[4])
+			continue
+		}
+		m := counterRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "captured":
+			s.Reported = true
+			s.Captured = n
+		case "received by filter":
+			s.ReceivedByFilter = n
+		case "dropped by kernel":
+			s.DroppedByKernel = n
+		case "dropped by interface":
+			s.DroppedByInterface = n
+		}
+	}
+	return s
+}
+
+// Dropped returns the number of packets dropped by the kernel and the
+// interface.
+func (s *CaptureStats) Dropped() int {
+	return s.DroppedByKernel + s.DroppedByInterface
+}
+
+// Result of looking for packets in a capture with the stats.
+func (s *CaptureStats) Result(seen bool) Result {
+	switch {
+	case seen:
+		return ResultSeen
+	case !s.Reported || s.Dropped() > 0:
+		return ResultInconclusive
+	}
+	return ResultNotSeen
+}
+
+func (s *CaptureStats) String() string {
+	str := fmt.Sprintf("%s (%s, snaplen %d)", s.Interface, s.LinkType, s.SnapLen)
+	if !s.Reported {
+		return str + ": no counters reported"
+	}
+	str += fmt.Sprintf(": %d captured, %d received by filter, %d dropped by kernel", s.Captured, s.ReceivedByFilter, s.DroppedByKernel)
+	if s.DroppedByInterface > 0 {
+		str += fmt.Sprintf(", %d dropped by interface", s.DroppedByInterface)
+	}
+	return str
+}
+
+// Result is the outcome of looking for packets in a capture.
+type Result int
+
+const (
+	// ResultSeen means the packets were captured.
+	ResultSeen Result = iota
+	// ResultNotSeen means the packets were not captured and none were
+	// dropped.
+	ResultNotSeen
+	// ResultInconclusive means the packets were not captured, but packets
+	// were dropped (or tcpdump did not report whether any were), so they
+	// may have arrived.
+	ResultInconclusive
+)
+
+func (r Result) String() string {
+	switch r {
+	case ResultSeen:
+		return "seen"
+	case ResultNotSeen:
+		return "not seen"
+	case ResultInconclusive:
+		return "inconclusive"
+	}
+	return fmt.Sprintf("Result(%d)", int(r))
+}
+
+// Stats returns the statistics reported by tcpdump so far. The counters
+// are only reported once it has exited.
+func (c *Capture) Stats() *CaptureStats {
+	return parseStats(c.Stderr())
+}
+
+// RunWithStats runs tcpdump until it exits and returns its statistics.
+func (r *Runner) RunWithStats(opt *Options, filter string) (*CaptureStats, error) {
+	c, err := r.Start(context.Background(), opt, filter)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Wait()
+	return c.Stats(), err
+}
+
+// Find reads packets from the stream until one matches. If none does
+// before ctx is done or the stream ends, tcpdump is stopped and the result
+// is ResultNotSeen, or ResultInconclusive if the statistics show that
+// packets were dropped. After a match before ctx is done, the stream keeps
+// running; after a match in the packets flushed once ctx is done, it is
+// closed.
+func (s *Stream) Find(ctx context.Context, match func(*Packet) bool) (*Packet, Result, error) {
+	for {
+		select {
+		case p, ok := <-s.Packets():
+			if !ok {
+				return nil, s.Stats().Result(false), s.Err()
+			}
+			if match(p) {
+				return p, ResultSeen, nil
+			}
+		case <-ctx.Done():
+			// Stop gracefully and look through the packets tcpdump
+			// flushes, reading them so that it is not blocked.
+			go s.Stop()
+			for p := range s.Packets() {
+				if match(p) {
+					// The reader would block on the packets that
+					// follow.
+					s.Close()
+					return p, ResultSeen, nil
+				}
+			}
+			return nil, s.Stats().Result(false), s.Err()
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpdump
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/pcap"
+)
+
+func TestParseStats(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc  string
+		lines []string
+		want  CaptureStats
+	}{
+		{
+			desc: "exited",
+			lines: []string{
+				"tcpdump: verbose output suppressed, use -v[v]... for full protocol decode",
+				"tcpdump: listening on eth0, link-type EN10MB (Ethernet), snapshot length 262144 bytes",
+				"12 packets captured",
+				"14 packets received by filter",
+				"2 packets dropped by kernel",
+			},
+			want: CaptureStats{Interface: "eth0", LinkType: "EN10MB", LinkTypeDescription: "Ethernet", SnapLen: 262144,
+				Reported: true, Captured: 12, ReceivedByFilter: 14, DroppedByKernel: 2},
+		},
+		{
+			desc: "old version",
+			lines: []string{
+				"tcpdump: listening on any, link-type LINUX_SLL (Linux cooked), capture size 65535 bytes",
+				"1 packet captured",
+				"1 packet received by filter",
+				"0 packets dropped by kernel",
+				"3 packets dropped by interface",
+			},
+			want: CaptureStats{Interface: "any", LinkType: "LINUX_SLL", LinkTypeDescription: "Linux cooked", SnapLen: 65535,
+				Reported: true, Captured: 1, ReceivedByFilter: 1, DroppedByInterface: 3},
+		},
+		{
+			desc: "cooked v2",
+			lines: []string{
+				"tcpdump: data link type LINUX_SLL2",
+				"tcpdump: listening on any, link-type LINUX_SLL2 (Linux cooked v2), snapshot length 96 bytes",
+			},
+			want: CaptureStats{Interface: "any", LinkType: "LINUX_SLL2", LinkTypeDescription: "Linux cooked v2", SnapLen: 96},
+		},
+		{
+			desc:  "error",
+			lines: []string{"tcpdump: eth9: No such device exists"},
+		},
+	} {
+		if got := parseStats(tc.lines); !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("%s: parseStats() = %+v; want %+v", tc.desc, *got, tc.want)
+		}
+	}
+}
+
+func TestStatsResult(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		stats CaptureStats
+		seen  bool
+		want  Result
+	}{
+		{stats: CaptureStats{Reported: true}, seen: true, want: ResultSeen},
+		{stats: CaptureStats{Reported: true, DroppedByKernel: 1}, seen: true, want: ResultSeen},
+		{stats: CaptureStats{Reported: true}, want: ResultNotSeen},
+		{stats: CaptureStats{Reported: true, DroppedByKernel: 1}, want: ResultInconclusive},
+		{stats: CaptureStats{Reported: true, DroppedByInterface: 1}, want: ResultInconclusive},
+		{stats: CaptureStats{}, want: ResultInconclusive},
+	} {
+		if got := tc.stats.Result(tc.seen); got != tc.want {
+			t.Errorf("%+v.Result(%t) = %v; want %v", tc.stats, tc.seen, got, tc.want)
+		}
+	}
+}
+
+// statsScript prints the ready message, runs body, then waits for SIGINT
+// and prints the counters with the given kernel drops.
+func statsScript(body string, dropped int) string {
+	return fmt.Sprintf(`trap 'echo "2 packets captured" >&2; echo "2 packets received by filter" >&2; echo "%d packets dropped by kernel" >&2; exit 0' INT
+echo "tcpdump: listening on eth0, link-type RAW (Raw IP), snapshot length 262144 bytes" >&2
+%s
+while true; do sleep 0.01; done`, dropped, body)
+}
+
+func TestRunWithStats(t *testing.T) {
+	_, restore := fakeTCPDump(t, `echo "tcpdump: listening on eth0, link-type EN10MB (Ethernet), snapshot length 262144 bytes" >&2
+echo "5 packets captured" >&2
+echo "5 packets received by filter" >&2
+echo "0 packets dropped by kernel" >&2`)
+	defer restore()
+
+	stats, err := (&Runner{}).RunWithStats(&Options{Count: 5}, "")
+	if err != nil {
+		t.Fatalf("RunWithStats() = _, %v; want nil", err)
+	}
+	want := "eth0 (EN10MB, snaplen 262144): 5 captured, 5 received by filter, 0 dropped by kernel"
+	if stats.String() != want {
+		t.Errorf("stats = %q; want %q", stats, want)
+	}
+}
+
+func TestStreamFind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	captureFile := filepath.Join(dir, "capture.pcap")
+	if err := ioutil.WriteFile(captureFile, testCapture(t), 0644); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+
+	hasPayload := func(payload string) func(*Packet) bool {
+		return func(p *Packet) bool { return p.Decoded != nil && strings.HasSuffix(string(p.Decoded.Payload), payload) }
+	}
+	for _, tc := range []struct {
+		desc    string
+		dropped int
+		payload string
+		want    Result
+	}{
+		{desc: "seen", payload: "magic", want: ResultSeen},
+		{desc: "not seen", payload: "other", want: ResultNotSeen},
+		{desc: "dropped", dropped: 3, payload: "other", want: ResultInconclusive},
+	} {
+		func() {
+			_, restore := fakeTCPDump(t, statsScript("cat "+captureFile, tc.dropped))
+			defer restore()
+
+			s, err := (&Runner{}).Stream(context.Background(), &Options{}, "")
+			if err != nil {
+				t.Fatalf("%s: Stream() = _, %v; want nil", tc.desc, err)
+			}
+			defer s.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			p, result, err := s.Find(ctx, hasPayload(tc.payload))
+			if err != nil {
+				t.Errorf("%s: Find() = _, _, %v; want nil", tc.desc, err)
+			}
+			if result != tc.want || (result == ResultSeen) != (p != nil) {
+				t.Errorf("%s: Find() = %v, %v; want %v", tc.desc, p, result, tc.want)
+			}
+			if result != ResultSeen && s.Stats().DroppedByKernel != tc.dropped {
+				t.Errorf("%s: Stats() = %v; want %d dropped", tc.desc, s.Stats(), tc.dropped)
+			}
+		}()
+	}
+}
+
+func TestStreamFindFlushed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// tcpdump flushes more packets than the channel and the pipe hold once
+	// it is interrupted.
+	capture := testCapture(t)
+	headerFile := filepath.Join(dir, "header.pcap")
+	packetsFile := filepath.Join(dir, "packets")
+	if err := ioutil.WriteFile(headerFile, capture[:pcap.FileHeaderSize], 0644); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	packets := bytes.Repeat(capture[pcap.FileHeaderSize:], 2000)
+	if err := ioutil.WriteFile(packetsFile, packets, 0644); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	_, restore := fakeTCPDump(t, fmt.Sprintf(`trap 'cat %s; exit 0' INT
+echo "tcpdump: listening on eth0, link-type RAW (Raw IP), snapshot length 262144 bytes" >&2
+cat %s
+while true; do sleep 0.01; done`, packetsFile, headerFile))
+	defer restore()
+
+	s, err := (&Runner{}).Stream(context.Background(), &Options{}, "")
+	if err != nil {
+		t.Fatalf("Stream() = _, %v; want nil", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	p, result, err := s.Find(ctx, func(p *Packet) bool { return p.Decoded != nil })
+	if err != nil || result != ResultSeen || p == nil {
+		t.Errorf("Find() = %v, %v, %v; want a packet, %v, nil", p, result, err, ResultSeen)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(StopGracePeriod / 2):
+		t.Fatalf("tcpdump still running %v after Find() returned", time.Since(start))
+	}
+}
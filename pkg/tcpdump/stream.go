@@ -0,0 +1,186 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpdump
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/pcap"
+	"github.com/golang/glog"
+)
+
+const streamChannelCapacity = 64
+
+// ErrStreamOptions is returned by Stream for options that write files.
+var ErrStreamOptions = errors.New("OutputFile, FileSize, RotateSeconds and FileCountLimit cannot be used when streaming")
+
+// Packet is a packet captured by a Stream.
+type Packet struct {
+	Timestamp time.Time
+	// Data is the captured bytes, starting with the link layer header.
+	Data []byte
+	// Length of the packet on the wire.
+	Length int
+	// LinkType of Data.
+	LinkType pcap.LinkType
+	// Decoded is the IP and transport layer of the packet. This is nil if
+	// the packet is not IP or could not be decoded. Lighthouse probes can
+	// be found with probe.DecodePacket(Decoded.IP).
+	Decoded *pcap.Decoded
+}
+
+// Stream is a running tcpdump whose packets are decoded as they are
+// captured. The Capture methods control the lifecycle of tcpdump; after
+// Stop, the packets it flushes are still delivered.
+type Stream struct {
+	*Capture
+	packets chan *Packet
+	// closed is closed by Close, so that packets are no longer sent.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// Stream runs tcpdump, writing the capture to a pipe (-w - -U), and
+// returns the Stream of its packets. tcpdump is stopped when ctx is done.
+func (r *Runner) Stream(ctx context.Context, opt *Options, filter string) (*Stream, error) {
+	if opt.OutputFile != "" || opt.FileSize != 0 || opt.RotateSeconds != 0 || opt.FileCountLimit != 0 {
+		return nil, ErrStreamOptions
+	}
+	if err := r.checkOptions(opt); err != nil {
+		return nil, err
+	}
+	if err := r.CheckFilter(filter); err != nil {
+		return nil, err
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	streamOpt := *opt
+	streamOpt.OutputFile = "-"
+	// -U writes each packet as it arrives instead of buffering.
+	c, err := startCapture(ctx, append([]string{"-U"}, args(&streamOpt, filter)...), pw)
+	// tcpdump has its own copy of the write end.
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	s := &Stream{
+		Capture: c,
+		packets: make(chan *Packet, streamChannelCapacity),
+		closed:  make(chan struct{}),
+	}
+	go s.read(pr)
+	return s, nil
+}
+
+// Packets returns the channel of captured packets. It is closed when
+// tcpdump exits, after which Err reports why.
+func (s *Stream) Packets() <-chan *Packet {
+	return s.packets
+}
+
+// Err returns the error that ended the stream, if any. It is only valid
+// once the Packets channel is closed.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops tcpdump. Packets that have not been read are dropped and the
+// Packets channel is closed.
+func (s *Stream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.Stop()
+	})
+	return err
+}
+
+// read decodes the capture from tcpdump until it exits.
+func (s *Stream) read(r *os.File) {
+	defer close(s.packets)
+	defer r.Close()
+
+	err := s.decode(r)
+	// Drain the pipe so that tcpdump is not blocked writing to it.
+	io.Copy(ioutil.Discard, r)
+	if waitErr := s.Wait(); err == nil {
+		err = waitErr
+	}
+	select {
+	case <-s.closed:
+		err = nil
+	default:
+	}
+	glog.V(2).Infof("tcpdump stream ended: %v", err)
+
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// decode packets from the pcap stream r and send them on the channel. It
+// returns nil at the end of the stream.
+func (s *Stream) decode(r io.Reader) error {
+	rd, err := pcap.NewReader(r)
+	if err != nil {
+		if err == io.EOF {
+			// tcpdump exited before writing anything.
+			return nil
+		}
+		return err
+	}
+	for {
+		p, err := rd.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case s.packets <- decodePacket(rd.LinkType(), p):
+		case <-s.closed:
+			return nil
+		}
+	}
+}
+
+func decodePacket(linkType pcap.LinkType, p *pcap.Packet) *Packet {
+	pkt := &Packet{Timestamp: p.Timestamp, Data: p.Data, Length: p.Length, LinkType: linkType}
+	d, err := pcap.Decode(linkType, p.Data)
+	if err != nil {
+		return pkt
+	}
+	pkt.Decoded = d
+	return pkt
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpdump
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bowei/lighthouse/pkg/flags"
+	"github.com/bowei/lighthouse/pkg/pcap"
+)
+
+// fakeTCPDump installs a script as flags.TCPDumpExecutable. The script
+// records its arguments in the returned file, rejects the filter "bad"
+// and otherwise runs body. It returns a function to restore the flag.
+func fakeTCPDump(t *testing.T, body string) (string, func()) {
+	dir, err := ioutil.TempDir("", "tcpdump")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	argsFile := filepath.Join(dir, "args")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "-d" ]; then
+  [ "$2" != "bad" ]
+  exit
+fi
+echo "$@" > %s
+%s
+`, argsFile, body)
+	executable := filepath.Join(dir, "tcpdump")
+	if err := ioutil.WriteFile(executable, []byte(script), 0755); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+
+	saved := flags.TCPDumpExecutable
+	flags.TCPDumpExecutable = executable
+	return argsFile, func() {
+		flags.TCPDumpExecutable = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func readArgs(t *testing.T, argsFile string) string {
+	b, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) = _, %v", argsFile, err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestArgs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		opt    Options
+		filter string
+		want   []string
+	}{
+		{},
+		{filter: "tcp port 80", want: []string{"tcp port 80"}},
+		{
+			opt:    Options{Count: 10, FileSize: 2, RotateSeconds: 60, Interface: "eth0", SnapLen: 96, OutputFile: "out.pcap", FileCountLimit: 3},
+			filter: "icmp",
+			want:   []string{"-c", "10", "-C", "2", "-G", "60", "-i", "eth0", "-s", "96", "-w", "out.pcap", "-W", "3", "icmp"},
+		},
+		{
+			opt: Options{NoResolve: true, NoPromiscuous: true, BufferSize: 4096, ImmediateMode: true, Direction: DirectionIn,
+				TimestampType: "adapter", NanoPrecision: true, User: "nobody", PostRotateCommand: "gzip"},
+			want: []string{"-n", "-p", "-B", "4096", "--immediate-mode", "-Q", "in", "-j", "adapter",
+				"--time-stamp-precision=nano", "-Z", "nobody", "-z", "gzip"},
+		},
+	} {
+		if got := args(&tc.opt, tc.filter); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("args(%+v, %q) = %q; want %q", tc.opt, tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		desc    string
+		opt     Options
+		wantErr bool
+	}{
+		{desc: "empty"},
+		{desc: "all", opt: Options{Count: 1, FileSize: 1, OutputFile: "x", BufferSize: 1024, Direction: DirectionInOut,
+			TimestampType: "host_hiprec", PostRotateCommand: "gzip"}},
+		{desc: "negative count", opt: Options{Count: -1}, wantErr: true},
+		{desc: "negative buffer size", opt: Options{BufferSize: -1}, wantErr: true},
+		{desc: "direction", opt: Options{Direction: "both"}, wantErr: true},
+		{desc: "timestamp type", opt: Options{TimestampType: "gps"}, wantErr: true},
+		{desc: "post-rotate without rotation", opt: Options{OutputFile: "x", PostRotateCommand: "gzip"}, wantErr: true},
+		{desc: "post-rotate without file", opt: Options{RotateSeconds: 1, PostRotateCommand: "gzip"}, wantErr: true},
+	} {
+		if err := tc.opt.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: Validate() = %v; want error %t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+// testCapture returns a capture with a UDP packet with the payload "magic"
+// and an ARP packet.
+func testCapture(t *testing.T) []byte {
+	payload := []byte("magic")
+	ip := []byte{
+		0x45, 0, 0, byte(28 + len(payload)), 0, 1, 0x40, 0, 64, 17, 0, 0,
+		10, 0, 0, 1, 10, 0, 0, 2,
+		0x0b, 0xb8, 0, 53, 0, byte(8 + len(payload)), 0, 0,
+	}
+	ip = append(ip, payload...)
+
+	var buf bytes.Buffer
+	w, err := pcap.NewWriter(&buf, 0, pcap.LinkTypeRaw)
+	if err != nil {
+		t.Fatalf("NewWriter() = _, %v", err)
+	}
+	w.WritePacket(time.Unix(100, 0), ip, 0)
+	w.WritePacket(time.Unix(101, 0), []byte{0}, 0)
+	return buf.Bytes()
+}
+
+func TestStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	captureFile := filepath.Join(dir, "capture.pcap")
+	if err := ioutil.WriteFile(captureFile, testCapture(t), 0644); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+
+	argsFile, restore := fakeTCPDump(t, "cat "+captureFile)
+	defer restore()
+
+	s, err := (&Runner{}).Stream(context.Background(), &Options{Interface: "eth0", Count: 2}, "udp")
+	if err != nil {
+		t.Fatalf("Stream() = _, %v; want nil", err)
+	}
+	var got []*Packet
+	for p := range s.Packets() {
+		got = append(got, p)
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("Err() = %v; want nil", err)
+	}
+	if want := "-U -c 2 -i eth0 -w - udp"; readArgs(t, argsFile) != want {
+		t.Errorf("tcpdump args = %q; want %q", readArgs(t, argsFile), want)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("got %d packets; want 2", len(got))
+	}
+	p := got[0]
+	if !p.Timestamp.Equal(time.Unix(100, 0)) || p.LinkType != pcap.LinkTypeRaw || p.Decoded == nil {
+		t.Fatalf("packet 0 = %+v; want decoded raw packet at 100", p)
+	}
+	if p.Decoded.Src.String() != "10.0.0.1" || p.Decoded.SrcPort != 3000 || p.Decoded.DestPort != 53 {
+		t.Errorf("packet 0 decoded = %+v; want 10.0.0.1:3000 > :53", p.Decoded)
+	}
+	if !strings.HasSuffix(string(p.Decoded.Payload), "magic") {
+		t.Errorf("packet 0 payload = %q; want UDP data magic", p.Decoded.Payload)
+	}
+	if got[1].Decoded != nil {
+		t.Errorf("packet 1 = %+v; want undecoded", got[1])
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	_, restore := fakeTCPDump(t, "exit 1")
+	defer restore()
+
+	r := &Runner{}
+	if _, err := r.Stream(context.Background(), &Options{OutputFile: "out.pcap"}, ""); err != ErrStreamOptions {
+		t.Errorf("Stream(OutputFile) = _, %v; want %v", err, ErrStreamOptions)
+	}
+	if _, err := r.Stream(context.Background(), &Options{}, "bad"); err != ErrBadSyntax {
+		t.Errorf("Stream(bad filter) = _, %v; want %v", err, ErrBadSyntax)
+	}
+
+	s, err := r.Stream(context.Background(), &Options{}, "")
+	if err != nil {
+		t.Fatalf("Stream() = _, %v; want nil", err)
+	}
+	for range s.Packets() {
+		t.Errorf("got a packet; want none")
+	}
+	if s.Err() == nil {
+		t.Errorf("Err() = nil; want the exit status of tcpdump")
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatalf("TempDir() = _, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	captureFile := filepath.Join(dir, "capture.pcap")
+	if err := ioutil.WriteFile(captureFile, testCapture(t), 0644); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+
+	// Write the packets, then keep running until killed.
+	_, restore := fakeTCPDump(t, fmt.Sprintf("cat %s; exec sleep 60", captureFile))
+	defer restore()
+
+	s, err := (&Runner{}).Stream(context.Background(), &Options{}, "")
+	if err != nil {
+		t.Fatalf("Stream() = _, %v; want nil", err)
+	}
+	if p := <-s.Packets(); p == nil || p.Decoded == nil {
+		t.Fatalf("first packet = %+v; want the UDP packet", p)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() = %v; want nil", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case _, ok := <-s.Packets():
+			done = !ok
+		case <-timeout:
+			t.Fatalf("Packets() not closed 5s after Close()")
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("Err() = %v; want nil after Close", err)
+	}
+}
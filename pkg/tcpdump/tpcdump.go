@@ -17,9 +17,11 @@ limitations under the License.
 package tcpdump
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os/exec"
+	"sync"
 
 	"github.com/bowei/lighthouse/pkg/flags"
 	"github.com/golang/glog"
@@ -30,7 +32,7 @@ var (
 	ErrBadSyntax = errors.New("invalid filter syntax")
 )
 
-// Options for tcpdump.
+// Options for tcpdump. Direction is one of the Direction constants.
 type Options struct {
 	Count          int    // -c
 	FileSize       int    // -C
@@ -39,10 +41,71 @@ type Options struct {
 	SnapLen        int    // -s
 	OutputFile     string // -w
 	FileCountLimit int    // -W
+
+	NoResolve         bool   // -n
+	NoPromiscuous     bool   // -p
+	BufferSize        int    // -B, in KiB
+	ImmediateMode     bool   // --immediate-mode
+	Direction         string // -Q
+	TimestampType     string // -j
+	NanoPrecision     bool   // --time-stamp-precision=nano
+	User              string // -Z
+	PostRotateCommand string // -z
+}
+
+// Directions for Options.Direction.
+const (
+	DirectionIn    = "in"
+	DirectionOut   = "out"
+	DirectionInOut = "inout"
+)
+
+// timestampTypes known to libpcap, for Options.TimestampType.
+var timestampTypes = map[string]bool{
+	"host":                 true,
+	"host_lowprec":         true,
+	"host_hiprec":          true,
+	"host_hiprec_unsynced": true,
+	"adapter":              true,
+	"adapter_unsynced":     true,
+}
+
+// Validate checks that the options are consistent.
+func (opt *Options) Validate() error {
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"Count", opt.Count},
+		{"FileSize", opt.FileSize},
+		{"RotateSeconds", opt.RotateSeconds},
+		{"SnapLen", opt.SnapLen},
+		{"FileCountLimit", opt.FileCountLimit},
+		{"BufferSize", opt.BufferSize},
+	} {
+		if v.value < 0 {
+			return fmt.Errorf("%s must not be negative, got %d", v.name, v.value)
+		}
+	}
+	switch opt.Direction {
+	case "", DirectionIn, DirectionOut, DirectionInOut:
+	default:
+		return fmt.Errorf("invalid Direction %q, must be %q, %q or %q", opt.Direction, DirectionIn, DirectionOut, DirectionInOut)
+	}
+	if opt.TimestampType != "" && !timestampTypes[opt.TimestampType] {
+		return fmt.Errorf("invalid TimestampType %q", opt.TimestampType)
+	}
+	if opt.PostRotateCommand != "" && (opt.OutputFile == "" || opt.FileSize == 0 && opt.RotateSeconds == 0) {
+		return fmt.Errorf("PostRotateCommand requires OutputFile and FileSize or RotateSeconds")
+	}
+	return nil
 }
 
 // Runner manages the execution of tcpdump.
 type Runner struct {
+	versionOnce sync.Once
+	version     Version
+	versionErr  error
 }
 
 // CheckFilter checks the syntax of a BPF filter.
@@ -61,43 +124,68 @@ func (r *Runner) CheckFilter(filter string) error {
 	return nil
 }
 
-// Run tcpdump.
+// Run tcpdump until it exits.
 func (r *Runner) Run(opt *Options, filter string) error {
-	if err := r.CheckFilter(filter); err != nil {
+	c, err := r.Start(context.Background(), opt, filter)
+	if err != nil {
 		return err
 	}
+	return c.Wait()
+}
 
-	cmd := exec.Cmd{
-		Args: []string{flags.TCPDumpExecutable},
-		Path: flags.TCPDumpExecutable,
-	}
-
+// args returns the tcpdump arguments for opt and filter.
+func args(opt *Options, filter string) []string {
+	var args []string
 	if opt.Count != 0 {
-		cmd.Args = append(cmd.Args, "-c", fmt.Sprintf("%d", opt.Count))
+		args = append(args, "-c", fmt.Sprintf("%d", opt.Count))
 	}
 	if opt.FileSize != 0 {
-		cmd.Args = append(cmd.Args, "-C", fmt.Sprintf("%d", opt.FileSize))
+		args = append(args, "-C", fmt.Sprintf("%d", opt.FileSize))
 	}
 	if opt.RotateSeconds != 0 {
-		cmd.Args = append(cmd.Args, "-G", fmt.Sprintf("%d", opt.RotateSeconds))
+		args = append(args, "-G", fmt.Sprintf("%d", opt.RotateSeconds))
 	}
 	if opt.Interface != "" {
-		cmd.Args = append(cmd.Args, "-i", opt.Interface)
+		args = append(args, "-i", opt.Interface)
 	}
 	if opt.SnapLen != 0 {
-		cmd.Args = append(cmd.Args, "-s", fmt.Sprintf("%d", opt.SnapLen))
+		args = append(args, "-s", fmt.Sprintf("%d", opt.SnapLen))
 	}
 	if opt.OutputFile != "" {
-		cmd.Args = append(cmd.Args, "-w", opt.OutputFile)
+		args = append(args, "-w", opt.OutputFile)
 	}
 	if opt.FileCountLimit != 0 {
-		cmd.Args = append(cmd.Args, "-W", fmt.Sprintf("%d", opt.FileCountLimit))
+		args = append(args, "-W", fmt.Sprintf("%d", opt.FileCountLimit))
+	}
+	if opt.NoResolve {
+		args = append(args, "-n")
+	}
+	if opt.NoPromiscuous {
+		args = append(args, "-p")
+	}
+	if opt.BufferSize != 0 {
+		args = append(args, "-B", fmt.Sprintf("%d", opt.BufferSize))
+	}
+	if opt.ImmediateMode {
+		args = append(args, "--immediate-mode")
+	}
+	if opt.Direction != "" {
+		args = append(args, "-Q", opt.Direction)
+	}
+	if opt.TimestampType != "" {
+		args = append(args, "-j", opt.TimestampType)
+	}
+	if opt.NanoPrecision {
+		args = append(args, "--time-stamp-precision=nano")
+	}
+	if opt.User != "" {
+		args = append(args, "-Z", opt.User)
+	}
+	if opt.PostRotateCommand != "" {
+		args = append(args, "-z", opt.PostRotateCommand)
 	}
 	if filter != "" {
-		cmd.Args = append(cmd.Args, filter)
+		args = append(args, filter)
 	}
-
-	glog.V(4).Infof("tcpdump = %+v", cmd)
-
-	return cmd.Run()
+	return args
 }
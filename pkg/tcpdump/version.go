@@ -0,0 +1,141 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpdump
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/bowei/lighthouse/pkg/flags"
+	"github.com/golang/glog"
+)
+
+// versionRE matches the version line printed by tcpdump --version, or by
+// tcpdump -h for versions without --version.
+var versionRE = regexp.MustCompile(`tcpdump version (\d+)\.(\d+)(?:\.(\d+))?`)
+
+// Version of tcpdump.
+type Version struct {
+	Major, Minor, Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast returns true if v is the same as or later than other.
+func (v Version) AtLeast(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor > other.Minor
+	}
+	return v.Patch >= other.Patch
+}
+
+// ParseVersion parses the output of tcpdump --version.
+func ParseVersion(output string) (Version, error) {
+	m := versionRE.FindStringSubmatch(output)
+	if m == nil {
+		return Version{}, fmt.Errorf("no tcpdump version in %q", output)
+	}
+	var v Version
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		v.Patch, _ = strconv.Atoi(m[3])
+	}
+	return v, nil
+}
+
+// optionVersions lists the options that need a particular tcpdump
+// version. Some of them also need a recent enough libpcap, which tcpdump
+// reports when it starts.
+var optionVersions = []struct {
+	flag    string
+	set     func(*Options) bool
+	version Version
+}{
+	{"-Z", func(opt *Options) bool { return opt.User != "" }, Version{3, 9, 0}},
+	{"-B", func(opt *Options) bool { return opt.BufferSize != 0 }, Version{4, 0, 0}},
+	{"-z", func(opt *Options) bool { return opt.PostRotateCommand != "" }, Version{4, 0, 0}},
+	{"-j", func(opt *Options) bool { return opt.TimestampType != "" }, Version{4, 2, 0}},
+	{"-Q", func(opt *Options) bool { return opt.Direction != "" }, Version{4, 6, 0}},
+	{"--time-stamp-precision", func(opt *Options) bool { return opt.NanoPrecision }, Version{4, 6, 0}},
+	{"--immediate-mode", func(opt *Options) bool { return opt.ImmediateMode }, Version{4, 7, 0}},
+}
+
+// Supports returns nil if tcpdump version v supports all of opt, or an
+// error naming the first option it does not.
+func (v Version) Supports(opt *Options) error {
+	for _, ov := range optionVersions {
+		if ov.set(opt) && !v.AtLeast(ov.version) {
+			return fmt.Errorf("%s requires tcpdump %v or later, have %v", ov.flag, ov.version, v)
+		}
+	}
+	return nil
+}
+
+// needsVersion returns true if any of opt depends on the tcpdump version.
+func needsVersion(opt *Options) bool {
+	for _, ov := range optionVersions {
+		if ov.set(opt) {
+			return true
+		}
+	}
+	return false
+}
+
+// Version returns the version of the installed tcpdump. It is run once
+// and the result is cached.
+func (r *Runner) Version() (Version, error) {
+	r.versionOnce.Do(func() {
+		cmd := exec.Cmd{
+			Args: []string{flags.TCPDumpExecutable, "--version"},
+			Path: flags.TCPDumpExecutable,
+		}
+		glog.V(4).Infof("tcpdump = %+v", cmd)
+		// Versions without --version print usage, including the version,
+		// and exit with an error, so the output is parsed regardless.
+		out, err := cmd.CombinedOutput()
+		r.version, r.versionErr = ParseVersion(string(out))
+		if r.versionErr != nil && err != nil {
+			r.versionErr = err
+		}
+		glog.V(2).Infof("tcpdump version = %v, %v", r.version, r.versionErr)
+	})
+	return r.version, r.versionErr
+}
+
+// checkOptions validates opt and checks that the installed tcpdump
+// supports it.
+func (r *Runner) checkOptions(opt *Options) error {
+	if err := opt.Validate(); err != nil {
+		return err
+	}
+	if !needsVersion(opt) {
+		return nil
+	}
+	v, err := r.Version()
+	if err != nil {
+		return fmt.Errorf("cannot determine tcpdump version: %v", err)
+	}
+	return v.Supports(opt)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpdump
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		output  string
+		want    Version
+		wantErr bool
+	}{
+		{output: "tcpdump version 4.9.3\nlibpcap version 1.8.1\nOpenSSL 1.1.1d  10 Sep 2019\n", want: Version{4, 9, 3}},
+		{output: "tcpdump version 4.99.1\nlibpcap version 1.10.1 (with TPACKET_V3)\n", want: Version{4, 99, 1}},
+		{output: "tcpdump version 4.1\nlibpcap version 1.1.1\nUsage: tcpdump [-aAdDefIKlLnNOpqRStuUvxX]\n", want: Version{4, 1, 0}},
+		{output: "tcpdump: unrecognized option '--version'", wantErr: true},
+	} {
+		got, err := ParseVersion(tc.output)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseVersion(%q) = %v, %v; want %v, error %t", tc.output, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestVersionSupports(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		version Version
+		opt     Options
+		wantErr bool
+	}{
+		{version: Version{3, 8, 0}, opt: Options{NoResolve: true, NoPromiscuous: true}},
+		{version: Version{4, 6, 0}, opt: Options{Direction: DirectionOut, NanoPrecision: true}},
+		{version: Version{4, 5, 1}, opt: Options{Direction: DirectionOut}, wantErr: true},
+		{version: Version{4, 6, 2}, opt: Options{ImmediateMode: true}, wantErr: true},
+		{version: Version{4, 7, 0}, opt: Options{ImmediateMode: true}},
+		{version: Version{5, 0, 0}, opt: Options{ImmediateMode: true, BufferSize: 1, User: "nobody"}},
+	} {
+		if err := tc.version.Supports(&tc.opt); (err != nil) != tc.wantErr {
+			t.Errorf("%v.Supports(%+v) = %v; want error %t", tc.version, tc.opt, err, tc.wantErr)
+		}
+	}
+}
+
+func TestStartCheckVersion(t *testing.T) {
+	_, restore := fakeTCPDump(t, `if [ "$1" = "--version" ]; then
+  echo "tcpdump version 4.6.2"
+  echo "libpcap version 1.6.2"
+fi`)
+	defer restore()
+
+	r := &Runner{}
+	if _, err := r.Start(context.Background(), &Options{ImmediateMode: true}, ""); err == nil {
+		t.Errorf("Start(ImmediateMode) = _, nil; want error")
+	}
+	c, err := r.Start(context.Background(), &Options{Direction: DirectionIn}, "")
+	if err != nil {
+		t.Fatalf("Start(Direction) = _, %v; want nil", err)
+	}
+	if err := c.Wait(); err != nil {
+		t.Errorf("Wait() = %v; want nil", err)
+	}
+	if v, err := r.Version(); err != nil || v != (Version{4, 6, 2}) {
+		t.Errorf("Version() = %v, %v; want 4.6.2, nil", v, err)
+	}
+}
+
+func TestVersionError(t *testing.T) {
+	_, restore := fakeTCPDump(t, `echo "tcpdump: unrecognized option" >&2; exit 1`)
+	defer restore()
+
+	r := &Runner{}
+	if _, err := r.Version(); err == nil {
+		t.Errorf("Version() = _, nil; want error")
+	}
+	if _, err := r.Start(context.Background(), &Options{Direction: DirectionIn}, ""); err == nil {
+		t.Errorf("Start(Direction) = _, nil; want error")
+	}
+}